@@ -1,23 +1,162 @@
 package config
 
+// Constants that are also fields of Config (see settings.go) are only its defaults,
+// code reads them from the Config a node is initialized with.
+
 const (
 	// InitialChainDifficulty is equal to four times the number of zeros at hash value head.
 	InitialChainDifficulty = 16
+	// MinChainDifficulty is the lowest difficulty retargeting can reach
+	MinChainDifficulty = 8
+	// RetargetInterval is the number of blocks between two difficulty adjustments, should be at least 2
+	RetargetInterval = 10
+	// TargetBlockInterval is the expected time (in milliseconds) between two blocks
+	TargetBlockInterval = 10000
+	// MaxDifficultyAdjustment bounds the change of difficulty in a single retarget
+	MaxDifficultyAdjustment = 2
+	// MaxFutureBlockTime is how far (in milliseconds) a block timestamp may be ahead of local time
+	MaxFutureBlockTime = 2 * 60 * 60 * 1000
 	// MiningReward is the number of coins given to each block
 	MiningReward = 100
+	// MaxBlockTXBytes bounds the total serialized size of transactions in a block
+	MaxBlockTXBytes = 256 * 1024
 
-	// PersistentStoragePath is where we store the chain on disk
+	// PersistentStoragePath is where we store the chain on disk, each user has a directory in it
 	PersistentStoragePath = "./tmp/"
-	WalletFileName        = "/wallets.data"
-	BlockchainPath        = "/blocks"
-	UTXOSetPath           = "/utxo.data"
+	// WalletFileName, BlockchainPath, PeerFileName and RPCTokenFileName are inside directory of each user
+	WalletFileName   = "/wallets.data"
+	BlockchainPath   = "/blocks"
+	PeerFileName     = "/peers.data"
+	RPCTokenFileName = "/rpc.token"
+
+	// MaxOrphanBlocks bounds the number of blocks waiting for their parents
+	MaxOrphanBlocks = 100
+	// MaxOrphanBlocksPerPeer bounds the number of orphan blocks from a single peer
+	MaxOrphanBlocksPerPeer = 20
+	// OrphanBlockExpiry is how long (in milliseconds) an orphan block waits for its parent
+	OrphanBlockExpiry = 10 * 60 * 1000
+
+	// MaxPendingTXs bounds the number of transactions in mempool
+	MaxPendingTXs = 1000
+	// MaxPendingTXBytes bounds the total serialized size of transactions in mempool
+	MaxPendingTXBytes = 1 << 20
+	// PendingTXExpiry is how long (in milliseconds) a transaction may stay in mempool
+	PendingTXExpiry = 60 * 60 * 1000
+
+	// ProtocolVersion is exchanged in handshake, peers with another version are rejected
+	ProtocolVersion = 1
+	// HandshakeTimeout is how long (in milliseconds) dialing and handshake with a peer may take
+	HandshakeTimeout = 5000
+	// WriteTimeout is how long (in milliseconds) sending a message may take, a peer that does
+	// not read in time is dropped
+	WriteTimeout = 10000
+	// MaxMessageSize bounds the payload of a single network message
+	MaxMessageSize = 32 * 1024 * 1024
+	// MaxHandshakeMessageSize bounds payload of messages before handshake is done
+	MaxHandshakeMessageSize = 64 * 1024
+	// MaxQueuedMessages is how many messages of a connection may wait to be handled before
+	// we stop reading from it
+	MaxQueuedMessages = 16
+	// MaxKnownInventory bounds the number of transactions and blocks remembered as known by each peer
+	MaxKnownInventory = 5000
+	// GetDataTimeout is how long (in milliseconds) we wait for requested data before asking again
+	GetDataTimeout = 5000
+	// MaxMisbehaviorScore is the misbehavior score at which a peer is banned for BanDuration milliseconds
+	MaxMisbehaviorScore = 100
+	BanDuration         = 10 * 60 * 1000
+	// MalformedMessageScore, InvalidTXScore and InvalidBlockScore are added to misbehavior score
+	// of a peer for messages that can not be decoded, invalid transactions and invalid blocks
+	MalformedMessageScore = 20
+	InvalidTXScore        = 10
+	InvalidBlockScore     = 100
+
+	// MaxInboundConnections and MaxOutboundConnections bound connections accepted from and dialed to peers
+	MaxInboundConnections  = 32
+	MaxOutboundConnections = 16
+	// MaxVerifyDialsPerIP bounds dials in flight to one IP that check listen addresses claimed by
+	// inbound peers, these dials are closed after handshake and do not count as outbound connections
+	MaxVerifyDialsPerIP = 2
+	// MaxAddressBookSize bounds the number of peers in connection pool
+	MaxAddressBookSize = 1000
+	// MaxPeerFailures is the number of failed dials or sends in a row after which a peer is removed,
+	// after each failure a peer is not tried for PeerRetryBackoff milliseconds, doubled for each failure
+	MaxPeerFailures  = 5
+	PeerRetryBackoff = 1000
+	// PeerExpiry is how long (in milliseconds) a peer that is not connected stays in pool without being heard from
+	PeerExpiry = 24 * 60 * 60 * 1000
+	// PeerMaintenanceInterval is how often (in milliseconds) stale peers are removed and the address book is saved
+	PeerMaintenanceInterval = 60 * 1000
+
+	// MaxHeadersPerMessage bounds the number of block headers sent for a single getheaders message
+	MaxHeadersPerMessage = 2000
+	// MaxLocatorHashes bounds the number of hashes in the block locator of a getheaders message
+	MaxLocatorHashes = 64
+	// HeaderSyncTimeout is how long (in milliseconds) we wait for headers before asking another peer
+	HeaderSyncTimeout = 10000
+	// BlockDownloadWindow is how far (in blocks) beyond the first missing block of header chain
+	// blocks are downloaded, MaxBlocksInFlightPerPeer bounds the blocks requested from a single peer
+	BlockDownloadWindow      = 128
+	MaxBlocksInFlightPerPeer = 16
+	// BlockStallTimeout is how long (in milliseconds) we wait for a requested block before asking
+	// another peer, the peer that stalls is not asked for blocks for PeerStallDuration milliseconds
+	BlockStallTimeout = 5000
+	PeerStallDuration = 30000
+	// SyncProgressInterval is how often (in milliseconds) sync progress is printed
+	SyncProgressInterval = 5000
+
+	// RPCHost is the interface RPC server listens on, it only serves local clients
+	RPCHost = "127.0.0.1"
+	// MaxRPCRequestSize bounds the body of a single RPC request
+	MaxRPCRequestSize = 1 << 20
+	// RPCTokenLength is the number of random bytes in a generated RPC auth token
+	RPCTokenLength = 16
+	// DefaultListenAddress is where peers reach a node unless another address is configured
+	DefaultListenAddress = "localhost:5000"
+	// DefaultRPCPort is the port of RPC server started by 'node start' and dialed by other commands
+	DefaultRPCPort = "5500"
+	// RPCClientTimeout is how long (in milliseconds) a command waits for RPC server, mining may take a while
+	RPCClientTimeout = 10 * 60 * 1000
+	// RPCShutdownTimeout is how long (in milliseconds) stopping RPC server waits for requests being handled
+	RPCShutdownTimeout = 5000
 
 	// GenesisData is contained in Data field of genesis block
 	GenesisData = "Genesis"
+	// GenesisTimestamp is the fixed timestamp (in milliseconds) of genesis block
+	GenesisTimestamp = 1650000000000
+	// ChainID is committed to by transaction signatures, so that they can not be replayed on other chains
+	ChainID = "AntonyMei/Blockchain"
+	// NetworkMagic starts every network message, "BLKC"
+	NetworkMagic = 0x424c4b43
+	// regtest is a separate network, see RegtestChainParams, its magic is "REGT"
+	RegtestNetworkID   = "regtest"
+	RegtestMagic       = 0x52454754
+	RegtestGenesisData = "Regtest genesis"
+	// GeneratedBlockData: description of blocks created by generate
+	GeneratedBlockData = "Generated block"
 	// CoinbaseSig is signature of coinbase transactions
 	CoinbaseSig = "Coinbase Signature"
 
 	// ChecksumLength is used by wallet
 	ChecksumLength = 4
 	WalletVersion  = byte(0x00)
+	// MnemonicEntropyLength is the number of random bytes behind a wallet mnemonic
+	MnemonicEntropyLength = 16
+	// HDSeedKey is the HMAC key that turns a seed into the master key of HD wallets
+	HDSeedKey = "Blockchain seed"
+	// HDCoinType is the coin type level of HD wallet paths m/44'/coin'/0'/chain/index
+	HDCoinType = 1
+	// HDGapLimit is how many unused addresses in a row end the scan when restoring wallets
+	HDGapLimit = 20
+	// WalletScryptN, WalletScryptR and WalletScryptP are scrypt cost parameters of the
+	// key that encrypts wallet file, they are saved in the file when it is encrypted
+	WalletScryptN = 1 << 15
+	WalletScryptR = 8
+	WalletScryptP = 1
+	// WalletSaltLength is the length of random scrypt salt of wallet file
+	WalletSaltLength = 16
+	// WalletFileVersion is the format of wallet file, files without it keep their mnemonic
+	// in plain text and are encrypted when loaded
+	WalletFileVersion = 1
+	// WalletUnlockTimeout is how long (in seconds) wallets stay unlocked by default
+	WalletUnlockTimeout = 5 * 60
 )
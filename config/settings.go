@@ -0,0 +1,357 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config holds the settings a node can change without recompiling. Defaults are the
+// constants in config.go, a YAML or JSON file, environment variables and command line
+// flags are applied on top of them, in that order. A chain spec file, if given, replaces
+// the chain section as a whole.
+
+type Allocation struct {
+	// Address: hex, as wallets print it
+	Address string `yaml:"address" json:"address"`
+	Amount  int    `yaml:"amount" json:"amount"`
+}
+
+type RewardEra struct {
+	// Reward is paid for blocks from Height on, until the next era
+	Height int `yaml:"height" json:"height"`
+	Reward int `yaml:"reward" json:"reward"`
+}
+
+type ChainParams struct {
+	// nodes with different chain params can not share a chain
+	// NetworkID is committed to by transaction signatures and Magic starts every network
+	// message, so that transactions and messages of one network are rejected by others
+	NetworkID string `yaml:"network_id" json:"network_id"`
+	Magic     uint32 `yaml:"magic" json:"magic"`
+	// genesis block is derived from these, Premine is paid by its coinbase
+	GenesisTimestamp int64        `yaml:"genesis_timestamp" json:"genesis_timestamp"`
+	GenesisData      string       `yaml:"genesis_data" json:"genesis_data"`
+	Premine          []Allocation `yaml:"premine" json:"premine"`
+	// MiningReward is paid until the first era of RewardSchedule
+	MiningReward   int         `yaml:"mining_reward" json:"mining_reward"`
+	RewardSchedule []RewardEra `yaml:"reward_schedule" json:"reward_schedule"`
+
+	InitialDifficulty       int   `yaml:"initial_difficulty" json:"initial_difficulty"`
+	MinDifficulty           int   `yaml:"min_difficulty" json:"min_difficulty"`
+	RetargetInterval        int   `yaml:"retarget_interval" json:"retarget_interval"`
+	TargetBlockInterval     int64 `yaml:"target_block_interval" json:"target_block_interval"`
+	MaxDifficultyAdjustment int   `yaml:"max_difficulty_adjustment" json:"max_difficulty_adjustment"`
+	MaxFutureBlockTime      int64 `yaml:"max_future_block_time" json:"max_future_block_time"`
+	MaxBlockTXBytes         int   `yaml:"max_block_tx_bytes" json:"max_block_tx_bytes"`
+	// Regtest: difficulty never changes and may be 0, coinbase of mined blocks is derived
+	// from chain state, and blocks can be generated on demand, for testing only
+	Regtest bool `yaml:"regtest" json:"regtest"`
+}
+
+func (p *ChainParams) Reward(height int) int {
+	// mining reward of block at height, eras are sorted by height
+	reward := p.MiningReward
+	for _, era := range p.RewardSchedule {
+		if height < era.Height {
+			break
+		}
+		reward = era.Reward
+	}
+	return reward
+}
+
+type WalletParams struct {
+	// address format, addresses of another format do not validate
+	Version        uint8 `yaml:"version" json:"version"`
+	ChecksumLength int   `yaml:"checksum_length" json:"checksum_length"`
+}
+
+type MempoolParams struct {
+	MaxTXs   int   `yaml:"max_txs" json:"max_txs"`
+	MaxBytes int   `yaml:"max_bytes" json:"max_bytes"`
+	Expiry   int64 `yaml:"expiry" json:"expiry"`
+}
+
+type NetworkParams struct {
+	// Listen: host:port peers reach node at, Peers: host:port of peers dialed at start
+	Listen         string   `yaml:"listen" json:"listen"`
+	Peers          []string `yaml:"peers" json:"peers"`
+	MaxInbound     int      `yaml:"max_inbound" json:"max_inbound"`
+	MaxOutbound    int      `yaml:"max_outbound" json:"max_outbound"`
+	MaxAddressBook int      `yaml:"max_address_book" json:"max_address_book"`
+}
+
+type RPCParams struct {
+	// Port: empty to disable rpc server, Token: random if empty
+	Port  string `yaml:"port" json:"port"`
+	Token string `yaml:"token" json:"token"`
+}
+
+type Config struct {
+	// DataDir: each user has a directory in it, ChainSpec: file that replaces Chain if not empty
+	DataDir   string        `yaml:"datadir" json:"datadir"`
+	ChainSpec string        `yaml:"chain_spec" json:"chain_spec"`
+	Chain     ChainParams   `yaml:"chain" json:"chain"`
+	Wallet    WalletParams  `yaml:"wallet" json:"wallet"`
+	Mempool   MempoolParams `yaml:"mempool" json:"mempool"`
+	Network   NetworkParams `yaml:"network" json:"network"`
+	RPC       RPCParams     `yaml:"rpc" json:"rpc"`
+}
+
+// EnvPrefix starts the environment variables of settings, e.g. BLOCKCHAIN_CHAIN_MINING_REWARD
+const EnvPrefix = "BLOCKCHAIN"
+
+func Default() *Config {
+	return &Config{
+		DataDir: PersistentStoragePath,
+		Chain:   defaultChainParams(),
+		Wallet:  WalletParams{Version: WalletVersion, ChecksumLength: ChecksumLength},
+		Mempool: MempoolParams{MaxTXs: MaxPendingTXs, MaxBytes: MaxPendingTXBytes, Expiry: PendingTXExpiry},
+		Network: NetworkParams{Listen: DefaultListenAddress, Peers: []string{}, MaxInbound: MaxInboundConnections,
+			MaxOutbound: MaxOutboundConnections, MaxAddressBook: MaxAddressBookSize},
+		RPC: RPCParams{Port: DefaultRPCPort},
+	}
+}
+
+func defaultChainParams() ChainParams {
+	// the chain every node joins unless told otherwise
+	return ChainParams{
+		NetworkID:               ChainID,
+		Magic:                   NetworkMagic,
+		GenesisTimestamp:        GenesisTimestamp,
+		GenesisData:             GenesisData,
+		Premine:                 []Allocation{},
+		MiningReward:            MiningReward,
+		RewardSchedule:          []RewardEra{},
+		InitialDifficulty:       InitialChainDifficulty,
+		MinDifficulty:           MinChainDifficulty,
+		RetargetInterval:        RetargetInterval,
+		TargetBlockInterval:     TargetBlockInterval,
+		MaxDifficultyAdjustment: MaxDifficultyAdjustment,
+		MaxFutureBlockTime:      MaxFutureBlockTime,
+		MaxBlockTXBytes:         MaxBlockTXBytes,
+	}
+}
+
+func RegtestChainParams() ChainParams {
+	// a local chain for testing, every hash meets the target of difficulty 0
+	params := defaultChainParams()
+	params.NetworkID = RegtestNetworkID
+	params.Magic = RegtestMagic
+	params.GenesisData = RegtestGenesisData
+	params.InitialDifficulty = 0
+	params.MinDifficulty = 0
+	params.Regtest = true
+	return params
+}
+
+func Load(path string) (*Config, error) {
+	// defaults overwritten by file at path
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+	if err := decodeFile(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadChainSpec(path string) (ChainParams, error) {
+	// default chain params overwritten by chain spec file at path
+	params := defaultChainParams()
+	err := decodeFile(path, &params)
+	return params, err
+}
+
+func Resolve(path string, lookup func(string) (string, bool), override func(*Config)) (*Config, error) {
+	// config file at path (defaults if empty), then environment, then override (e.g. from flags),
+	// then chain spec, the result is validated
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.ApplyEnv(lookup); err != nil {
+		return nil, err
+	}
+	if override != nil {
+		override(cfg)
+	}
+	if cfg.ChainSpec != "" {
+		if cfg.Chain, err = LoadChainSpec(cfg.ChainSpec); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func decodeFile(path string, v interface{}) error {
+	// format is picked by extension, unknown keys are errors
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(v)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(v)
+	default:
+		return fmt.Errorf("file %s is neither .yaml, .yml nor .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	// a setting is named by its keys in config file, e.g. chain.mining_reward is
+	// BLOCKCHAIN_CHAIN_MINING_REWARD, lists of strings are separated by commas, other
+	// lists can only be set in files
+	return applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup)
+}
+
+func applyEnv(value reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Field(idx)
+		name := prefix + "_" + strings.ToUpper(value.Type().Field(idx).Tag.Get("yaml"))
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.String {
+			continue
+		}
+		raw, found := lookup(name)
+		if !found {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("could not parse %s=%s as boolean", name, raw)
+			}
+			field.SetBool(parsed)
+		case reflect.Int, reflect.Int64:
+			parsed, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return fmt.Errorf("could not parse %s=%s as integer", name, raw)
+			}
+			field.SetInt(parsed)
+		case reflect.Uint8, reflect.Uint32:
+			parsed, err := strconv.ParseUint(raw, 0, field.Type().Bits())
+			if err != nil {
+				return fmt.Errorf("could not parse %s=%s as unsigned integer", name, raw)
+			}
+			field.SetUint(parsed)
+		case reflect.Slice:
+			items := []string{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			panic("Unsupported kind of setting " + name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	// all problems are reported at once
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.DataDir != "", "datadir is empty")
+	chain := c.Chain
+	check(chain.NetworkID != "", "chain.network_id is empty")
+	check(chain.Magic != 0, "chain.magic must not be 0")
+	check(chain.GenesisData != "", "chain.genesis_data is empty")
+	for idx, allocation := range chain.Premine {
+		check(allocation.Address != "" && allocation.Amount > 0,
+			"chain.premine[%d] needs an address and a positive amount", idx)
+	}
+	for idx, era := range chain.RewardSchedule {
+		check(era.Reward > 0, "chain.reward_schedule[%d].reward must be positive", idx)
+		check(era.Height >= 1 && (idx == 0 || era.Height > chain.RewardSchedule[idx-1].Height),
+			"chain.reward_schedule must be sorted by height, starting at 1 or later")
+	}
+	if chain.Regtest {
+		check(chain.MinDifficulty >= 0 && chain.MinDifficulty <= 255, "chain.min_difficulty must be in [0, 255]")
+	} else {
+		check(chain.MinDifficulty >= 1 && chain.MinDifficulty <= 255, "chain.min_difficulty must be in [1, 255]")
+	}
+	check(chain.InitialDifficulty >= chain.MinDifficulty && chain.InitialDifficulty <= 255,
+		"chain.initial_difficulty must be in [chain.min_difficulty, 255]")
+	check(chain.RetargetInterval >= 2, "chain.retarget_interval must be at least 2")
+	check(chain.TargetBlockInterval > 0, "chain.target_block_interval must be positive")
+	check(chain.MaxDifficultyAdjustment >= 0, "chain.max_difficulty_adjustment must not be negative")
+	check(chain.MaxFutureBlockTime >= 0, "chain.max_future_block_time must not be negative")
+	check(chain.MiningReward > 0, "chain.mining_reward must be positive")
+	check(chain.MaxBlockTXBytes > 0, "chain.max_block_tx_bytes must be positive")
+	check(c.Wallet.ChecksumLength >= 1 && c.Wallet.ChecksumLength <= 32, "wallet.checksum_length must be in [1, 32]")
+	check(c.Mempool.MaxTXs > 0, "mempool.max_txs must be positive")
+	check(c.Mempool.MaxBytes > 0, "mempool.max_bytes must be positive")
+	check(c.Mempool.Expiry > 0, "mempool.expiry must be positive")
+	if _, port, err := net.SplitHostPort(c.Network.Listen); err != nil || !validPort(port) {
+		problems = append(problems, fmt.Sprintf("network.listen %q is not host:port", c.Network.Listen))
+	}
+	for _, peer := range c.Network.Peers {
+		if _, port, err := net.SplitHostPort(peer); err != nil || !validPort(port) {
+			problems = append(problems, fmt.Sprintf("network.peers: %q is not host:port", peer))
+		}
+	}
+	check(c.Network.MaxInbound >= 0, "network.max_inbound must not be negative")
+	check(c.Network.MaxOutbound >= 1, "network.max_outbound must be at least 1")
+	check(c.Network.MaxAddressBook >= 1, "network.max_address_book must be at least 1")
+	check(c.RPC.Port == "" || validPort(c.RPC.Port), "rpc.port %q is not a port", c.RPC.Port)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validPort(port string) bool {
+	parsed, err := strconv.Atoi(port)
+	return err == nil && parsed > 0 && parsed < 65536
+}
+
+func (c *Config) UserPath(userName string) string {
+	// directory of user, files like WalletFileName are inside it
+	return filepath.ToSlash(filepath.Join(c.DataDir, userName))
+}
+
+func (c *Config) ListenAddress() (string, string) {
+	// ip and port of Listen, host defaults to localhost, Listen should be validated before
+	host, port, _ := net.SplitHostPort(c.Network.Listen)
+	if host == "" {
+		host = "localhost"
+	}
+	return host, port
+}
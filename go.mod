@@ -6,6 +6,7 @@ require (
 	github.com/dgraph-io/badger v1.6.2
 	github.com/mr-tron/base58 v1.2.0
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
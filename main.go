@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/blockchain"
@@ -11,16 +12,29 @@ import (
 	"github.com/AntonyMei/Blockchain/src/transaction"
 	"github.com/AntonyMei/Blockchain/src/utils"
 	"github.com/AntonyMei/Blockchain/src/wallet"
+	"net"
 	"os"
 	"strconv"
 	"time"
 )
 
 func main() {
-	runCli()
+	// interactive mode without command, see 'blockchain help' for the others
+	if len(os.Args) < 2 || os.Args[1] == "console" {
+		runCli()
+		return
+	}
+	os.Exit(cli.RunCommand(os.Args[1:]))
 }
 
 func runCli() {
+	// settings come from BLOCKCHAIN_CONFIG file and environment
+	cfg, err := config.Resolve(os.Getenv(config.EnvPrefix+"_CONFIG"), os.LookupEnv, nil)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		os.Exit(1)
+	}
+
 	// login to local system
 	fmt.Println("Blockchain interactive mode, type 'help' for more information.")
 	var reader = bufio.NewReader(os.Stdin)
@@ -32,13 +46,13 @@ func runCli() {
 		inputList := utils.ReadCommand(reader)
 		if len(inputList) == 1 {
 			userName = inputList[0]
-			pathExists, err := utils.PathExists(config.PersistentStoragePath + userName)
+			pathExists, err := utils.PathExists(cfg.UserPath(userName))
 			utils.Handle(err)
 			if pathExists {
 				fmt.Printf("Login as %v.\n", userName)
 			} else {
 				fmt.Printf("New user %v.\n", userName)
-				err := os.Mkdir(config.PersistentStoragePath+userName, os.ModePerm)
+				err := os.MkdirAll(cfg.UserPath(userName), os.ModePerm)
 				utils.Handle(err)
 			}
 			break
@@ -51,19 +65,24 @@ func runCli() {
 		fmt.Print(">>> Enter Port: ")
 		inputList := utils.ReadCommand(reader)
 		if len(inputList) == 1 {
-			ip = "localhost" // currently only consider localhost
+			// either [port] on localhost or [host:port]
+			ip = "localhost"
 			port = inputList[0]
+			if host, hostPort, err := net.SplitHostPort(inputList[0]); err == nil {
+				ip = host
+				port = hostPort
+			}
 			time.Sleep(time.Duration(1) * time.Millisecond)
 			break
 		} else {
 			fmt.Printf("Expect 1 parameter, got %v instead. Enter a valid port number\n", len(inputList))
 		}
 	}
-	walletPath := config.PersistentStoragePath + userName + config.WalletFileName
-	blockchainPath := config.PersistentStoragePath + userName + config.BlockchainPath
+	walletPath := cfg.UserPath(userName) + config.WalletFileName
+	blockchainPath := cfg.UserPath(userName) + config.BlockchainPath
 	fmt.Printf("Wallet path: %v\n", walletPath)
 	fmt.Printf("Blockchain path: %v\n", blockchainPath)
-	commandLine := cli.InitializeCli(userName, ip, port)
+	commandLine := cli.InitializeCli(cfg, userName, ip, port)
 
 	commandLine.Loop(reader)
 }
@@ -97,17 +116,18 @@ func test_network() {
 	// initialize nodes and wallets for each agent
 	var chain *blockchain.BlockChain
 
-	wallets, _ := wallet.InitializeWallets(agent)
+	cfg := config.Default()
+	wallets, _ := wallet.InitializeWallets(cfg, agent)
 	// utils.Handle(err)
 	// agentAddr := wallets.CreateWallet(agent)
 	// agentWallet := wallets.GetWallet(agent)
 	if chain == nil {
-		chain = blockchain.InitBlockChain(wallets, agent)
+		chain = blockchain.InitBlockChain(cfg, agent)
 	}
 	meta := network.NetworkMetaData{Ip: "localhost", Port: ports[agent]}
 	// agent_meta := network.UserMetaData{Name:agent, PublicKey: agentWallet.PublicKey, WalletAddr: agentAddr}
-	node := network.InitializeNode(wallets, chain, meta)
-	node.Serve()
+	node := network.InitializeNode(cfg, agent, wallets, chain, meta)
+	utils.Handle(node.Start(context.Background()))
 
 	if agent == "Bob" || agent == "Charlie" || agent == "David" {
 		alice_meta := network.NetworkMetaData{Ip: "localhost", Port: ports["Alice"]}
@@ -137,7 +157,7 @@ func test_network_tx() {
 		err := os.Mkdir(config.PersistentStoragePath+agent, os.ModePerm)
 		utils.Handle(err)
 	}
-	commandLine := cli.InitializeCli(agent, "localhost", ports[agent])
+	commandLine := cli.InitializeCli(config.Default(), agent, "localhost", ports[agent])
 
 	if agent == "Bob" || agent == "Charlie" || agent == "David" {
 		commandLine.Ping("localhost", ports["Alice"])
@@ -149,7 +169,7 @@ func test_network_tx() {
 	fmt.Println("Enter to continue...")
 	utils.ReadCommand(reader)
 
-	commandLine.CreateWallet(agent)
+	commandLine.CreateWallet(agent, wallet.ReceiveChain)
 	if agent == "Alice" {
 		fmt.Println("Add First Block")
 		commandLine.MineBlock(agent, "FirstBlock", []string{})
@@ -158,7 +178,7 @@ func test_network_tx() {
 		commandLine.Broadcast(agent)
 
 		fmt.Println("Add First Transaction")
-		commandLine.CreateTransaction("FirstTx", agent, []string{"Bob"}, []int{33})
+		commandLine.CreateTransaction("FirstTx", agent, []string{"Bob"}, []int{33}, 0)
 	}
 	if agent == "Bob" {
 		commandLine.Broadcast(agent)
@@ -171,18 +191,18 @@ func test_network_tx() {
 func TestLocal() {
 	println("Local test")
 	// initialize wallets
-	wallets, err := wallet.InitializeWallets("Alice")
-	utxoSet, _ := blockchain.InitUTXOSet("Alice")
+	cfg := config.Default()
+	wallets, err := wallet.InitializeWallets(cfg, "Alice")
 	var aliceAddr, bobAddr, charlieAddr, davidAddr []byte
 	var aliceWallet, bobWallet, charlieWallet, davidWallet *wallet.Wallet
 	if err != nil {
-		aliceAddr = wallets.CreateWallet("Alice")
+		aliceAddr, _ = wallets.CreateWallet("Alice")
 		aliceWallet = wallets.GetWallet("Alice")
-		bobAddr = wallets.CreateWallet("Bob")
+		bobAddr, _ = wallets.CreateWallet("Bob")
 		bobWallet = wallets.GetWallet("Bob")
-		charlieAddr = wallets.CreateWallet("Charlie")
+		charlieAddr, _ = wallets.CreateWallet("Charlie")
 		charlieWallet = wallets.GetWallet("Charlie")
-		davidAddr = wallets.CreateWallet("David")
+		davidAddr, _ = wallets.CreateWallet("David")
 		davidWallet = wallets.GetWallet("David")
 		wallets.AddKnownAddress("Alice", &wallet.KnownAddress{Address: aliceAddr,
 			PublicKey: aliceWallet.PrivateKey.PublicKey})
@@ -194,46 +214,42 @@ func TestLocal() {
 			PublicKey: davidWallet.PrivateKey.PublicKey})
 	} else {
 		aliceWallet = wallets.GetWallet("Alice")
-		aliceAddr = aliceWallet.Address()
+		aliceAddr = aliceWallet.Address(wallets.Params)
 		bobWallet = wallets.GetWallet("Bob")
-		bobAddr = bobWallet.Address()
+		bobAddr = bobWallet.Address(wallets.Params)
 		charlieWallet = wallets.GetWallet("Charlie")
-		charlieAddr = charlieWallet.Address()
+		charlieAddr = charlieWallet.Address(wallets.Params)
 		davidWallet = wallets.GetWallet("David")
-		davidAddr = davidWallet.Address()
+		davidAddr = davidWallet.Address(wallets.Params)
 	}
 
 	// starts a chain / continues from last chain
-	chain := blockchain.InitBlockChain(wallets, "Alice")
+	chain := blockchain.InitBlockChain(cfg, "Alice")
+	utxoSet := blockchain.InitUTXOSet(chain)
 
 	// alice mines two blocks
 	// block 0
-	block0 := chain.MineBlock(aliceAddr, "Alice 1", []*transaction.Transaction{})
+	block0, _ := chain.MineBlock(context.Background(), aliceAddr, "Alice 1", []*transaction.Transaction{}, 0)
 	chain.AddBlock(block0, utxoSet)
-	utxoSet.DumpBlock(block0)
 	// block 1
-	block1 := chain.MineBlock(aliceAddr, "Alice 2", []*transaction.Transaction{})
+	block1, _ := chain.MineBlock(context.Background(), aliceAddr, "Alice 2", []*transaction.Transaction{}, 0)
 	chain.AddBlock(block1, utxoSet)
-	utxoSet.DumpBlock(block1)
 
 	// bob comes in and mine another block
-	block2 := chain.MineBlock(bobAddr, "Bob 1", []*transaction.Transaction{})
+	block2, _ := chain.MineBlock(context.Background(), bobAddr, "Bob 1", []*transaction.Transaction{}, 0)
 	chain.AddBlock(block2, utxoSet)
-	utxoSet.DumpBlock(block2)
 
 	// Alice pays bob 30 in the next block
-	tx1 := chain.GenerateTransaction(aliceWallet, [][]byte{bobAddr}, []int{30})
-	block3 := chain.MineBlock(bobAddr, "Bob records that Alice pays Bob 30.", []*transaction.Transaction{tx1})
+	tx1, _ := chain.GenerateTransaction(utxoSet, nil, aliceWallet, [][]byte{bobAddr}, []int{30}, 0)
+	block3, _ := chain.MineBlock(context.Background(), bobAddr, "Bob records that Alice pays Bob 30.", []*transaction.Transaction{tx1}, 0)
 	chain.AddBlock(block3, utxoSet)
-	utxoSet.DumpBlock(block3)
 
 	// Alice gives Bob 90, David 40, then Bob returns 60, Charlie logs this
-	tx2 := chain.GenerateTransaction(aliceWallet, [][]byte{bobAddr, davidAddr}, []int{90, 40})
-	tx3 := chain.GenerateTransaction(bobWallet, [][]byte{aliceAddr}, []int{60})
-	block4 := chain.MineBlock(charlieAddr, "Charlie records that Alice gives Bob 90, David 40 and Bob returns 60.",
-		[]*transaction.Transaction{tx2, tx3})
+	tx2, _ := chain.GenerateTransaction(utxoSet, nil, aliceWallet, [][]byte{bobAddr, davidAddr}, []int{90, 40}, 0)
+	tx3, _ := chain.GenerateTransaction(utxoSet, nil, bobWallet, [][]byte{aliceAddr}, []int{60}, 0)
+	block4, _ := chain.MineBlock(context.Background(), charlieAddr, "Charlie records that Alice gives Bob 90, David 40 and Bob returns 60.",
+		[]*transaction.Transaction{tx2, tx3}, 0)
 	chain.AddBlock(block4, utxoSet)
-	utxoSet.DumpBlock(block4)
 
 	// At this point the balance should look like
 	// Alice:   100
@@ -245,10 +261,10 @@ func TestLocal() {
 	// print info
 	chain.Log2Terminal()
 	fmt.Printf("Final Balance\n")
-	fmt.Printf("Alice: %v.\n", chain.GetBalance(aliceAddr, &aliceWallet.PrivateKey.PublicKey))
-	fmt.Printf("Bob: %v.\n", chain.GetBalance(bobAddr, &bobWallet.PrivateKey.PublicKey))
-	fmt.Printf("Charlie: %v.\n", chain.GetBalance(charlieAddr, &charlieWallet.PrivateKey.PublicKey))
-	fmt.Printf("David: %v.\n", chain.GetBalance(davidAddr, &davidWallet.PrivateKey.PublicKey))
-	wallets.SaveFile()
+	fmt.Printf("Alice: %v.\n", utxoSet.GetBalance(wallet.AddressToPubKeyHash(aliceAddr)))
+	fmt.Printf("Bob: %v.\n", utxoSet.GetBalance(wallet.AddressToPubKeyHash(bobAddr)))
+	fmt.Printf("Charlie: %v.\n", utxoSet.GetBalance(wallet.AddressToPubKeyHash(charlieAddr)))
+	fmt.Printf("David: %v.\n", utxoSet.GetBalance(wallet.AddressToPubKeyHash(davidAddr)))
+	utils.Handle(wallets.SaveFile())
 	chain.Exit()
 }
@@ -7,15 +7,42 @@ import (
 	"fmt"
 )
 
+type CacheStatus int
+
+const (
+	// Cached: block is put into queue
+	// Orphaned: parent of block is unknown, block is put into orphan pool
+	// Rejected: block is dropped
+	// Invalid: block is dropped since its proof of work is invalid
+	Cached = iota
+	Orphaned
+	Rejected
+	Invalid
+)
+
+type CachedBlock struct {
+	// Peer: address of the peer that sent the block, empty for local blocks
+	Block *blocks.Block
+	Peer string
+}
+
 type BlockCache struct {
-	que []*blocks.Block
+	que []*CachedBlock
 	mu sync.Mutex
 	size int
 	lastHash []byte
+	// hasBlock tells whether a block is already stored, blocks on side chains are
+	// accepted as long as their parent is known
+	hasBlock func([]byte) bool
+	// orphans: blocks that arrive before their parents
+	orphans *OrphanPool
+	// minDifficulty: blocks below it are invalid
+	minDifficulty int
 }
 
-func InitBlockCache(size int, lastHash []byte) *BlockCache {
-	c := BlockCache{size: size, lastHash: lastHash}
+func InitBlockCache(size int, minDifficulty int, lastHash []byte, hasBlock func([]byte) bool) *BlockCache {
+	c := BlockCache{size: size, lastHash: lastHash, hasBlock: hasBlock, orphans: InitOrphanPool(),
+		minDifficulty: minDifficulty}
 	// fmt.Printf("init lasthash %x.\n", c.lastHash)
 	return &c
 }
@@ -23,54 +50,86 @@ func InitBlockCache(size int, lastHash []byte) *BlockCache {
 func (c *BlockCache) SetLastHash(lastHash []byte) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	// blocks in queue are kept, since they may belong to a side chain
 	if bytes.Compare(lastHash, c.lastHash) != 0 {
 		c.lastHash = lastHash[:]
-		c.que = []*blocks.Block{}
 	}
 	// fmt.Println("Set lasthash", c.lastHash)
 }
 
-func (c *BlockCache) AddBlock(block *blocks.Block) bool {
+func (c *BlockCache) AddBlock(block *blocks.Block, peer string) CacheStatus {
+	// peer is the address of the peer that sends the block, empty for local blocks
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	// only add when the hash is consistent
-	if bytes.Compare(block.PrevHash, c.lastHash) != 0 {
-		fmt.Printf("Not compatible lasthash %x %x.\n", block.PrevHash, c.lastHash)
-		return false
+	// proof of work, difficulty is checked first since target is 2^(256-difficulty)
+	if block.Difficulty < c.minDifficulty || block.Difficulty > 256 {
+		fmt.Println("validate pow failed")
+		return Invalid
 	}
-	
-	// proof of work
 	pow := blocks.CreateProofOfWork(block)
 	if !pow.ValidateNonce() {
 		fmt.Println("validate pow failed")
-		return false
+		return Invalid
 	}
 
 	// check whether the block exists
+	if c.hasBlock(block.Hash) || c.orphans.Exists(block.Hash) {
+		return Rejected
+	}
 	for _, cachedBlock := range c.que {
-		if bytes.Compare(cachedBlock.Hash, block.Hash) != 0 {
+		if bytes.Compare(cachedBlock.Block.Hash, block.Hash) == 0 {
 			fmt.Println("block with same hash exists")
-			return false
+			return Rejected
+		}
+	}
+
+	// only add when the hash is consistent, or when parent is on some side chain
+	// otherwise the block waits in orphan pool until its parent arrives
+	if bytes.Compare(block.PrevHash, c.lastHash) != 0 && !c.hasBlock(block.PrevHash) {
+		if !c.orphans.AddOrphan(block, peer) {
+			fmt.Printf("Orphan block %x rejected.\n", block.Hash)
+			return Rejected
 		}
+		fmt.Printf("Orphan block %x waits for parent %x.\n", block.Hash, block.PrevHash)
+		return Orphaned
 	}
 
+	c.enqueue(&CachedBlock{Block: block, Peer: peer})
+	return Cached
+}
+
+func (c *BlockCache) ConnectOrphans(parentHash []byte) int {
+	// move orphans waiting for parentHash into queue, should be called after parent is stored
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	children := c.orphans.PopChildren(parentHash)
+	for _, child := range children {
+		c.enqueue(&CachedBlock{Block: child.Block, Peer: child.Peer})
+	}
+	return len(children)
+}
+
+func (c *BlockCache) OrphanCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.orphans.Size()
+}
+
+func (c *BlockCache) enqueue(block *CachedBlock) {
 	if len(c.que) >= c.size {
 		c.que = c.que[1:]
 	}
 	c.que = append(c.que, block)
-
-	// fmt.Println("Added Block")
-
-	return true
 }
 
-func (c *BlockCache) PopBlock() *blocks.Block {
+func (c *BlockCache) PopBlock() (*blocks.Block, string) {
+	// returns the block and address of the peer that sent it
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if len(c.que) == 0 {
-		return nil
+		return nil, ""
 	}
-	block := c.que[0]
+	cached := c.que[0]
 	c.que = c.que[1:]
-	return block
+	return cached.Block, cached.Peer
 }
\ No newline at end of file
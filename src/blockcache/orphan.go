@@ -0,0 +1,130 @@
+package blockcache
+
+import (
+	"bytes"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"time"
+)
+
+type OrphanBlock struct {
+	// Block: a block whose parent is unknown
+	// Peer: address of the peer that sent the block, empty for local blocks
+	// ArrivalTime: when the block is added into the pool
+	Block       *blocks.Block
+	Peer        string
+	ArrivalTime time.Time
+}
+
+type OrphanPool struct {
+	// OrphanPool is not thread safe, it is guarded by the BlockCache that owns it
+	// orphans: hash of missing parent -> blocks waiting for it
+	// peerCount: peer address -> number of orphans from that peer
+	orphans   map[string][]*OrphanBlock
+	peerCount map[string]int
+	size      int
+}
+
+func InitOrphanPool() *OrphanPool {
+	p := OrphanPool{orphans: make(map[string][]*OrphanBlock), peerCount: make(map[string]int)}
+	return &p
+}
+
+func (p *OrphanPool) Size() int {
+	return p.size
+}
+
+func (p *OrphanPool) Exists(hash []byte) bool {
+	for _, orphanList := range p.orphans {
+		for _, orphan := range orphanList {
+			if bytes.Compare(orphan.Block.Hash, hash) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *OrphanPool) AddOrphan(block *blocks.Block, peer string) bool {
+	// add a block into pool, returns false if it is rejected by limits
+	p.ExpireOrphans()
+	if p.Exists(block.Hash) {
+		return false
+	}
+	if peer != "" && p.peerCount[peer] >= config.MaxOrphanBlocksPerPeer {
+		return false
+	}
+	if p.size >= config.MaxOrphanBlocks {
+		p.removeOldest()
+	}
+	orphan := OrphanBlock{Block: block, Peer: peer, ArrivalTime: time.Now()}
+	p.orphans[string(block.PrevHash)] = append(p.orphans[string(block.PrevHash)], &orphan)
+	p.peerCount[peer] += 1
+	p.size += 1
+	return true
+}
+
+func (p *OrphanPool) PopChildren(parentHash []byte) []*OrphanBlock {
+	// remove and return all orphans waiting for parentHash
+	var children []*OrphanBlock
+	for _, orphan := range p.orphans[string(parentHash)] {
+		children = append(children, orphan)
+		p.release(orphan)
+	}
+	delete(p.orphans, string(parentHash))
+	return children
+}
+
+func (p *OrphanPool) ExpireOrphans() {
+	// drop orphans that have waited too long for their parents
+	expiry := time.Duration(config.OrphanBlockExpiry) * time.Millisecond
+	for parentHash, orphanList := range p.orphans {
+		var keptList []*OrphanBlock
+		for _, orphan := range orphanList {
+			if time.Since(orphan.ArrivalTime) > expiry {
+				p.release(orphan)
+			} else {
+				keptList = append(keptList, orphan)
+			}
+		}
+		if len(keptList) == 0 {
+			delete(p.orphans, parentHash)
+		} else {
+			p.orphans[parentHash] = keptList
+		}
+	}
+}
+
+func (p *OrphanPool) removeOldest() {
+	// evict the orphan that arrives first
+	var oldestParent string
+	oldestIdx := -1
+	for parentHash, orphanList := range p.orphans {
+		for idx, orphan := range orphanList {
+			if oldestIdx == -1 || orphan.ArrivalTime.Before(p.orphans[oldestParent][oldestIdx].ArrivalTime) {
+				oldestParent = parentHash
+				oldestIdx = idx
+			}
+		}
+	}
+	if oldestIdx == -1 {
+		return
+	}
+	orphanList := p.orphans[oldestParent]
+	p.release(orphanList[oldestIdx])
+	orphanList = append(orphanList[:oldestIdx], orphanList[oldestIdx+1:]...)
+	if len(orphanList) == 0 {
+		delete(p.orphans, oldestParent)
+	} else {
+		p.orphans[oldestParent] = orphanList
+	}
+}
+
+func (p *OrphanPool) release(orphan *OrphanBlock) {
+	// update counters after an orphan leaves the pool
+	p.size -= 1
+	p.peerCount[orphan.Peer] -= 1
+	if p.peerCount[orphan.Peer] == 0 {
+		delete(p.peerCount, orphan.Peer)
+	}
+}
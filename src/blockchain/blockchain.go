@@ -2,8 +2,9 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"encoding/hex"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/blocks"
@@ -11,39 +12,61 @@ import (
 	"github.com/AntonyMei/Blockchain/src/utils"
 	"github.com/AntonyMei/Blockchain/src/wallet"
 	"github.com/dgraph-io/badger"
-	"log"
+	"math/big"
 	"strconv"
+	"sync"
 )
 
+// ErrNotEnoughFunds is returned when spendable UTXOs of a wallet do not cover a transaction
+var ErrNotEnoughFunds = errors.New("not enough funds")
+
 type BlockChain struct {
 	// blockchain is stored in badger database (k-v database)
 	// key: hash of block, value: serialized block
 	Database *badger.DB
-	// Wallets: wallets of current user
-	Wallets *wallet.Wallets
+	// Params: consensus settings, nodes with other params can not share this chain
+	// AddressFormat: format of premine addresses in genesis
+	Params        config.ChainParams
+	AddressFormat config.WalletParams
+	// Clock: chain time, it can be set in regtest
+	Clock *utils.Clock
 	// proof of difficulty
 	ChainDifficulty int
 	// hash of last block
 	LastHash []byte
 	// height of last block
 	BlockHeight int
+	// HandleReorg is called after best chain switches to another branch
+	HandleReorg func(*ReorgEvent)
+	// tipMu: LastHash, BlockHeight and ChainDifficulty are changed under it, goroutines
+	// other than the one adding blocks read them with Tip
+	tipMu sync.RWMutex
+}
+
+type ChainTip struct {
+	// Hash / Height: last block of best chain, Difficulty: difficulty of the next block
+	Hash       []byte
+	Height     int
+	Difficulty int
 }
 
-func InitBlockChain(wallets *wallet.Wallets, userName string) *BlockChain {
+func InitBlockChain(cfg *config.Config, userName string) *BlockChain {
 	// open db connection
-	persistentPath := config.PersistentStoragePath + userName + config.BlockchainPath
+	persistentPath := cfg.UserPath(userName) + config.BlockchainPath
 	var options = badger.DefaultOptions(persistentPath)
 	database, err := badger.Open(options)
 	utils.Handle(err)
 
 	// create a new blockchain if nothing exists
-	blockchain := BlockChain{Database: database, Wallets: wallets, ChainDifficulty: config.InitialChainDifficulty, BlockHeight: 0}
+	blockchain := BlockChain{Database: database, Params: cfg.Chain, AddressFormat: cfg.Wallet, Clock: &utils.Clock{},
+		ChainDifficulty: cfg.Chain.InitialDifficulty, BlockHeight: 0}
 	err = database.Update(func(txn *badger.Txn) error {
 		_, err := txn.Get([]byte("lasthash"))
 		if err == badger.ErrKeyNotFound {
 			// no chain in database, create a new one
 			fmt.Println("Initiating a new blockchain...")
-			genesis := blocks.Genesis(config.InitialChainDifficulty)
+			genesis, err := blocks.Genesis(&cfg.Chain, cfg.Wallet)
+			utils.Handle(err)
 			verifyResult := blockchain.ValidateBlock(genesis, nil)
 			blockchain.LastHash = genesis.Hash[:]
 			blockchain.BlockHeight = genesis.Height
@@ -52,6 +75,7 @@ func InitBlockChain(wallets *wallet.Wallets, userName string) *BlockChain {
 			utils.Handle(err)
 			err = txn.Set([]byte("lasthash"), genesis.Hash)
 			utils.Handle(err)
+			indexBlock(txn, genesis)
 		} else {
 			// there exists a blockchain already
 			fmt.Println("Continuing from saved blockchain...")
@@ -63,314 +87,395 @@ func InitBlockChain(wallets *wallet.Wallets, userName string) *BlockChain {
 	block := blockchain.Iterator().GetVal()
 	blockchain.LastHash = block.Hash
 	blockchain.BlockHeight = block.Height
+	blockchain.ChainDifficulty = blockchain.GetNextDifficulty(block)
+	if !blockchain.HasIndexes() {
+		blockchain.BuildIndexes()
+	}
+	// a chain created from another chain spec can not be continued
+	genesis, _ := blockchain.GetBlockByHeight(0)
+	if genesis == nil || blockchain.ValidateBlock(genesis, nil) != utils.Verified {
+		utils.Handle(fmt.Errorf("blockchain in %s does not match chain spec %s", persistentPath,
+			cfg.Chain.NetworkID))
+	}
 
 	return &blockchain
 }
 
-func (bc *BlockChain) MineBlock(minerAddr []byte, description string, txList []*transaction.Transaction) *blocks.Block {
-	// create new block
-	txList = append(txList, transaction.CoinbaseTx(minerAddr))
-	newBlock := blocks.CreateBlock(description, txList, bc.LastHash, bc.ChainDifficulty, bc.BlockHeight, false)
-	return newBlock
+func (bc *BlockChain) MineBlock(ctx context.Context, minerAddr []byte, description string,
+	txList []*transaction.Transaction, fees int) (*blocks.Block, utils.MiningStatus) {
+	// create new block on current tip, mining stops early if ctx is cancelled
+	// fees: total fee of txList, claimed by coinbase
+	tip := bc.Tip()
+	coinbase := transaction.CoinbaseTx(minerAddr, bc.Params.Reward(tip.Height+1), fees)
+	if bc.Params.Regtest {
+		// token is derived from parent and height, so that generated chains are reproducible
+		token := sha256.Sum256(bytes.Join([][]byte{tip.Hash, utils.Int2Hex(int64(tip.Height + 1))}, []byte{}))
+		coinbase = transaction.CoinbaseTxWithToken(minerAddr, bc.Params.Reward(tip.Height+1), fees, token[:])
+	}
+	txList = append(txList, coinbase)
+	return blocks.CreateBlock(ctx, description, txList, tip.Hash, tip.Difficulty, tip.Height,
+		bc.Clock.Now().UnixMilli())
 }
 
 func (bc *BlockChain) AddBlock(block *blocks.Block, utxoSet *UTXOSet) bool {
-	// add a block into database, either
-	// whether this is a new block
-	if bytes.Compare(block.PrevHash, bc.LastHash) != 0 {
-		// this is not not a new block
+	// add a block into database and update utxoSet, returns whether best chain changes
+	// blocks on side chains are stored, and we switch to the chain with most cumulative work
+	if _, exists := bc.GetBlock(block.Hash); exists {
 		return false
 	}
-	validBlock := false
-	err := bc.Database.Update(func(txn *badger.Txn) error {
-		// check block
-		verifyResult := bc.ValidateBlock(block, utxoSet)
-		fmt.Printf("Verify block: %v.\n", verifyResult.String())
+	if bc.IsInvalid(block.PrevHash) {
+		// descendants of invalid blocks are invalid
+		bc.MarkInvalid(block.Hash)
+		return false
+	}
+
+	// block on side chain
+	if bytes.Compare(block.PrevHash, bc.LastHash) != 0 {
+		verifyResult := bc.ValidateBlockHeader(block)
+		fmt.Printf("Verify side chain block: %v.\n", verifyResult.String())
 		if verifyResult != utils.Verified {
-			return nil
+			return false
 		}
-		bc.LastHash = block.Hash
-		bc.BlockHeight = block.Height
-		validBlock = true
+		bc.StoreSideBlock(block)
+		if bc.GetCumulativeWork(block.Hash).Cmp(bc.GetCumulativeWork(bc.LastHash)) > 0 {
+			return bc.Reorganize(block, utxoSet)
+		}
+		return false
+	}
 
-		// add into db
+	// block extending best chain
+	verifyResult := bc.ValidateBlock(block, utxoSet)
+	fmt.Printf("Verify block: %v.\n", verifyResult.String())
+	if verifyResult != utils.Verified {
+		return false
+	}
+	work := new(big.Int).Add(bc.GetCumulativeWork(block.PrevHash), block.Work())
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		// add into db, UTXO set is updated in the same txn so that a crash
+		// can never leave it out of sync with lasthash
+		utxoView := utxoSet.WithTxn(txn)
+		undoData := utxoView.GenerateUndoData(block)
+		utxoView.DumpBlock(block)
 		err := txn.Set(block.Hash, block.Serialize())
 		utils.Handle(err)
+		err = txn.Set(workKey(block.Hash), work.Bytes())
+		utils.Handle(err)
+		err = txn.Set(undoKey(block.Hash), serializeUndoData(undoData))
+		utils.Handle(err)
 		err = txn.Set([]byte("lasthash"), block.Hash)
 		utils.Handle(err)
+		indexBlock(txn, block)
 		return nil
 	})
 	utils.Handle(err)
-	return validBlock
+	bc.setTip(block)
+	return true
+}
+
+func (bc *BlockChain) Tip() ChainTip {
+	// snapshot of best chain tip, safe to call while blocks are added
+	bc.tipMu.RLock()
+	defer bc.tipMu.RUnlock()
+	return ChainTip{Hash: bc.LastHash, Height: bc.BlockHeight, Difficulty: bc.ChainDifficulty}
+}
+
+func (bc *BlockChain) setTip(block *blocks.Block) {
+	// difficulty of next block may change after this one
+	difficulty := bc.GetNextDifficulty(block)
+	bc.tipMu.Lock()
+	defer bc.tipMu.Unlock()
+	bc.LastHash = block.Hash
+	bc.BlockHeight = block.Height
+	bc.ChainDifficulty = difficulty
+}
+
+func (bc *BlockChain) GetBlock(hash []byte) (*blocks.Block, bool) {
+	// read a block from database, returns false if there is no such block
+	var block *blocks.Block
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(hash)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		utils.Handle(err)
+		err = item.Value(func(val []byte) error {
+			block = blocks.Deserialize(val)
+			return nil
+		})
+		utils.Handle(err)
+		return nil
+	})
+	utils.Handle(err)
+	return block, block != nil
+}
+
+func (bc *BlockChain) GetNextDifficulty(prevBlock *blocks.Block) int {
+	return NextDifficulty(&bc.Params, prevBlock.Header(), bc.GetHeader)
 }
 
 func (bc *BlockChain) ValidateBlock(block *blocks.Block, utxoSet *UTXOSet) utils.BlockStatus {
-	wallets := bc.Wallets
+	// validation only depends on chain data, i.e. the block itself, its ancestors and utxoSet
 	// check if this block is genesis
 	if bytes.Compare(block.PrevHash, []byte{}) == 0 {
-		// check hash
-		pow := blocks.CreateProofOfWork(block)
-		if !pow.ValidateNonce() {
-			return utils.WrongGenesis
-		}
-		// check data
-		if bytes.Compare(block.Data, []byte(config.GenesisData)) != 0 {
+		// everything but nonce and hash is derived from chain spec
+		template, err := blocks.GenesisTemplate(&bc.Params, bc.AddressFormat)
+		if err != nil || block.Height != 0 || bytes.Compare(block.Data, template.Data) != 0 ||
+			block.Difficulty != template.Difficulty || block.Timestamp != template.Timestamp ||
+			len(block.TransactionList) != 1 {
 			return utils.WrongGenesis
 		}
-		// check Difficulty
-		if block.Difficulty != config.InitialChainDifficulty {
+		tx, expected := block.TransactionList[0], template.TransactionList[0]
+		if bytes.Compare(tx.TxID, expected.TxID) != 0 || len(tx.TxInputList) != len(expected.TxInputList) ||
+			len(tx.TxOutputList) != len(expected.TxOutputList) {
 			return utils.WrongGenesis
 		}
-		// check transactions
-		if len(block.TransactionList) != 1 {
-			return utils.WrongGenesis
+		for idx := range tx.TxInputList {
+			if bytes.Compare(tx.TxInputList[idx].Serialize(), expected.TxInputList[idx].Serialize()) != 0 {
+				return utils.WrongGenesis
+			}
 		}
-		tx := block.TransactionList[0]
-		if !tx.IsCoinbase() {
-			return utils.WrongGenesis
+		for idx := range tx.TxOutputList {
+			if bytes.Compare(tx.TxOutputList[idx].Serialize(), expected.TxOutputList[idx].Serialize()) != 0 {
+				return utils.WrongGenesis
+			}
 		}
-		if bytes.Compare(tx.TxOutputList[0].Address, []byte(config.GenesisData)) != 0 {
+		// check hash
+		pow := blocks.CreateProofOfWork(block)
+		if !pow.ValidateNonce() {
 			return utils.WrongGenesis
 		}
 		return utils.Verified
 	}
 
 	// other blocks
-	// check prevHash
-	var prevBlockFound bool
-	err := bc.Database.View(func(txn *badger.Txn) error {
-		_, err := txn.Get(block.PrevHash)
-		if err == badger.ErrKeyNotFound {
-			prevBlockFound = false
-		} else {
-			prevBlockFound = true
-		}
-		return nil
-	})
-	utils.Handle(err)
-	if !prevBlockFound {
-		return utils.PrevBlockNotFound
+	// check header
+	headerStatus := bc.ValidateBlockHeader(block)
+	if headerStatus != utils.Verified {
+		return headerStatus
 	}
-	// check hash
-	pow := blocks.CreateProofOfWork(block)
-	if !pow.ValidateNonce() {
-		return utils.HashMismatch
+	// check block size
+	blockTXBytes := 0
+	for _, tx := range block.TransactionList {
+		blockTXBytes += tx.Size()
 	}
-	// get all UTXes before further checking on transactions
-	var allUTXOMap = make(map[string]UnspentTXO)
-	var UTXOAddrMap = make(map[string]*wallet.KnownAddress)
-	for _, knownAddr := range wallets.KnownAddressMap {
-		tmpUTXOSet := utxoSet.Addr2UTXO[string(knownAddr.Address)]
-		for _, tmpUTXO := range tmpUTXOSet {
-			allUTXOMap[string(tmpUTXO.SourceTxID)+strconv.Itoa(tmpUTXO.TxOutputIdx)] = tmpUTXO
-			UTXOAddrMap[string(tmpUTXO.SourceTxID)+strconv.Itoa(tmpUTXO.TxOutputIdx)] = knownAddr
-		}
+	if blockTXBytes > bc.Params.MaxBlockTXBytes {
+		return utils.BlockTooLarge
 	}
-	// check transactions
+	// check transactions, a TX may spend outputs of TXes before it in the same block
 	coinbaseTXCount := 0
+	coinbaseValue := 0
+	totalFee := 0
+	var blockTXIDs = make(map[string]bool)
 	var SpentUXTOMap = make(map[string]bool)
+	var blockTXOMap = make(map[string]transaction.TxOutput)
+	findTXO := func(sourceTxID []byte, txOutputIdx int) (UnspentTXO, []byte, bool) {
+		if txo, exists := blockTXOMap[string(sourceTxID)+strconv.Itoa(txOutputIdx)]; exists {
+			return UnspentTXO{SourceTxID: sourceTxID, TxOutputIdx: txOutputIdx, Value: txo.Value}, txo.PubKeyHash, true
+		}
+		return utxoSet.FindUTXO(sourceTxID, txOutputIdx)
+	}
 	for _, tx := range block.TransactionList {
+		// TxID must be the hash of the TX and must not be taken by another TX, otherwise
+		// outputs and index entries of that TX would be overwritten
+		if !tx.HasValidID() {
+			return utils.WrongTxID
+		}
+		if blockTXIDs[string(tx.TxID)] || utxoSet.HasUnspentOutputs(tx.TxID) ||
+			isIndexedElsewhere(utxoSet, tx.TxID, block.Hash) {
+			return utils.DuplicateTX
+		}
+		blockTXIDs[string(tx.TxID)] = true
 		// check if it is coinbase TX
 		if tx.IsCoinbase() {
 			coinbaseTXCount += 1
 			if coinbaseTXCount > 1 {
 				return utils.TooManyCoinbaseTX
 			}
+			// only genesis pays premine to several outputs
+			if len(tx.TxOutputList) != 1 {
+				return utils.WrongCoinbaseValue
+			}
+			for _, txo := range tx.TxOutputList {
+				// sum of outputs must not overflow, otherwise it could look smaller than reward
+				if txo.Value <= 0 || coinbaseValue+txo.Value < coinbaseValue {
+					return utils.WrongCoinbaseValue
+				}
+				coinbaseValue += txo.Value
+			}
 			continue
 		}
-		// check if TxID is correct
-		txCopy := transaction.Transaction{TxInputList: tx.TxInputList, TxOutputList: tx.TxOutputList}
-		txCopy.SetID()
-		if bytes.Compare(txCopy.TxID, tx.TxID) != 0 {
-			return utils.WrongTxID
-		}
-		// check each input of TX
-		inputSum := 0
+		// check that no TXO is spent twice in this block
 		for _, txInput := range tx.TxInputList {
-			// check whether the source TXO exists in UTXO set
-			sourceTXO, exists := allUTXOMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)]
-			if !exists {
-				return utils.SourceTXONotFound
-			}
-			// check whether the input is correctly signed
-			signer := UTXOAddrMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)]
-			if !txInput.Verify(&signer.PublicKey) {
-				return utils.WrongTXInputSignature
-			}
-			_, exists = SpentUXTOMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)]
+			_, exists := SpentUXTOMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)]
 			if !exists {
 				SpentUXTOMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)] = true
 			} else {
 				return utils.DoubleSpending
 			}
-			// accumulate to inputSum
-			inputSum += sourceTXO.Value
 		}
-		// check if sum of input is equal to sum of output
-		outputSum := 0
-		for _, txOutput := range tx.TxOutputList {
-			outputSum += txOutput.Value
+		// check the TX itself
+		txStatus, fee := ValidateTransaction(tx, bc.Params.NetworkID, findTXO)
+		if txStatus != utils.Verified {
+			return txStatus
 		}
-		if outputSum != inputSum {
-			return utils.InputSumOutputSumMismatch
+		totalFee += fee
+		for outputIdx, txo := range tx.TxOutputList {
+			blockTXOMap[string(tx.TxID)+strconv.Itoa(outputIdx)] = txo
 		}
 	}
+	// miner can claim at most mining reward plus fees
+	if coinbaseValue > bc.Params.Reward(block.Height)+totalFee {
+		return utils.WrongCoinbaseValue
+	}
 	return utils.Verified
 }
 
-func (bc *BlockChain) FindUnspentTransactions(address []byte, publicKey *ecdsa.PublicKey) []transaction.Transaction {
-	// This function returns all transactions that contain unspent outputs associated with a wallet
-
-	// initialize
-	var unspentTxs []transaction.Transaction
-	spentTxMap := make(map[string][]int)
-	bcIterator := bc.Iterator()
-
-	// iterator through the chain to find unspent transactions
-	for {
-		// read block from chain
-		block := bcIterator.GetVal()
-		bcIterator.Next()
-
-		// check each transaction in the list
-		for _, tx := range block.TransactionList {
-			txID := hex.EncodeToString(tx.TxID)
-
-		Outputs:
-			// check each TxOutput
-			for outIdx, out := range tx.TxOutputList {
-				if spentTxMap[txID] != nil {
-					for _, spentOutIdx := range spentTxMap[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				if out.BelongsTo(address) {
-					unspentTxs = append(unspentTxs, *tx)
-				}
-			}
-			// mark all its inputs as spent
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.TxInputList {
-					if in.Verify(publicKey) {
-						inTxID := hex.EncodeToString(in.SourceTxID)
-						spentTxMap[inTxID] = append(spentTxMap[inTxID], in.TxOutputIdx)
-					}
-				}
-			}
+func ValidateTransaction(tx *transaction.Transaction, networkID string,
+	findTXO func(sourceTxID []byte, txOutputIdx int) (UnspentTXO, []byte, bool)) (utils.BlockStatus, int) {
+	// check a non-coinbase TX signed for networkID, findTXO looks up the TXOs it spends
+	// returns fee of the TX, i.e. input sum minus output sum, if it is valid
+	// check if TxID is correct
+	if !tx.HasValidID() {
+		return utils.WrongTxID, 0
+	}
+	// check each input of TX
+	inputSum := 0
+	var spentTXOMap = make(map[string]bool)
+	for inputIdx, txInput := range tx.TxInputList {
+		// check whether the source TXO exists
+		sourceTXO, pubKeyHash, exists := findTXO(txInput.SourceTxID, txInput.TxOutputIdx)
+		if !exists {
+			return utils.SourceTXONotFound, 0
 		}
-		if len(block.PrevHash) == 0 {
-			break
+		// check whether the input carries the public key the source TXO is locked with
+		if !txInput.UsesKey(pubKeyHash) {
+			return utils.WrongTXInputPublicKey, 0
 		}
+		// check whether the input is correctly signed
+		if !tx.VerifyInput(networkID, inputIdx) {
+			return utils.WrongTXInputSignature, 0
+		}
+		if spentTXOMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)] {
+			return utils.DoubleSpending, 0
+		}
+		spentTXOMap[string(txInput.SourceTxID)+strconv.Itoa(txInput.TxOutputIdx)] = true
+		// accumulate to inputSum
+		inputSum += sourceTXO.Value
 	}
-	return unspentTxs
-}
-
-func (bc *BlockChain) FindUTXO(address []byte, publicKey *ecdsa.PublicKey) []transaction.TxOutput {
-	// This function returns all UTXOs associated with address
-	var UTXOs []transaction.TxOutput
-	unspentTransactions := bc.FindUnspentTransactions(address, publicKey)
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.TxOutputList {
-			if out.BelongsTo(address) {
-				UTXOs = append(UTXOs, out)
-			}
+	// check outputs, the part of input sum not spent by outputs is fee
+	outputSum := 0
+	for _, txOutput := range tx.TxOutputList {
+		// sum of outputs must not overflow, otherwise it could look smaller than input sum
+		if txOutput.Value <= 0 || outputSum+txOutput.Value < outputSum {
+			return utils.WrongTXOutputValue, 0
 		}
+		outputSum += txOutput.Value
 	}
-	return UTXOs
+	if outputSum > inputSum {
+		return utils.InputSumOutputSumMismatch, 0
+	}
+	return utils.Verified, inputSum - outputSum
 }
 
-func (bc *BlockChain) GenerateSpendingPlan(wallet *wallet.Wallet, amount int) (int, map[string][]int) {
+func (bc *BlockChain) ValidateBlockHeader(block *blocks.Block) utils.BlockStatus {
+	// check everything of a non-genesis block except its transactions, so that blocks
+	// on side chains can be checked without a UTXO set at their parent
+	return ValidateHeader(&bc.Params, block.Header(), bc.Clock.Now().UnixMilli(), bc.GetHeader)
+}
+
+func (bc *BlockChain) GenerateSpendingPlan(utxoSet *UTXOSet, mempool *PendingTXs, wallet *wallet.Wallet,
+	amount int) (int, []UnspentTXO) {
 	// Generate a plan containing UTXOs such that the given address can use them to pay #amount to others
+	// UTXOs spent by pending transactions are skipped, mempool may be nil
 	// returns the total amount and plan of UTXOs
-	var unspentTxs = bc.FindUnspentTransactions(wallet.Address(), &wallet.PrivateKey.PublicKey)
 	var accumulated = 0
-	var candidateUTXOSet = make(map[string][]int)
-	var address = wallet.Address()
-
-TxLoop:
-	for _, tx := range unspentTxs {
-		txID := hex.EncodeToString(tx.TxID)
-		for outIdx, out := range tx.TxOutputList {
-			if out.BelongsTo(address) {
-				accumulated += out.Value
-				candidateUTXOSet[txID] = append(candidateUTXOSet[txID], outIdx)
-				if accumulated >= amount {
-					break TxLoop
-				}
-			}
+	var plan []UnspentTXO
+	for _, utxo := range utxoSet.FindUTXOsByPubKeyHash(wallet.PubKeyHash()) {
+		if mempool != nil && mempool.IsSpent(utxo.SourceTxID, utxo.TxOutputIdx) {
+			continue
+		}
+		accumulated += utxo.Value
+		plan = append(plan, utxo)
+		if accumulated >= amount {
+			break
 		}
 	}
-	return accumulated, candidateUTXOSet
+	return accumulated, plan
 }
 
-func (bc *BlockChain) GenerateTransaction(fromWallet *wallet.Wallet, toAddrList [][]byte, amountList []int) *transaction.Transaction {
-	// generate a transaction
+func (bc *BlockChain) GenerateTransaction(utxoSet *UTXOSet, mempool *PendingTXs, fromWallet *wallet.Wallet,
+	toAddrList [][]byte, amountList []int, fee int) (*transaction.Transaction, error) {
+	// generate a transaction that spends confirmed UTXOs of fromWallet not yet spent by mempool
 	// check input
-	utils.Assert(len(toAddrList) == len(amountList), "TX error: receiver and amount dimension mismatch.")
+	if len(toAddrList) != len(amountList) {
+		return nil, errors.New("receiver and amount dimension mismatch")
+	}
+	if fee < 0 {
+		return nil, errors.New("fee must not be negative")
+	}
 
 	// generate a plan of spending
 	totalAmount := 0
 	for _, amount := range amountList {
+		if amount <= 0 {
+			return nil, errors.New("amount must be positive")
+		}
 		totalAmount += amount
 	}
-	inputTotal, inputUTXOs := bc.GenerateSpendingPlan(fromWallet, totalAmount)
+	// fee is the part of inputs that goes to no output
+	totalAmount += fee
+	inputTotal, inputUTXOs := bc.GenerateSpendingPlan(utxoSet, mempool, fromWallet, totalAmount)
 	if inputTotal < totalAmount {
-		log.Panic("Error: Not enough funds!")
+		return nil, fmt.Errorf("%w: need %v, spendable %v", ErrNotEnoughFunds, totalAmount, inputTotal)
 	}
 
-	// create input list for new transaction
+	// create input list for new transaction, a source transaction may pay us several outputs
 	var inputs []transaction.TxInput
-	for rawTxId, OutIdxList := range inputUTXOs {
-		txID, err := hex.DecodeString(rawTxId)
-		utils.Handle(err)
-		utils.Assert(len(OutIdxList) == 1, "Multiple TXO with same address in one transaction!")
-		for _, out := range OutIdxList {
-			input := transaction.TxInput{SourceTxID: txID, TxOutputIdx: out}
-			input.Sign(&fromWallet.PrivateKey)
-			inputs = append(inputs, input)
-		}
+	for _, utxo := range inputUTXOs {
+		inputs = append(inputs, transaction.TxInput{SourceTxID: utxo.SourceTxID, TxOutputIdx: utxo.TxOutputIdx,
+			PubKey: fromWallet.PublicKey})
 	}
 
 	// create output list for new transaction
 	var outputs []transaction.TxOutput
 	for idx := range toAddrList {
-		outputs = append(outputs, transaction.TxOutput{Value: amountList[idx], Address: toAddrList[idx]})
+		outputs = append(outputs, transaction.NewTxOutput(amountList[idx], toAddrList[idx]))
 	}
 	if inputTotal > totalAmount {
-		outputs = append(outputs, transaction.TxOutput{Value: inputTotal - totalAmount, Address: fromWallet.Address()})
+		outputs = append(outputs, transaction.TxOutput{Value: inputTotal - totalAmount,
+			PubKeyHash: fromWallet.PubKeyHash()})
 	}
 
-	// create new transaction and seal it with ID
+	// create new transaction, sign all inputs and seal it with ID
 	tx := transaction.Transaction{TxInputList: inputs, TxOutputList: outputs}
+	if err := tx.Sign(bc.Params.NetworkID, &fromWallet.PrivateKey); err != nil {
+		return nil, err
+	}
 	tx.SetID()
-	return &tx
+	return &tx, nil
 }
 
-func (bc *BlockChain) GetBalance(address []byte, publicKey *ecdsa.PublicKey) int {
-	// Get balance of an account
-	var unspentTxs = bc.FindUnspentTransactions(address, publicKey)
-	var balance = 0
-	for _, tx := range unspentTxs {
-		for _, out := range tx.TxOutputList {
-			if out.BelongsTo(address) {
-				balance += out.Value
-			}
-		}
+func (bc *BlockChain) GenerateMerkleProof(txID []byte) (*blocks.MerkleProof, *blocks.Block, bool) {
+	// find the block containing txID and generate an inclusion proof for it
+	_, block, found := bc.FindTransaction(txID)
+	if !found {
+		return nil, nil, false
 	}
-	return balance
+	proof, _ := block.GenerateMerkleProof(txID)
+	return proof, block, true
 }
 
-func (bc *BlockChain) GetAllBlocks() []*blocks.Block {
+func (bc *BlockChain) VerifyMerkleProof(proof *blocks.MerkleProof) (*blocks.Block, bool) {
+	// a proof is valid if it leads to the merkle root of some block on our chain
 	hasNext := true
-	var allBlocks []*blocks.Block
 	for iterator := bc.Iterator(); hasNext; {
 		block := iterator.GetVal()
 		hasNext = iterator.Next()
-		allBlocks = append(allBlocks, block)
+		if bytes.Compare(block.GetMerkleRoot(), proof.Root) == 0 {
+			return block, proof.Verify(block.GetMerkleRoot())
+		}
 	}
-	return allBlocks
+	return nil, false
 }
 
 func (bc *BlockChain) Log2Terminal() {
@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"math"
+	"testing"
+
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/transaction"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/AntonyMei/Blockchain/src/wallet"
+)
+
+func coinbaseWithOutputs(values []int, miner []byte) *transaction.Transaction {
+	// coinbase that pays each value to miner in its own output
+	token := make([]byte, 32)
+	_, _ = rand.Read(token)
+	tx := transaction.Transaction{Token: token,
+		TxInputList: []transaction.TxInput{{SourceTxID: []byte{}, TxOutputIdx: -1, Sig: config.CoinbaseSig}}}
+	for _, value := range values {
+		tx.TxOutputList = append(tx.TxOutputList, transaction.NewTxOutput(value, miner))
+	}
+	tx.SetID()
+	return &tx
+}
+
+func TestCoinbaseValueLimit(t *testing.T) {
+	chain, utxoSet, mempool, alice := testMempool(t, 1)
+	aliceAddr := alice.Address(chain.AddressFormat)
+	payment := pay(t, chain, utxoSet, mempool, alice, wallet.CreateWallet(), 10, 2)
+	parent, _ := chain.GetBlock(chain.Tip().Hash)
+	reward := chain.Params.Reward(parent.Height + 1)
+
+	cases := []struct {
+		name   string
+		values []int
+		status utils.BlockStatus
+	}{
+		{"reward and fees", []int{reward + 2}, utils.Verified},
+		{"less than allowed", []int{reward}, utils.Verified},
+		{"more than allowed", []int{reward + 3}, utils.WrongCoinbaseValue},
+		{"zero output", []int{0}, utils.WrongCoinbaseValue},
+		{"negative output", []int{-1}, utils.WrongCoinbaseValue},
+		// several outputs are only allowed in genesis
+		{"split reward", []int{reward, 2}, utils.WrongCoinbaseValue},
+		{"overflowing outputs", []int{math.MaxInt64, math.MaxInt64}, utils.WrongCoinbaseValue},
+		{"huge output", []int{math.MaxInt64}, utils.WrongCoinbaseValue},
+	}
+	for _, c := range cases {
+		block := mineWithCoinbase(t, chain, parent, []*transaction.Transaction{payment},
+			coinbaseWithOutputs(c.values, aliceAddr))
+		if status := chain.ValidateBlock(block, utxoSet); status != c.status {
+			t.Errorf("%s: got %v, expect %v", c.name, status.String(), c.status.String())
+		}
+	}
+}
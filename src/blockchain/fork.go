@@ -0,0 +1,207 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/dgraph-io/badger"
+	"math/big"
+)
+
+// Besides hash -> block, the following keys are stored in badger for fork handling
+// work-[hash]: cumulative work from genesis to the block
+// undo-[hash]: TXOs spent by the block, only for blocks that have been on best chain
+// invalid-[hash]: the block (or one of its ancestors) failed validation
+func workKey(hash []byte) []byte {
+	return append([]byte("work-"), hash...)
+}
+
+func undoKey(hash []byte) []byte {
+	return append([]byte("undo-"), hash...)
+}
+
+func invalidKey(hash []byte) []byte {
+	return append([]byte("invalid-"), hash...)
+}
+
+type ReorgEvent struct {
+	// OldTip / NewTip: last hash before and after reorg
+	// ForkHeight: height of the last block shared by both chains
+	// Disconnected: blocks removed from best chain, from old tip to fork
+	// Connected: blocks added to best chain, from fork to new tip
+	OldTip       []byte
+	NewTip       []byte
+	ForkHeight   int
+	Disconnected []*blocks.Block
+	Connected    []*blocks.Block
+}
+
+var errReorgAborted = errors.New("reorg aborted")
+
+func (event *ReorgEvent) Log2Terminal() {
+	fmt.Printf("[Reorg] Fork at height %v, %v block(s) disconnected, %v block(s) connected.\n",
+		event.ForkHeight, len(event.Disconnected), len(event.Connected))
+	fmt.Printf("Old tip: %x\n", event.OldTip)
+	fmt.Printf("New tip: %x\n", event.NewTip)
+}
+
+func (bc *BlockChain) SetReorgFunc(f func(*ReorgEvent)) {
+	bc.HandleReorg = f
+}
+
+func (bc *BlockChain) readValue(key []byte) ([]byte, bool) {
+	var value []byte
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		utils.Handle(err)
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	utils.Handle(err)
+	return value, value != nil
+}
+
+func (bc *BlockChain) GetCumulativeWork(hash []byte) *big.Int {
+	// read cumulative work of a block, work of blocks stored before work
+	// tracking existed is recomputed from their ancestors
+	var missingList []*blocks.Block
+	work := big.NewInt(0)
+	for cursor := hash; len(cursor) > 0; {
+		if storedWork, found := bc.readValue(workKey(cursor)); found {
+			work.SetBytes(storedWork)
+			break
+		}
+		block, found := bc.GetBlock(cursor)
+		utils.Assert(found, "Block not found when computing cumulative work.")
+		missingList = append(missingList, block)
+		cursor = block.PrevHash
+	}
+	for idx := len(missingList) - 1; idx >= 0; idx-- {
+		work = new(big.Int).Add(work, missingList[idx].Work())
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(workKey(missingList[idx].Hash), work.Bytes())
+		})
+		utils.Handle(err)
+	}
+	return work
+}
+
+func (bc *BlockChain) IsInvalid(hash []byte) bool {
+	_, found := bc.readValue(invalidKey(hash))
+	return found
+}
+
+func (bc *BlockChain) MarkInvalid(hash []byte) {
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(invalidKey(hash), []byte{1})
+	})
+	utils.Handle(err)
+}
+
+func (bc *BlockChain) GetUndoData(hash []byte) []SpentTXO {
+	// read TXOs spent by a block that has been on best chain
+	stream, found := bc.readValue(undoKey(hash))
+	utils.Assert(found, "Undo data not found.")
+	var spentList []SpentTXO
+	var decoder = gob.NewDecoder(bytes.NewReader(stream))
+	utils.Handle(decoder.Decode(&spentList))
+	return spentList
+}
+
+func serializeUndoData(spentList []SpentTXO) []byte {
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(spentList))
+	return result.Bytes()
+}
+
+func (bc *BlockChain) StoreSideBlock(block *blocks.Block) {
+	// store a block that is not (yet) on best chain together with its cumulative work
+	work := new(big.Int).Add(bc.GetCumulativeWork(block.PrevHash), block.Work())
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Set(block.Hash, block.Serialize())
+		utils.Handle(err)
+		return txn.Set(workKey(block.Hash), work.Bytes())
+	})
+	utils.Handle(err)
+}
+
+func (bc *BlockChain) Reorganize(newTip *blocks.Block, utxoSet *UTXOSet) bool {
+	// switch best chain to the one ending with newTip, returns false and stays on
+	// current chain if some block on the new chain is invalid
+	oldTip, found := bc.GetBlock(bc.LastHash)
+	utils.Assert(found, "Last block not found.")
+
+	// walk back from both tips to find the fork point
+	var disconnectList []*blocks.Block
+	var connectList []*blocks.Block
+	oldCursor, newCursor := oldTip, newTip
+	for newCursor.Height > oldCursor.Height {
+		connectList = append([]*blocks.Block{newCursor}, connectList...)
+		newCursor, found = bc.GetBlock(newCursor.PrevHash)
+		utils.Assert(found, "Side chain is not connected.")
+	}
+	for oldCursor.Height > newCursor.Height {
+		disconnectList = append(disconnectList, oldCursor)
+		oldCursor, found = bc.GetBlock(oldCursor.PrevHash)
+		utils.Assert(found, "Best chain is not connected.")
+	}
+	for bytes.Compare(oldCursor.Hash, newCursor.Hash) != 0 {
+		connectList = append([]*blocks.Block{newCursor}, connectList...)
+		disconnectList = append(disconnectList, oldCursor)
+		newCursor, found = bc.GetBlock(newCursor.PrevHash)
+		utils.Assert(found, "Side chain is not connected.")
+		oldCursor, found = bc.GetBlock(oldCursor.PrevHash)
+		utils.Assert(found, "Best chain is not connected.")
+	}
+	forkBlock := oldCursor
+
+	// disconnect old blocks and connect new ones in a single badger txn, so that
+	// UTXO set, indexes and lasthash move together or not at all
+	invalidIdx := -1
+	err := bc.Database.Update(func(txn *badger.Txn) error {
+		utxoView := utxoSet.WithTxn(txn)
+		for _, block := range disconnectList {
+			utxoView.UndoBlock(block, bc.GetUndoData(block.Hash))
+			unindexBlock(txn, block)
+		}
+		// roll UTXO set forward along the new chain, every block is fully validated
+		for idx, block := range connectList {
+			verifyResult := bc.ValidateBlock(block, utxoView)
+			if verifyResult != utils.Verified {
+				fmt.Printf("Reorg aborted, block %x: %v.\n", block.Hash, verifyResult.String())
+				invalidIdx = idx
+				// discard the txn to stay on the old chain
+				return errReorgAborted
+			}
+			undoData := utxoView.GenerateUndoData(block)
+			utxoView.DumpBlock(block)
+			err := txn.Set(undoKey(block.Hash), serializeUndoData(undoData))
+			utils.Handle(err)
+			indexBlock(txn, block)
+		}
+		return txn.Set([]byte("lasthash"), newTip.Hash)
+	})
+	if err == errReorgAborted {
+		for _, invalidBlock := range connectList[invalidIdx:] {
+			bc.MarkInvalid(invalidBlock.Hash)
+		}
+		return false
+	}
+	utils.Handle(err)
+	bc.setTip(newTip)
+
+	// notify others
+	event := ReorgEvent{OldTip: oldTip.Hash, NewTip: newTip.Hash, ForkHeight: forkBlock.Height,
+		Disconnected: disconnectList, Connected: connectList}
+	if bc.HandleReorg != nil {
+		bc.HandleReorg(&event)
+	}
+	return true
+}
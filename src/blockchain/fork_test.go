@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/transaction"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/AntonyMei/Blockchain/src/wallet"
+)
+
+func testChain(t *testing.T) (*BlockChain, *UTXOSet) {
+	// regtest chain of user "alice" in a data dir of its own, closed when test ends
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	cfg.Chain = config.RegtestChainParams()
+	if err := os.MkdirAll(cfg.UserPath("alice"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	chain := InitBlockChain(cfg, "alice")
+	t.Cleanup(chain.Exit)
+	return chain, InitUTXOSet(chain)
+}
+
+func mineOn(t *testing.T, chain *BlockChain, parent *blocks.Block, miner []byte, txList []*transaction.Transaction,
+	fees int) *blocks.Block {
+	// block on top of parent whichever branch it is on, coinbase pays reward and fees to miner
+	coinbase := transaction.CoinbaseTx(miner, chain.Params.Reward(parent.Height+1), fees)
+	return mineWithCoinbase(t, chain, parent, txList, coinbase)
+}
+
+func mineWithCoinbase(t *testing.T, chain *BlockChain, parent *blocks.Block, txList []*transaction.Transaction,
+	coinbase *transaction.Transaction) *blocks.Block {
+	txList = append(txList, coinbase)
+	block, status := blocks.CreateBlock(context.Background(), "test block", txList, parent.Hash,
+		chain.GetNextDifficulty(parent), parent.Height, parent.Timestamp+1)
+	if status != utils.MiningSucceeded {
+		t.Fatalf("mining failed: %v", status.String())
+	}
+	return block
+}
+
+func addBlocks(t *testing.T, chain *BlockChain, utxoSet *UTXOSet, blockList ...*blocks.Block) {
+	for _, block := range blockList {
+		chain.AddBlock(block, utxoSet)
+		if chain.IsInvalid(block.Hash) {
+			t.Fatalf("block at height %v is invalid", block.Height)
+		}
+	}
+}
+
+func checkConsistent(t *testing.T, chain *BlockChain, utxoSet *UTXOSet) {
+	// stored UTXO set and indexes are the same as replaying best chain from genesis
+	report := chain.VerifyChain(utxoSet)
+	if !report.IsConsistent() {
+		t.Fatalf("chain is not consistent: %+v", report)
+	}
+}
+
+func TestReorgRoundTrip(t *testing.T) {
+	chain, utxoSet := testChain(t)
+	alice, bob, carol := wallet.CreateWallet(), wallet.CreateWallet(), wallet.CreateWallet()
+	aliceAddr := alice.Address(chain.AddressFormat)
+	bobAddr := bob.Address(chain.AddressFormat)
+	carolAddr := carol.Address(chain.AddressFormat)
+	var events []*ReorgEvent
+	chain.SetReorgFunc(func(event *ReorgEvent) {
+		events = append(events, event)
+	})
+
+	// main chain: alice mines a block, then pays bob 30 in the next one
+	genesis, _ := chain.GetBlockByHeight(0)
+	a1 := mineOn(t, chain, genesis, aliceAddr, nil, 0)
+	addBlocks(t, chain, utxoSet, a1)
+	payment, err := chain.GenerateTransaction(utxoSet, nil, alice, [][]byte{bobAddr}, []int{30}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2 := mineOn(t, chain, a1, aliceAddr, []*transaction.Transaction{payment}, 0)
+	addBlocks(t, chain, utxoSet, a2)
+	aliceBalance := utxoSet.GetBalance(alice.PubKeyHash())
+	if utxoSet.GetBalance(bob.PubKeyHash()) != 30 {
+		t.Fatalf("bob has %v, expect 30", utxoSet.GetBalance(bob.PubKeyHash()))
+	}
+
+	// carol mines a longer branch from a1, payment to bob is undone
+	b2 := mineOn(t, chain, a1, carolAddr, nil, 0)
+	b3 := mineOn(t, chain, b2, carolAddr, nil, 0)
+	addBlocks(t, chain, utxoSet, b2, b3)
+	if !bytes.Equal(chain.Tip().Hash, b3.Hash) {
+		t.Fatal("best chain does not switch to the longer branch")
+	}
+	if len(events) != 1 || len(events[0].Disconnected) != 1 || len(events[0].Connected) != 2 ||
+		events[0].ForkHeight != a1.Height {
+		t.Fatalf("unexpected reorg events: %+v", events)
+	}
+	if balance := utxoSet.GetBalance(bob.PubKeyHash()); balance != 0 {
+		t.Fatalf("bob has %v after payment is disconnected", balance)
+	}
+	if utxoSet.GetBalance(carol.PubKeyHash()) != 2*chain.Params.Reward(2) {
+		t.Fatalf("carol has %v, expect rewards of two blocks", utxoSet.GetBalance(carol.PubKeyHash()))
+	}
+	if _, _, found := chain.FindTransaction(payment.TxID); found {
+		t.Fatal("disconnected transaction is still indexed")
+	}
+	checkConsistent(t, chain, utxoSet)
+
+	// main chain grows longer again, everything is back as it was with two more blocks
+	a3 := mineOn(t, chain, a2, aliceAddr, nil, 0)
+	a4 := mineOn(t, chain, a3, aliceAddr, nil, 0)
+	addBlocks(t, chain, utxoSet, a3, a4)
+	if !bytes.Equal(chain.Tip().Hash, a4.Hash) || chain.Tip().Height != 4 {
+		t.Fatal("best chain does not switch back to the main branch")
+	}
+	if len(events) != 2 || len(events[1].Disconnected) != 2 || len(events[1].Connected) != 3 {
+		t.Fatalf("unexpected reorg events: %+v", events)
+	}
+	if balance := utxoSet.GetBalance(bob.PubKeyHash()); balance != 30 {
+		t.Fatalf("bob has %v after payment is connected again", balance)
+	}
+	expected := aliceBalance + chain.Params.Reward(3) + chain.Params.Reward(4)
+	if balance := utxoSet.GetBalance(alice.PubKeyHash()); balance != expected {
+		t.Fatalf("alice has %v, expect %v", balance, expected)
+	}
+	if balance := utxoSet.GetBalance(carol.PubKeyHash()); balance != 0 {
+		t.Fatalf("carol has %v on main branch", balance)
+	}
+	if _, block, found := chain.FindTransaction(payment.TxID); !found || !bytes.Equal(block.Hash, a2.Hash) {
+		t.Fatal("payment is not indexed in its block again")
+	}
+	checkConsistent(t, chain, utxoSet)
+}
+
+func TestReorgToInvalidBranch(t *testing.T) {
+	chain, utxoSet := testChain(t)
+	alice, carol := wallet.CreateWallet(), wallet.CreateWallet()
+	aliceAddr, carolAddr := alice.Address(chain.AddressFormat), carol.Address(chain.AddressFormat)
+	genesis, _ := chain.GetBlockByHeight(0)
+	a1 := mineOn(t, chain, genesis, aliceAddr, nil, 0)
+	addBlocks(t, chain, utxoSet, a1)
+
+	// a longer branch whose first block claims more than its reward is not switched to
+	b1 := mineOn(t, chain, genesis, carolAddr, nil, 1)
+	b2 := mineOn(t, chain, b1, carolAddr, nil, 0)
+	chain.AddBlock(b1, utxoSet)
+	chain.AddBlock(b2, utxoSet)
+	if !bytes.Equal(chain.Tip().Hash, a1.Hash) {
+		t.Fatal("best chain switches to an invalid branch")
+	}
+	if !chain.IsInvalid(b1.Hash) || !chain.IsInvalid(b2.Hash) {
+		t.Fatal("invalid branch is not marked invalid")
+	}
+	if balance := utxoSet.GetBalance(alice.PubKeyHash()); balance != chain.Params.Reward(1) {
+		t.Fatalf("alice has %v after aborted reorg", balance)
+	}
+	checkConsistent(t, chain, utxoSet)
+}
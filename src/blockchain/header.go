@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/utils"
+)
+
+// Header checks only need ancestors of a header, getHeader looks them up. It is usually
+// GetHeader of the chain, but headers-first sync also looks into headers whose blocks
+// have not been downloaded yet.
+
+func (bc *BlockChain) GetHeader(hash []byte) (*blocks.BlockHeader, bool) {
+	block, found := bc.GetBlock(hash)
+	if !found {
+		return nil, false
+	}
+	return block.Header(), true
+}
+
+func NextDifficulty(params *config.ChainParams, prevHeader *blocks.BlockHeader,
+	getHeader func([]byte) (*blocks.BlockHeader, bool)) int {
+	// difficulty only changes every RetargetInterval blocks, and never in regtest
+	nextHeight := prevHeader.Height + 1
+	if params.Regtest || nextHeight%params.RetargetInterval != 0 {
+		return prevHeader.Difficulty
+	}
+	// walk back to the first block of this retarget window
+	firstHeader := prevHeader
+	for idx := 0; idx < params.RetargetInterval-1; idx++ {
+		header, found := getHeader(firstHeader.PrevHash)
+		utils.Assert(found, "Retarget window goes beyond genesis.")
+		firstHeader = header
+	}
+	actualTimespan := prevHeader.Timestamp - firstHeader.Timestamp
+	expectedTimespan := int64(params.RetargetInterval-1) * params.TargetBlockInterval
+	return blocks.CalculateNextDifficulty(params, prevHeader.Difficulty, actualTimespan, expectedTimespan)
+}
+
+func ValidateHeader(params *config.ChainParams, header *blocks.BlockHeader, now int64,
+	getHeader func([]byte) (*blocks.BlockHeader, bool)) utils.BlockStatus {
+	// check everything of a non-genesis header, i.e. all of a block except its transactions
+	// now: chain time in milliseconds
+	// check prevHash
+	prevHeader, prevHeaderFound := getHeader(header.PrevHash)
+	if !prevHeaderFound {
+		return utils.PrevBlockNotFound
+	}
+	// check height
+	if header.Height != prevHeader.Height+1 {
+		return utils.WrongHeight
+	}
+	// check timestamp, it can not go backwards or be too far in the future
+	if header.Timestamp < prevHeader.Timestamp ||
+		header.Timestamp > now+params.MaxFutureBlockTime {
+		return utils.WrongTimestamp
+	}
+	// check difficulty
+	if header.Difficulty != NextDifficulty(params, prevHeader, getHeader) {
+		return utils.WrongDifficulty
+	}
+	// check hash
+	if !header.ValidateProofOfWork(params.MinDifficulty) {
+		return utils.HashMismatch
+	}
+	return utils.Verified
+}
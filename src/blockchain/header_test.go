@@ -0,0 +1,61 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+)
+
+func testHeaders(count int, difficulty int, interval int64) ([]*blocks.BlockHeader,
+	func([]byte) (*blocks.BlockHeader, bool)) {
+	// a chain of count headers, one every interval milliseconds, and the lookup of it
+	headers := make([]*blocks.BlockHeader, count)
+	byHash := make(map[string]*blocks.BlockHeader)
+	var prevHash []byte
+	for height := 0; height < count; height++ {
+		header := &blocks.BlockHeader{PrevHash: prevHash, Hash: []byte{byte(height), 0xcd}, Height: height,
+			Timestamp: int64(height) * interval, Difficulty: difficulty}
+		headers[height] = header
+		byHash[string(header.Hash)] = header
+		prevHash = header.Hash
+	}
+	return headers, func(hash []byte) (*blocks.BlockHeader, bool) {
+		header, found := byHash[string(hash)]
+		return header, found
+	}
+}
+
+func TestNextDifficultyRetargetWindow(t *testing.T) {
+	params := config.Default().Chain
+	params.RetargetInterval = 4
+	params.TargetBlockInterval = 1000
+	params.MaxDifficultyAdjustment = 2
+	params.MinDifficulty = 1
+
+	// blocks come twice as fast as expected
+	headers, getHeader := testHeaders(8, 10, 500)
+	for _, prev := range headers {
+		next := NextDifficulty(&params, prev, getHeader)
+		if (prev.Height+1)%params.RetargetInterval != 0 {
+			if next != 10 {
+				t.Fatalf("difficulty after height %v changes to %v inside a window", prev.Height, next)
+			}
+		} else if next != 11 {
+			t.Fatalf("difficulty after height %v is %v, expect 11", prev.Height, next)
+		}
+	}
+
+	// blocks on time keep difficulty at the boundary
+	headers, getHeader = testHeaders(4, 10, 1000)
+	if next := NextDifficulty(&params, headers[3], getHeader); next != 10 {
+		t.Fatalf("difficulty changes to %v with blocks on time", next)
+	}
+
+	// regtest never retargets
+	params.Regtest = true
+	headers, getHeader = testHeaders(4, 10, 1)
+	if next := NextDifficulty(&params, headers[3], getHeader); next != 10 {
+		t.Fatalf("difficulty changes to %v in regtest", next)
+	}
+}
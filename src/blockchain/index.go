@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/transaction"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/dgraph-io/badger"
+)
+
+// Indexes of best chain stored in badger, they are updated together with lasthash
+// height-[height]: hash of block at that height
+// tx-[txID]: location of a transaction
+// addr-[len(pubKeyHash)][pubKeyHash][txID][outputIdx]: an output locked with pubKeyHash
+func heightKey(height int) []byte {
+	return append([]byte("height-"), utils.Int2Hex(int64(height))...)
+}
+
+func txKey(txID []byte) []byte {
+	return append([]byte("tx-"), txID...)
+}
+
+func addrPrefix(pubKeyHash []byte) []byte {
+	return bytes.Join([][]byte{[]byte("addr-"), {byte(len(pubKeyHash))}, pubKeyHash}, []byte{})
+}
+
+func addrKey(pubKeyHash []byte, txID []byte, outputIdx int) []byte {
+	return bytes.Join([][]byte{addrPrefix(pubKeyHash), txID, utils.Int2Hex(int64(outputIdx))}, []byte{})
+}
+
+type TxLocation struct {
+	// BlockHash: hash of the block that contains the transaction
+	// Position: index of the transaction in TransactionList of that block
+	BlockHash []byte
+	Position  int
+}
+
+type Outpoint struct {
+	// an output of some transaction
+	TxID        []byte
+	TxOutputIdx int
+}
+
+func indexBlock(txn *badger.Txn, block *blocks.Block) {
+	// add a block that joins best chain into indexes
+	err := txn.Set(heightKey(block.Height), block.Hash)
+	utils.Handle(err)
+	for position, tx := range block.TransactionList {
+		var location bytes.Buffer
+		var encoder = gob.NewEncoder(&location)
+		utils.Handle(encoder.Encode(TxLocation{BlockHash: block.Hash, Position: position}))
+		err = txn.Set(txKey(tx.TxID), location.Bytes())
+		utils.Handle(err)
+		for outputIdx, txo := range tx.TxOutputList {
+			err = txn.Set(addrKey(txo.PubKeyHash, tx.TxID, outputIdx), []byte{})
+			utils.Handle(err)
+		}
+	}
+}
+
+func unindexBlock(txn *badger.Txn, block *blocks.Block) {
+	// remove a block that leaves best chain from indexes
+	err := txn.Delete(heightKey(block.Height))
+	utils.Handle(err)
+	for _, tx := range block.TransactionList {
+		err = txn.Delete(txKey(tx.TxID))
+		utils.Handle(err)
+		for outputIdx, txo := range tx.TxOutputList {
+			err = txn.Delete(addrKey(txo.PubKeyHash, tx.TxID, outputIdx))
+			utils.Handle(err)
+		}
+	}
+}
+
+func (bc *BlockChain) HasIndexes() bool {
+	// indexes are complete if the tip is indexed
+	hash, found := bc.readValue(heightKey(bc.BlockHeight))
+	return found && bytes.Compare(hash, bc.LastHash) == 0
+}
+
+func (bc *BlockChain) BuildIndexes() {
+	// index every block on best chain, used for chains stored before indexes existed
+	fmt.Println("Building indexes of blockchain...")
+	hasNext := true
+	for iterator := bc.Iterator(); hasNext; {
+		block := iterator.GetVal()
+		hasNext = iterator.Next()
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			indexBlock(txn, block)
+			return nil
+		})
+		utils.Handle(err)
+	}
+}
+
+func (bc *BlockChain) GetBlockHashByHeight(height int) ([]byte, bool) {
+	return bc.readValue(heightKey(height))
+}
+
+func (bc *BlockChain) GetBlockByHeight(height int) (*blocks.Block, bool) {
+	// get block on best chain with given height
+	hash, found := bc.GetBlockHashByHeight(height)
+	if !found {
+		return nil, false
+	}
+	return bc.GetBlock(hash)
+}
+
+func (bc *BlockChain) FindTransaction(txID []byte) (*transaction.Transaction, *blocks.Block, bool) {
+	// find a transaction on best chain and the block that contains it
+	stream, found := bc.readValue(txKey(txID))
+	if !found {
+		return nil, nil, false
+	}
+	var location TxLocation
+	var decoder = gob.NewDecoder(bytes.NewReader(stream))
+	utils.Handle(decoder.Decode(&location))
+	block, found := bc.GetBlock(location.BlockHash)
+	utils.Assert(found, "Indexed block not found.")
+	return block.TransactionList[location.Position], block, true
+}
+
+func isIndexedElsewhere(utxoSet *UTXOSet, txID []byte, blockHash []byte) bool {
+	// whether best chain seen by utxoSet, which may be a view inside a badger txn, has
+	// txID in a block other than blockHash
+	indexed := false
+	utxoSet.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(txKey(txID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		utils.Handle(err)
+		return item.Value(func(val []byte) error {
+			var location TxLocation
+			utils.Handle(gob.NewDecoder(bytes.NewReader(val)).Decode(&location))
+			indexed = bytes.Compare(location.BlockHash, blockHash) != 0
+			return nil
+		})
+	})
+	return indexed
+}
+
+func (bc *BlockChain) GetAddressHistory(pubKeyHash []byte) []Outpoint {
+	// get all outputs on best chain that are locked with pubKeyHash, spent or not
+	var outpoints []Outpoint
+	prefix := addrPrefix(pubKeyHash)
+	err := bc.Database.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+		for iterator.Seek(prefix); iterator.ValidForPrefix(prefix); iterator.Next() {
+			key := iterator.Item().KeyCopy(nil)
+			rest := key[len(prefix):]
+			txID := rest[:len(rest)-8]
+			outputIdx := int(binary.BigEndian.Uint64(rest[len(rest)-8:]))
+			outpoints = append(outpoints, Outpoint{TxID: txID, TxOutputIdx: outputIdx})
+		}
+		return nil
+	})
+	utils.Handle(err)
+	return outpoints
+}
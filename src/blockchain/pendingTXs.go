@@ -1,60 +1,428 @@
 package blockchain
 
 import (
+	"container/heap"
+	"encoding/hex"
 	"fmt"
-	"sync"
+	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/transaction"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"sort"
+	"strconv"
+	"sync"
 )
 
+type PendingTX struct {
+	// Key: name of the transaction in pending zone
+	// Size: serialized size of the transaction, counted against MaxPendingTXBytes
+	// Fee: input sum minus output sum, goes to the miner
+	// ArrivalTime: when the transaction enters pending zone (in milliseconds)
+	Key         string
+	Tx          *transaction.Transaction
+	Size        int
+	Fee         int
+	ArrivalTime int64
+	// order: position in arrival order, breaks ties of ArrivalTime
+	order int
+}
+
 type PendingTXs struct {
-	pendingTXMap map[string]*transaction.Transaction
-	mu sync.Mutex
+	// mempool: every transaction in it is valid on top of UTXO set and pending
+	// transactions that arrived before it, and no two of them spend the same TXO
+	pendingTXMap map[string]*PendingTX
+	// txID (hex) -> key of pending tx
+	txID2Key map[string]string
+	// spent TXO (see outpointKey) -> key of pending tx that spends it
+	spentTXOMap map[string]string
+	totalSize   int
+	nextOrder   int
+	utxoSet     *UTXOSet
+	params      config.MempoolParams
+	// networkID: transactions must be signed for this network, see Transaction.SignatureHash
+	networkID string
+	// clock: chain time, arrival and expiry of transactions use it
+	clock *utils.Clock
+	mu    sync.Mutex
+}
+
+func outpointKey(txID []byte, txOutputIdx int) string {
+	return hex.EncodeToString(txID) + ":" + strconv.Itoa(txOutputIdx)
 }
 
-func InitPendingTXs() *PendingTXs {
+func InitPendingTXs(utxoSet *UTXOSet, params config.MempoolParams, networkID string,
+	clock *utils.Clock) *PendingTXs {
 	var p PendingTXs
-	p.pendingTXMap = make(map[string]*transaction.Transaction)
+	p.params = params
+	p.networkID = networkID
+	p.clock = clock
+	p.pendingTXMap = make(map[string]*PendingTX)
+	p.txID2Key = make(map[string]string)
+	p.spentTXOMap = make(map[string]string)
+	p.utxoSet = utxoSet
 	return &p
 }
 
-func (p *PendingTXs) AddTransaction(txKey string, tx *transaction.Transaction) {
+func (p *PendingTXs) AddTransaction(txKey string, tx *transaction.Transaction) utils.MempoolStatus {
+	// validate a transaction and put it into pending zone if it is accepted
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.pendingTXMap[txKey] = tx
+	p.expireTransactions()
+	p.nextOrder += 1
+	return p.addTransaction(&PendingTX{Key: txKey, Tx: tx, Size: tx.Size(), ArrivalTime: p.clock.Now().UnixMilli(),
+		order: p.nextOrder})
+}
+
+func (p *PendingTXs) addTransaction(entry *PendingTX) utils.MempoolStatus {
+	// check whether we have it already
+	if _, exists := p.pendingTXMap[entry.Key]; exists {
+		return utils.TXAlreadyKnown
+	}
+	if _, exists := p.txID2Key[hex.EncodeToString(entry.Tx.TxID)]; exists {
+		return utils.TXAlreadyKnown
+	}
+	// coinbase transactions only exist in blocks
+	if entry.Tx.IsCoinbase() {
+		return utils.TXInvalid
+	}
+	// check conflicts with pending transactions
+	for _, input := range entry.Tx.TxInputList {
+		if _, spent := p.spentTXOMap[outpointKey(input.SourceTxID, input.TxOutputIdx)]; spent {
+			return utils.TXConflict
+		}
+	}
+	// check the transaction on top of UTXO set and pending transactions
+	verifyResult, fee := ValidateTransaction(entry.Tx, p.networkID, p.findTXO)
+	if verifyResult != utils.Verified {
+		fmt.Printf("Verify transaction %s: %v.\n", entry.Key, verifyResult.String())
+		// inputs may be in a block or transaction we have not received yet
+		if verifyResult == utils.SourceTXONotFound {
+			return utils.TXMissingInputs
+		}
+		return utils.TXInvalid
+	}
+	entry.Fee = fee
+	// make room for it
+	if entry.Size > p.params.MaxBytes {
+		return utils.TXPoolFull
+	}
+	ancestors := p.getAncestors(entry.Tx)
+	for len(p.pendingTXMap) >= p.params.MaxTXs || p.totalSize+entry.Size > p.params.MaxBytes {
+		if !p.evictCheapest(entry, ancestors) {
+			return utils.TXPoolFull
+		}
+	}
+	// put into pending zone
+	p.pendingTXMap[entry.Key] = entry
+	p.txID2Key[hex.EncodeToString(entry.Tx.TxID)] = entry.Key
+	for _, input := range entry.Tx.TxInputList {
+		p.spentTXOMap[outpointKey(input.SourceTxID, input.TxOutputIdx)] = entry.Key
+	}
+	p.totalSize += entry.Size
+	return utils.TXAccepted
 }
 
-func (p *PendingTXs) ListPendingTransactions() { 
+func (p *PendingTXs) findTXO(sourceTxID []byte, txOutputIdx int) (UnspentTXO, []byte, bool) {
+	// a TXO can be spent if it is in UTXO set or is an output of some pending transaction
+	if utxo, pubKeyHash, exists := p.utxoSet.FindUTXO(sourceTxID, txOutputIdx); exists {
+		return utxo, pubKeyHash, true
+	}
+	parentKey, exists := p.txID2Key[hex.EncodeToString(sourceTxID)]
+	if !exists {
+		return UnspentTXO{}, nil, false
+	}
+	parent := p.pendingTXMap[parentKey].Tx
+	if txOutputIdx < 0 || txOutputIdx >= len(parent.TxOutputList) {
+		return UnspentTXO{}, nil, false
+	}
+	txo := parent.TxOutputList[txOutputIdx]
+	return UnspentTXO{SourceTxID: sourceTxID, TxOutputIdx: txOutputIdx, Value: txo.Value}, txo.PubKeyHash, true
+}
+
+func (p *PendingTXs) IsSpent(sourceTxID []byte, txOutputIdx int) bool {
+	// whether some pending transaction spends the TXO already
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	idx := 0
-	for txKey := range p.pendingTXMap {
-		fmt.Printf("Transaction %v: %s\n", idx, txKey)
+	_, spent := p.spentTXOMap[outpointKey(sourceTxID, txOutputIdx)]
+	return spent
+}
+
+func (p *PendingTXs) getAncestors(tx *transaction.Transaction) map[string]bool {
+	// keys of pending transactions whose outputs tx depends on, directly or not
+	ancestors := make(map[string]bool)
+	queue := []*transaction.Transaction{tx}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, input := range cur.TxInputList {
+			parentKey, exists := p.txID2Key[hex.EncodeToString(input.SourceTxID)]
+			if exists && !ancestors[parentKey] {
+				ancestors[parentKey] = true
+				queue = append(queue, p.pendingTXMap[parentKey].Tx)
+			}
+		}
+	}
+	return ancestors
+}
+
+func (entry *PendingTX) paysLessThan(other *PendingTX) bool {
+	// compare fee rates, i.e. Fee / Size, the older one pays more if they are equal
+	lhs, rhs := entry.Fee*other.Size, other.Fee*entry.Size
+	if lhs != rhs {
+		return lhs < rhs
+	}
+	return entry.order > other.order
+}
+
+func (p *PendingTXs) evictCheapest(newEntry *PendingTX, protected map[string]bool) bool {
+	// evict the transaction with lowest fee rate that is not protected, together with
+	// its descendants, returns false if newEntry does not pay more than it
+	var cheapest *PendingTX
+	for key, entry := range p.pendingTXMap {
+		if protected[key] {
+			continue
+		}
+		if cheapest == nil || entry.paysLessThan(cheapest) {
+			cheapest = entry
+		}
+	}
+	if cheapest == nil || !cheapest.paysLessThan(newEntry) {
+		return false
+	}
+	p.removeWithDescendants(cheapest.Key)
+	return true
+}
+
+func (p *PendingTXs) removeWithDescendants(txKey string) {
+	entry, exists := p.pendingTXMap[txKey]
+	if !exists {
+		return
+	}
+	p.removeTransaction(txKey)
+	for outputIdx := range entry.Tx.TxOutputList {
+		if childKey, spent := p.spentTXOMap[outpointKey(entry.Tx.TxID, outputIdx)]; spent {
+			p.removeWithDescendants(childKey)
+		}
+	}
+}
+
+func (p *PendingTXs) removeTransaction(txKey string) {
+	entry, exists := p.pendingTXMap[txKey]
+	if !exists {
+		return
+	}
+	delete(p.pendingTXMap, txKey)
+	delete(p.txID2Key, hex.EncodeToString(entry.Tx.TxID))
+	for _, input := range entry.Tx.TxInputList {
+		delete(p.spentTXOMap, outpointKey(input.SourceTxID, input.TxOutputIdx))
+	}
+	p.totalSize -= entry.Size
+}
+
+func (p *PendingTXs) expireTransactions() {
+	// remove transactions that have waited for too long, together with their descendants
+	now := p.clock.Now().UnixMilli()
+	for key, entry := range p.pendingTXMap {
+		if now-entry.ArrivalTime > p.params.Expiry {
+			p.removeWithDescendants(key)
+		}
+	}
+}
+
+func (p *PendingTXs) sortedEntries() []*PendingTX {
+	// entries in arrival order, a transaction always comes after its parents
+	var entries []*PendingTX
+	for _, entry := range p.pendingTXMap {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].order < entries[j].order
+	})
+	return entries
+}
+
+func (p *PendingTXs) Revalidate() int {
+	// check every transaction again after UTXO set changes (new block or reorg), and
+	// drop those that are mined, conflict with the chain or expire
+	// returns the number of transactions dropped
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expireTransactions()
+	entries := p.sortedEntries()
+	p.pendingTXMap = make(map[string]*PendingTX)
+	p.txID2Key = make(map[string]string)
+	p.spentTXOMap = make(map[string]string)
+	p.totalSize = 0
+	dropped := 0
+	for _, entry := range entries {
+		if p.addTransaction(entry) != utils.TXAccepted {
+			dropped += 1
+		}
+	}
+	return dropped
+}
+
+func (p *PendingTXs) ListPendingTransactions() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Printf("%v transaction(s), %v bytes in pending zone.\n", len(p.pendingTXMap), p.totalSize)
+	for idx, entry := range p.sortedEntries() {
+		fmt.Printf("Transaction %v: %s\n", idx, entry.Key)
 		//tx.Log2Terminal()
-		idx += 1
 	}
 }
 
+func (p *PendingTXs) GetTxByID(txID []byte) (string, *transaction.Transaction) {
+	// returns key and transaction, or nil if no pending transaction has this id
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	txKey, exists := p.txID2Key[hex.EncodeToString(txID)]
+	if !exists {
+		return "", nil
+	}
+	return txKey, p.pendingTXMap[txKey].Tx
+}
+
 func (p *PendingTXs) GetTx(txKey string) *transaction.Transaction {
 	p.mu.Lock()
-	tx := p.pendingTXMap[txKey]
-	p.mu.Unlock()
-	return tx
+	defer p.mu.Unlock()
+	entry, exists := p.pendingTXMap[txKey]
+	if !exists {
+		return nil
+	}
+	return entry.Tx
 }
 
 func (p *PendingTXs) DeleteTx(txKey string) {
+	// remove a single transaction, e.g. after it is mined
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	delete(p.pendingTXMap, txKey)
+	p.removeTransaction(txKey)
 }
 
 func (p *PendingTXs) GetAllTx() ([]string, []*transaction.Transaction) {
+	// all pending transactions in arrival order, so that parents come before children
 	p.mu.Lock()
+	defer p.mu.Unlock()
 	allTxs := []*transaction.Transaction{}
 	allTxKeys := []string{}
-	for txKey, tx := range p.pendingTXMap {
-		allTxs = append(allTxs, tx)
-		allTxKeys = append(allTxKeys, txKey)
+	for _, entry := range p.sortedEntries() {
+		allTxs = append(allTxs, entry.Tx)
+		allTxKeys = append(allTxKeys, entry.Key)
 	}
-	p.mu.Unlock()
 	return allTxKeys, allTxs
 }
+
+func (p *PendingTXs) GetAllEntries() []PendingTX {
+	// copies of all pending entries in arrival order
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var entries []PendingTX
+	for _, entry := range p.sortedEntries() {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+func (p *PendingTXs) GetFee(txKey string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, exists := p.pendingTXMap[txKey]
+	if !exists {
+		return 0
+	}
+	return entry.Fee
+}
+
+// templateQueue: packages of pending transactions, the one with highest fee rate first
+type templateQueue []*PendingTX
+
+func (q templateQueue) Len() int           { return len(q) }
+func (q templateQueue) Less(i, j int) bool { return q[j].paysLessThan(q[i]) }
+func (q templateQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *templateQueue) Push(x interface{}) {
+	*q = append(*q, x.(*PendingTX))
+}
+
+func (q *templateQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func (p *PendingTXs) BuildBlockTemplate(maxBytes int) ([]string, []*transaction.Transaction, int) {
+	// pick pending transactions with highest fee rate whose total size is within maxBytes
+	// a transaction is picked together with its unpicked pending ancestors, and the fee rate
+	// of this package decides its priority; parents always come before children
+	// returns keys, transactions and total fee
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// package of each transaction starts with all its pending ancestors, fee and size of
+	// picked ones are taken out of the packages of their descendants as they are picked
+	ancestors := make(map[string]map[string]bool)
+	descendants := make(map[string][]string)
+	packages := make(map[string]*PendingTX)
+	queue := &templateQueue{}
+	for key, entry := range p.pendingTXMap {
+		ancestors[key] = p.getAncestors(entry.Tx)
+		pkg := &PendingTX{Key: key, Fee: entry.Fee, Size: entry.Size, order: entry.order}
+		for ancestorKey := range ancestors[key] {
+			ancestor := p.pendingTXMap[ancestorKey]
+			pkg.Fee += ancestor.Fee
+			pkg.Size += ancestor.Size
+			descendants[ancestorKey] = append(descendants[ancestorKey], key)
+		}
+		packages[key] = pkg
+		heap.Push(queue, pkg)
+	}
+	picked := make(map[string]bool)
+	var pickedEntries []*PendingTX
+	usedBytes, totalFee := 0, 0
+	for queue.Len() > 0 {
+		best := heap.Pop(queue).(*PendingTX)
+		// packages changed after being queued, and picked or skipped ones, are stale
+		if packages[best.Key] != best {
+			continue
+		}
+		if usedBytes+best.Size > maxBytes {
+			// the package does not fit, its last member is not considered again
+			delete(packages, best.Key)
+			continue
+		}
+		members := []string{best.Key}
+		for ancestorKey := range ancestors[best.Key] {
+			if !picked[ancestorKey] {
+				members = append(members, ancestorKey)
+			}
+		}
+		for _, key := range members {
+			entry := p.pendingTXMap[key]
+			picked[key] = true
+			delete(packages, key)
+			pickedEntries = append(pickedEntries, entry)
+			for _, descendantKey := range descendants[key] {
+				if pkg, queued := packages[descendantKey]; queued {
+					updated := *pkg
+					updated.Fee -= entry.Fee
+					updated.Size -= entry.Size
+					packages[descendantKey] = &updated
+					heap.Push(queue, &updated)
+				}
+			}
+		}
+		usedBytes += best.Size
+		totalFee += best.Fee
+	}
+	// arrival order keeps parents before children
+	sort.Slice(pickedEntries, func(i, j int) bool {
+		return pickedEntries[i].order < pickedEntries[j].order
+	})
+	var keys []string
+	var txList []*transaction.Transaction
+	for _, entry := range pickedEntries {
+		keys = append(keys, entry.Key)
+		txList = append(txList, entry.Tx)
+	}
+	return keys, txList, totalFee
+}
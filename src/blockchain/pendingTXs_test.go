@@ -0,0 +1,147 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/transaction"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/AntonyMei/Blockchain/src/wallet"
+)
+
+func testMempool(t *testing.T, blockCount int) (*BlockChain, *UTXOSet, *PendingTXs, *wallet.Wallet) {
+	// regtest chain where a wallet has mined blockCount blocks, and an empty mempool on it
+	chain, utxoSet := testChain(t)
+	miner := wallet.CreateWallet()
+	for idx := 0; idx < blockCount; idx++ {
+		parent, _ := chain.GetBlock(chain.Tip().Hash)
+		addBlocks(t, chain, utxoSet, mineOn(t, chain, parent, miner.Address(chain.AddressFormat), nil, 0))
+	}
+	mempool := InitPendingTXs(utxoSet, config.Default().Mempool, chain.Params.NetworkID, chain.Clock)
+	return chain, utxoSet, mempool, miner
+}
+
+func spendOutput(t *testing.T, chain *BlockChain, owner *wallet.Wallet, source *transaction.Transaction,
+	outputIdx int, to []byte, fee int) *transaction.Transaction {
+	// pay an output of a pending transaction to another address, minus fee
+	value := source.TxOutputList[outputIdx].Value - fee
+	tx := transaction.Transaction{
+		TxInputList: []transaction.TxInput{{SourceTxID: source.TxID, TxOutputIdx: outputIdx,
+			PubKey: owner.PublicKey}},
+		TxOutputList: []transaction.TxOutput{transaction.NewTxOutput(value, to)},
+	}
+	if err := tx.Sign(chain.Params.NetworkID, &owner.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	tx.SetID()
+	return &tx
+}
+
+func pay(t *testing.T, chain *BlockChain, utxoSet *UTXOSet, mempool *PendingTXs, from *wallet.Wallet,
+	to *wallet.Wallet, amount int, fee int) *transaction.Transaction {
+	tx, err := chain.GenerateTransaction(utxoSet, mempool, from, [][]byte{to.Address(chain.AddressFormat)},
+		[]int{amount}, fee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestMempoolConflicts(t *testing.T) {
+	chain, utxoSet, mempool, alice := testMempool(t, 3)
+	bob, carol := wallet.CreateWallet(), wallet.CreateWallet()
+
+	first := pay(t, chain, utxoSet, nil, alice, bob, 10, 1)
+	if status := mempool.AddTransaction("first", first); status != utils.TXAccepted {
+		t.Fatalf("first transaction: %v", status.String())
+	}
+	if status := mempool.AddTransaction("again", first); status != utils.TXAlreadyKnown {
+		t.Fatalf("same transaction again: %v", status.String())
+	}
+
+	// without looking into mempool, the same TXO is spent again
+	doubleSpend := pay(t, chain, utxoSet, nil, alice, carol, 10, 2)
+	if status := mempool.AddTransaction("double spend", doubleSpend); status != utils.TXConflict {
+		t.Fatalf("double spend: %v", status.String())
+	}
+	input := first.TxInputList[0]
+	if !mempool.IsSpent(input.SourceTxID, input.TxOutputIdx) {
+		t.Fatal("input of pending transaction is not spent")
+	}
+
+	// TXOs spent by mempool are skipped
+	second := pay(t, chain, utxoSet, mempool, alice, carol, 10, 2)
+	if status := mempool.AddTransaction("second", second); status != utils.TXAccepted {
+		t.Fatalf("second transaction: %v", status.String())
+	}
+
+	// a child of a pending transaction is accepted, a tampered one is not
+	child := spendOutput(t, chain, bob, first, 0, carol.Address(chain.AddressFormat), 1)
+	tampered := *child
+	tampered.TxOutputList = []transaction.TxOutput{transaction.NewTxOutput(9, bob.Address(chain.AddressFormat))}
+	tampered.SetID()
+	if status := mempool.AddTransaction("tampered", &tampered); status != utils.TXInvalid {
+		t.Fatalf("tampered child: %v", status.String())
+	}
+	if status := mempool.AddTransaction("child", child); status != utils.TXAccepted {
+		t.Fatalf("child: %v", status.String())
+	}
+
+	// once first is mined, it leaves mempool and its child stays
+	parent, _ := chain.GetBlock(chain.Tip().Hash)
+	addBlocks(t, chain, utxoSet, mineOn(t, chain, parent, alice.Address(chain.AddressFormat),
+		[]*transaction.Transaction{first}, 1))
+	if dropped := mempool.Revalidate(); dropped != 1 {
+		t.Fatalf("%v transactions dropped after block, expect 1", dropped)
+	}
+	if mempool.GetTx("first") != nil || mempool.GetTx("second") == nil || mempool.GetTx("child") == nil {
+		t.Fatal("wrong transactions are left in mempool")
+	}
+}
+
+func TestBlockTemplateFeeRate(t *testing.T) {
+	chain, utxoSet, mempool, alice := testMempool(t, 3)
+	bob, carol := wallet.CreateWallet(), wallet.CreateWallet()
+
+	// low pays little, but its child pays enough for both, the package goes between high and mid
+	low := pay(t, chain, utxoSet, mempool, alice, bob, 10, 1)
+	mempool.AddTransaction("low", low)
+	mid := pay(t, chain, utxoSet, mempool, alice, bob, 10, 3)
+	mempool.AddTransaction("mid", mid)
+	high := pay(t, chain, utxoSet, mempool, alice, bob, 10, 6)
+	mempool.AddTransaction("high", high)
+	child := spendOutput(t, chain, bob, low, 0, carol.Address(chain.AddressFormat), 8)
+	if status := mempool.AddTransaction("child", child); status != utils.TXAccepted {
+		t.Fatalf("child: %v", status.String())
+	}
+
+	// everything fits, parents come before children
+	keys, txList, fees := mempool.BuildBlockTemplate(1 << 20)
+	if len(keys) != 4 || len(txList) != 4 || fees != 18 {
+		t.Fatalf("template of everything: %v, fees %v", keys, fees)
+	}
+	position := make(map[string]int)
+	for idx, key := range keys {
+		position[key] = idx
+	}
+	if position["low"] > position["child"] {
+		t.Fatalf("child comes before its parent: %v", keys)
+	}
+
+	// only room for high and the package of low, mid has the lowest fee rate
+	keys, _, fees = mempool.BuildBlockTemplate(high.Size() + low.Size() + child.Size())
+	if len(keys) != 3 || fees != 15 {
+		t.Fatalf("template without mid: %v, fees %v", keys, fees)
+	}
+	for _, key := range keys {
+		if key == "mid" {
+			t.Fatalf("mid is picked over higher fee rates: %v", keys)
+		}
+	}
+
+	// only room for one transaction, the package of low does not fit
+	keys, _, fees = mempool.BuildBlockTemplate(high.Size())
+	if len(keys) != 1 || keys[0] != "high" || fees != 6 {
+		t.Fatalf("template of one transaction: %v, fees %v", keys, fees)
+	}
+}
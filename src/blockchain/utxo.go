@@ -2,65 +2,141 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/elliptic"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
-	"github.com/AntonyMei/Blockchain/config"
+	"fmt"
 	"github.com/AntonyMei/Blockchain/src/blocks"
 	"github.com/AntonyMei/Blockchain/src/utils"
-	"io/ioutil"
-	"os"
-	"strconv"
+	"github.com/dgraph-io/badger"
 )
 
+// UTXO set is stored in the same badger database as blocks, and is updated in the
+// same badger transaction that moves lasthash, so that they never diverge
+// utxo-[txID][outputIdx]: serialized UTXOEntry
+// utxoaddr-[len(pubKeyHash)][pubKeyHash][txID][outputIdx]: value of that UTXO
+// utxoversion: marks that UTXO set is stored in database
+// all keys are prefixed with Namespace of the UTXO set, which is empty for the live one
+func (utxoSet *UTXOSet) utxoPrefix() []byte {
+	return append([]byte(utxoSet.Namespace), "utxo-"...)
+}
+
+func (utxoSet *UTXOSet) utxoKey(txID []byte, outputIdx int) []byte {
+	return bytes.Join([][]byte{utxoSet.utxoPrefix(), txID, utils.Int2Hex(int64(outputIdx))}, []byte{})
+}
+
+func (utxoSet *UTXOSet) utxoAddrRoot() []byte {
+	return append([]byte(utxoSet.Namespace), "utxoaddr-"...)
+}
+
+func (utxoSet *UTXOSet) utxoAddrPrefix(pubKeyHash []byte) []byte {
+	return bytes.Join([][]byte{utxoSet.utxoAddrRoot(), {byte(len(pubKeyHash))}, pubKeyHash}, []byte{})
+}
+
+func (utxoSet *UTXOSet) utxoAddrKey(pubKeyHash []byte, txID []byte, outputIdx int) []byte {
+	return bytes.Join([][]byte{utxoSet.utxoAddrPrefix(pubKeyHash), txID, utils.Int2Hex(int64(outputIdx))},
+		[]byte{})
+}
+
+func (utxoSet *UTXOSet) utxoVersionKey() []byte {
+	return append([]byte(utxoSet.Namespace), "utxoversion"...)
+}
+
 type UnspentTXO struct {
 	SourceTxID  []byte
 	TxOutputIdx int
 	Value       int
 }
 
+type UTXOEntry struct {
+	// value stored under utxo-[txID][outputIdx]
+	Value      int
+	PubKeyHash []byte
+}
+
+type SpentTXO struct {
+	// a TXO spent by some block, kept so that the block can be undone in a reorg
+	SourceTxID  []byte
+	TxOutputIdx int
+	Value       int
+	PubKeyHash  []byte
+}
+
 type UTXOSet struct {
-	// UTXO Set: address -> (SourceTxID, TxOutputIdx, Value)
-	Addr2UTXO   map[string][]UnspentTXO
-	UTXO2Addr   map[string]string
-	UTXOSetPath string
-}
-
-func InitUTXOSet(userName string) (*UTXOSet, error) {
-	utxoSet := UTXOSet{}
-	utxoSet.Addr2UTXO = make(map[string][]UnspentTXO)
-	utxoSet.UTXO2Addr = make(map[string]string)
-	utxoSet.UTXOSetPath = config.PersistentStoragePath + userName + config.UTXOSetPath
-	err := utxoSet.LoadFile()
-	return &utxoSet, err
-}
-
-func (utxoSet *UTXOSet) AddUTXO(addr []byte, txo UnspentTXO) {
-	// save utxo into addr -> utxo map
-	utxoSet.Addr2UTXO[string(addr)] = append(utxoSet.Addr2UTXO[string(addr)], txo)
-	// save utxo into (TxID | OutputIdx) -> addr map
-	UTXOKey := string(txo.SourceTxID) + strconv.Itoa(txo.TxOutputIdx)
-	utxoSet.UTXO2Addr[UTXOKey] = string(addr)
-}
-
-func (utxoSet *UTXOSet) DeleteUTXO(addr []byte, txo UnspentTXO) {
-	// find the UTXO in addr -> utxo map
-	var targetIdx = -1
-	for idx, utxo := range utxoSet.Addr2UTXO[string(addr)] {
-		if bytes.Compare(utxo.SourceTxID, txo.SourceTxID) == 0 && utxo.TxOutputIdx == txo.TxOutputIdx {
-			targetIdx = idx
-			break
-		}
+	// UTXO Set: (SourceTxID, TxOutputIdx) -> (Value, PubKeyHash), and an
+	// address index on it, where an address is identified by its public key hash
+	Database *badger.DB
+	// Namespace: prefix of all keys, so that a scratch UTXO set can live next to the live one
+	Namespace string
+	// txn: if not nil, all reads and writes go through this badger transaction
+	txn *badger.Txn
+}
+
+func InitUTXOSet(chain *BlockChain) *UTXOSet {
+	// UTXO set lives in chain database, it is built from chain if it does not exist yet
+	utxoSet := UTXOSet{Database: chain.Database}
+	if _, found := chain.readValue(utxoSet.utxoVersionKey()); !found {
+		fmt.Println("Building UTXO set from blockchain...")
+		report := chain.Reindex(&utxoSet)
+		report.Log2Terminal()
+	}
+	return &utxoSet
+}
+
+func (utxoSet *UTXOSet) WithTxn(txn *badger.Txn) *UTXOSet {
+	// get a view of UTXO set that reads and writes in txn
+	return &UTXOSet{Database: utxoSet.Database, Namespace: utxoSet.Namespace, txn: txn}
+}
+
+func (utxoSet *UTXOSet) view(f func(txn *badger.Txn) error) {
+	if utxoSet.txn != nil {
+		utils.Handle(f(utxoSet.txn))
+		return
 	}
+	utils.Handle(utxoSet.Database.View(f))
+}
 
-	// delete that UTXO from addr -> utxo map
-	var length = len(utxoSet.Addr2UTXO[string(addr)])
-	utxoSet.Addr2UTXO[string(addr)][targetIdx] = utxoSet.Addr2UTXO[string(addr)][length-1]
-	utxoSet.Addr2UTXO[string(addr)] = utxoSet.Addr2UTXO[string(addr)][:length-1]
+func (utxoSet *UTXOSet) update(f func(txn *badger.Txn) error) {
+	if utxoSet.txn != nil {
+		utils.Handle(f(utxoSet.txn))
+		return
+	}
+	utils.Handle(utxoSet.Database.Update(f))
+}
+
+func (utxoSet *UTXOSet) Drop() {
+	// remove every UTXO in this set
+	utils.Assert(utxoSet.txn == nil, "UTXO set can not be dropped inside a transaction.")
+	err := utxoSet.Database.DropPrefix(utxoSet.utxoPrefix(), utxoSet.utxoAddrRoot(), utxoSet.utxoVersionKey())
+	utils.Handle(err)
+}
+
+func (utxoSet *UTXOSet) MarkComplete() {
+	// mark that UTXO set matches the tip of best chain
+	utxoSet.update(func(txn *badger.Txn) error {
+		return txn.Set(utxoSet.utxoVersionKey(), []byte{1})
+	})
+}
+
+func (utxoSet *UTXOSet) AddUTXO(pubKeyHash []byte, txo UnspentTXO) {
+	// save utxo and put it into address index
+	var entry bytes.Buffer
+	var encoder = gob.NewEncoder(&entry)
+	utils.Handle(encoder.Encode(UTXOEntry{Value: txo.Value, PubKeyHash: pubKeyHash}))
+	utxoSet.update(func(txn *badger.Txn) error {
+		err := txn.Set(utxoSet.utxoKey(txo.SourceTxID, txo.TxOutputIdx), entry.Bytes())
+		utils.Handle(err)
+		return txn.Set(utxoSet.utxoAddrKey(pubKeyHash, txo.SourceTxID, txo.TxOutputIdx), utils.Int2Hex(int64(txo.Value)))
+	})
+}
 
-	// delete that UTXO from (TxID | OutputIdx) -> addr map
-	UTXOKey := string(txo.SourceTxID) + strconv.Itoa(txo.TxOutputIdx)
-	delete(utxoSet.UTXO2Addr, UTXOKey)
+func (utxoSet *UTXOSet) DeleteUTXO(pubKeyHash []byte, txo UnspentTXO) {
+	// remove utxo and its entry in address index
+	utxoSet.update(func(txn *badger.Txn) error {
+		err := txn.Delete(utxoSet.utxoKey(txo.SourceTxID, txo.TxOutputIdx))
+		utils.Handle(err)
+		return txn.Delete(utxoSet.utxoAddrKey(pubKeyHash, txo.SourceTxID, txo.TxOutputIdx))
+	})
 }
 
 func (utxoSet *UTXOSet) DumpBlock(block *blocks.Block) {
@@ -69,9 +145,9 @@ func (utxoSet *UTXOSet) DumpBlock(block *blocks.Block) {
 		// remove input
 		if !tx.IsCoinbase() {
 			for _, input := range tx.TxInputList {
-				UTXOKey := string(input.SourceTxID) + strconv.Itoa(input.TxOutputIdx)
-				addr := utxoSet.UTXO2Addr[UTXOKey]
-				utxoSet.DeleteUTXO([]byte(addr), UnspentTXO{
+				_, pubKeyHash, exists := utxoSet.FindUTXO(input.SourceTxID, input.TxOutputIdx)
+				utils.Assert(exists, "Spent TXO not found in UTXO set.")
+				utxoSet.DeleteUTXO(pubKeyHash, UnspentTXO{
 					SourceTxID:  input.SourceTxID,
 					TxOutputIdx: input.TxOutputIdx,
 					Value:       -1,
@@ -80,7 +156,7 @@ func (utxoSet *UTXOSet) DumpBlock(block *blocks.Block) {
 		}
 		// dump output
 		for idx, txo := range tx.TxOutputList {
-			utxoSet.AddUTXO(txo.Address, UnspentTXO{
+			utxoSet.AddUTXO(txo.PubKeyHash, UnspentTXO{
 				SourceTxID:  tx.TxID,
 				TxOutputIdx: idx,
 				Value:       txo.Value,
@@ -89,8 +165,107 @@ func (utxoSet *UTXOSet) DumpBlock(block *blocks.Block) {
 	}
 }
 
-func (utxoSet *UTXOSet) GenerateSpendingPlan(addr []byte, value int) (int, map[string][]int) {
-	var total, unspentList = utxoSet._GenerateSpendingPlan(addr, value)
+func (utxoSet *UTXOSet) GenerateUndoData(block *blocks.Block) []SpentTXO {
+	// collect all TXOs the block spends, must be called before DumpBlock
+	// TXOs created and spent in the same block never enter UTXO set, so they are skipped
+	var spentList []SpentTXO
+	blockTXs := make(map[string]bool)
+	for _, tx := range block.TransactionList {
+		blockTXs[string(tx.TxID)] = true
+	}
+	for _, tx := range block.TransactionList {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, input := range tx.TxInputList {
+			if blockTXs[string(input.SourceTxID)] {
+				continue
+			}
+			utxo, pubKeyHash, exists := utxoSet.FindUTXO(input.SourceTxID, input.TxOutputIdx)
+			utils.Assert(exists, "Spent TXO not found in UTXO set.")
+			spentList = append(spentList, SpentTXO{SourceTxID: utxo.SourceTxID, TxOutputIdx: utxo.TxOutputIdx,
+				Value: utxo.Value, PubKeyHash: pubKeyHash})
+		}
+	}
+	return spentList
+}
+
+func (utxoSet *UTXOSet) UndoBlock(block *blocks.Block, spentList []SpentTXO) {
+	// revert DumpBlock: remove every output of the block and restore TXOs it spends
+	for txIdx := len(block.TransactionList) - 1; txIdx >= 0; txIdx-- {
+		tx := block.TransactionList[txIdx]
+		for idx, txo := range tx.TxOutputList {
+			utxoSet.DeleteUTXO(txo.PubKeyHash, UnspentTXO{SourceTxID: tx.TxID, TxOutputIdx: idx, Value: -1})
+		}
+	}
+	for _, spent := range spentList {
+		utxoSet.AddUTXO(spent.PubKeyHash, UnspentTXO{SourceTxID: spent.SourceTxID,
+			TxOutputIdx: spent.TxOutputIdx, Value: spent.Value})
+	}
+}
+
+func (utxoSet *UTXOSet) FindUTXO(sourceTxID []byte, txOutputIdx int) (UnspentTXO, []byte, bool) {
+	// find an unspent output and the public key hash it is locked with
+	var entry *UTXOEntry
+	utxoSet.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoSet.utxoKey(sourceTxID, txOutputIdx))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		utils.Handle(err)
+		return item.Value(func(val []byte) error {
+			entry = &UTXOEntry{}
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(entry)
+		})
+	})
+	if entry == nil {
+		return UnspentTXO{}, nil, false
+	}
+	utxo := UnspentTXO{SourceTxID: sourceTxID, TxOutputIdx: txOutputIdx, Value: entry.Value}
+	return utxo, entry.PubKeyHash, true
+}
+
+func (utxoSet *UTXOSet) HasUnspentOutputs(txID []byte) bool {
+	// whether some output of transaction txID is unspent
+	found := false
+	prefix := append(utxoSet.utxoPrefix(), txID...)
+	utxoSet.view(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+		iterator.Seek(prefix)
+		found = iterator.ValidForPrefix(prefix)
+		return nil
+	})
+	return found
+}
+
+func (utxoSet *UTXOSet) FindUTXOsByPubKeyHash(pubKeyHash []byte) []UnspentTXO {
+	// get all unspent outputs locked with pubKeyHash
+	var utxoList []UnspentTXO
+	prefix := utxoSet.utxoAddrPrefix(pubKeyHash)
+	utxoSet.view(func(txn *badger.Txn) error {
+		iterator := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iterator.Close()
+		for iterator.Seek(prefix); iterator.ValidForPrefix(prefix); iterator.Next() {
+			item := iterator.Item()
+			rest := item.KeyCopy(nil)[len(prefix):]
+			value, err := item.ValueCopy(nil)
+			utils.Handle(err)
+			utxoList = append(utxoList, UnspentTXO{
+				SourceTxID:  rest[:len(rest)-8],
+				TxOutputIdx: int(binary.BigEndian.Uint64(rest[len(rest)-8:])),
+				Value:       int(binary.BigEndian.Uint64(value)),
+			})
+		}
+		return nil
+	})
+	return utxoList
+}
+
+func (utxoSet *UTXOSet) GenerateSpendingPlan(pubKeyHash []byte, value int) (int, map[string][]int) {
+	var total, unspentList = utxoSet._GenerateSpendingPlan(pubKeyHash, value)
 	if total != value {
 		return total, make(map[string][]int)
 	} else {
@@ -103,12 +278,12 @@ func (utxoSet *UTXOSet) GenerateSpendingPlan(addr []byte, value int) (int, map[s
 	}
 }
 
-func (utxoSet *UTXOSet) _GenerateSpendingPlan(addr []byte, value int) (int, []UnspentTXO) {
+func (utxoSet *UTXOSet) _GenerateSpendingPlan(pubKeyHash []byte, value int) (int, []UnspentTXO) {
 	// Generate a spending plan from this UTXOSet
 	// if successful: return (total, plan), o.w. return (-1, [])
 	var total = 0
 	var plan []UnspentTXO
-	for _, utxo := range utxoSet.Addr2UTXO[string(addr)] {
+	for _, utxo := range utxoSet.FindUTXOsByPubKeyHash(pubKeyHash) {
 		total += utxo.Value
 		plan = append(plan, utxo)
 		if total >= value {
@@ -122,35 +297,75 @@ func (utxoSet *UTXOSet) _GenerateSpendingPlan(addr []byte, value int) (int, []Un
 	}
 }
 
-func (utxoSet *UTXOSet) SaveFile() {
-	// encode the wallets
-	var content bytes.Buffer
-	gob.Register(elliptic.P256())
-	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(utxoSet)
-	utils.Handle(err)
-	// save to file
-	err = ioutil.WriteFile(utxoSet.UTXOSetPath, content.Bytes(), 0644)
-	utils.Handle(err)
+func (utxoSet *UTXOSet) GetBalance(pubKeyHash []byte) int {
+	// sum of all unspent outputs locked with pubKeyHash
+	balance := 0
+	for _, utxo := range utxoSet.FindUTXOsByPubKeyHash(pubKeyHash) {
+		balance += utxo.Value
+	}
+	return balance
 }
 
-func (utxoSet *UTXOSet) LoadFile() error {
-	// check whether wallet file exists
-	if _, err := os.Stat(utxoSet.UTXOSetPath); os.IsNotExist(err) {
-		return err
-	}
+func (utxoSet *UTXOSet) CountMismatches(other *UTXOSet) int {
+	// count UTXOs that are missing from either set or differ between them, and the same
+	// for entries of address index, each mismatch is counted once
+	return countPrefixMismatches(utxoSet, utxoSet.utxoPrefix(), other, other.utxoPrefix()) +
+		countPrefixMismatches(utxoSet, utxoSet.utxoAddrRoot(), other, other.utxoAddrRoot())
+}
 
-	// read the file
-	fileContent, err := ioutil.ReadFile(utxoSet.UTXOSetPath)
-	utils.Handle(err)
+func countPrefixMismatches(utxoSet *UTXOSet, prefix []byte, other *UTXOSet, otherPrefix []byte) int {
+	// entries under prefix in utxoSet are compared with those under otherPrefix in other
+	// by the rest of their keys
+	differing := 0
+	utxoSet.view(func(txn *badger.Txn) error {
+		iterator := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iterator.Close()
+		for iterator.Seek(prefix); iterator.ValidForPrefix(prefix); iterator.Next() {
+			item := iterator.Item()
+			otherKey := append(append([]byte{}, otherPrefix...), item.KeyCopy(nil)[len(prefix):]...)
+			value, err := item.ValueCopy(nil)
+			utils.Handle(err)
+			other.view(func(otherTxn *badger.Txn) error {
+				otherItem, err := otherTxn.Get(otherKey)
+				if err == badger.ErrKeyNotFound {
+					// missing ones are counted below
+					return nil
+				}
+				utils.Handle(err)
+				otherValue, err := otherItem.ValueCopy(nil)
+				utils.Handle(err)
+				if bytes.Compare(value, otherValue) != 0 {
+					differing++
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return differing + countMissing(utxoSet, prefix, other, otherPrefix) + countMissing(other, otherPrefix, utxoSet, prefix)
+}
 
-	// encode it back into a wallet
-	var tmpUTXOSet UTXOSet
-	gob.Register(elliptic.P256())
-	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&tmpUTXOSet)
-	utils.Handle(err)
-	utxoSet.Addr2UTXO = tmpUTXOSet.Addr2UTXO
-	utxoSet.UTXO2Addr = tmpUTXOSet.UTXO2Addr
-	return nil
+func countMissing(utxoSet *UTXOSet, prefix []byte, other *UTXOSet, otherPrefix []byte) int {
+	// number of entries under prefix in utxoSet that have no counterpart in other
+	missing := 0
+	utxoSet.view(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.PrefetchValues = false
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+		for iterator.Seek(prefix); iterator.ValidForPrefix(prefix); iterator.Next() {
+			otherKey := append(append([]byte{}, otherPrefix...), iterator.Item().KeyCopy(nil)[len(prefix):]...)
+			other.view(func(otherTxn *badger.Txn) error {
+				_, err := otherTxn.Get(otherKey)
+				if err == badger.ErrKeyNotFound {
+					missing++
+					return nil
+				}
+				utils.Handle(err)
+				return nil
+			})
+		}
+		return nil
+	})
+	return missing
 }
@@ -0,0 +1,162 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/dgraph-io/badger"
+)
+
+// scratch UTXO set used by VerifyChain, it is dropped when verification finishes
+const verifyNamespace = "verify-"
+
+var errReplayStopped = errors.New("replay stopped")
+
+type ChainReport struct {
+	// BlockCount: number of blocks on best chain that passed validation
+	// Status: Verified, or status of the first bad block (BadHeight, BadHash)
+	// UTXOMismatch / IndexMismatch: stored data that differs from replayed chain, UTXOMismatch
+	// covers address index of UTXO set as well, only filled by VerifyChain
+	BlockCount    int
+	Status        utils.BlockStatus
+	BadHeight     int
+	BadHash       []byte
+	UTXOMismatch  int
+	IndexMismatch int
+}
+
+func (report *ChainReport) Log2Terminal() {
+	fmt.Printf("[Chain Report] %v block(s) verified.\n", report.BlockCount)
+	if report.Status != utils.Verified {
+		fmt.Printf("First bad block: height %v, hash %x, status %v.\n", report.BadHeight, report.BadHash,
+			report.Status.String())
+	}
+	if report.UTXOMismatch > 0 || report.IndexMismatch > 0 {
+		fmt.Printf("Stored data out of sync: %v UTXO(s), %v index entries.\n", report.UTXOMismatch,
+			report.IndexMismatch)
+	}
+}
+
+func (report *ChainReport) IsConsistent() bool {
+	return report.Status == utils.Verified && report.UTXOMismatch == 0 && report.IndexMismatch == 0
+}
+
+func (bc *BlockChain) bestChainHashes() ([][]byte, *ChainReport) {
+	// follow PrevHash from lasthash back to genesis, returns hashes from genesis to tip
+	// if the walk breaks, a report of the broken block is returned instead
+	var hashList [][]byte
+	lastHash, found := bc.readValue([]byte("lasthash"))
+	utils.Assert(found, "Last hash not found.")
+	for cursor := lastHash; len(cursor) > 0; {
+		block, found := bc.GetBlock(cursor)
+		if !found {
+			return nil, &ChainReport{Status: utils.PrevBlockNotFound, BadHeight: -1, BadHash: cursor}
+		}
+		if bytes.Compare(block.Hash, cursor) != 0 {
+			return nil, &ChainReport{Status: utils.HashMismatch, BadHeight: block.Height, BadHash: cursor}
+		}
+		hashList = append([][]byte{cursor}, hashList...)
+		cursor = block.PrevHash
+	}
+	return hashList, nil
+}
+
+func (bc *BlockChain) replay(hashList [][]byte, utxoSet *UTXOSet,
+	connect func(txn *badger.Txn, block *blocks.Block, undoData []SpentTXO)) ChainReport {
+	// validate blocks in hashList one by one on top of utxoSet, which must be empty
+	// connect is called in the badger txn that dumps a valid block into utxoSet
+	report := ChainReport{Status: utils.Verified}
+	for height, hash := range hashList {
+		block, _ := bc.GetBlock(hash)
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			utxoView := utxoSet.WithTxn(txn)
+			status := bc.ValidateBlock(block, utxoView)
+			if status != utils.Verified {
+				report.Status = status
+				return errReplayStopped
+			}
+			undoData := utxoView.GenerateUndoData(block)
+			utxoView.DumpBlock(block)
+			connect(txn, block, undoData)
+			return nil
+		})
+		if err == errReplayStopped {
+			report.BadHeight = height
+			report.BadHash = hash
+			return report
+		}
+		utils.Handle(err)
+		report.BlockCount++
+	}
+	return report
+}
+
+func (bc *BlockChain) VerifyChain(utxoSet *UTXOSet) ChainReport {
+	// replay best chain from genesis on a scratch UTXO set, and check that stored
+	// UTXO set and indexes match the replayed chain, nothing stored is modified
+	hashList, brokenReport := bc.bestChainHashes()
+	if brokenReport != nil {
+		return *brokenReport
+	}
+	scratch := &UTXOSet{Database: bc.Database, Namespace: verifyNamespace}
+	scratch.Drop()
+	defer scratch.Drop()
+	indexMismatch := 0
+	report := bc.replay(hashList, scratch, func(txn *badger.Txn, block *blocks.Block, _ []SpentTXO) {
+		if hash, found := bc.GetBlockHashByHeight(block.Height); !found || bytes.Compare(hash, block.Hash) != 0 {
+			indexMismatch++
+		}
+		for _, tx := range block.TransactionList {
+			if _, found := bc.readValue(txKey(tx.TxID)); !found {
+				indexMismatch++
+			}
+		}
+	})
+	report.IndexMismatch = indexMismatch
+	if report.Status == utils.Verified {
+		report.UTXOMismatch = scratch.CountMismatches(utxoSet)
+	}
+	return report
+}
+
+func (bc *BlockChain) Reindex(utxoSet *UTXOSet) ChainReport {
+	// rebuild UTXO set, undo data and indexes by replaying best chain from genesis
+	// if a bad block is found, best chain is cut back to its parent
+	hashList, brokenReport := bc.bestChainHashes()
+	if brokenReport != nil {
+		return *brokenReport
+	}
+	// genesis can not be replaced, a chain with bad genesis is kept as it is, checking genesis
+	// does not need a UTXO set
+	genesis, _ := bc.GetBlock(hashList[0])
+	if status := bc.ValidateBlock(genesis, utxoSet); status != utils.Verified {
+		return ChainReport{Status: status, BadHeight: 0, BadHash: genesis.Hash}
+	}
+	utxoSet.Drop()
+	for _, prefix := range []string{"height-", "tx-", "addr-"} {
+		err := bc.Database.DropPrefix([]byte(prefix))
+		utils.Handle(err)
+	}
+	report := bc.replay(hashList, utxoSet, func(txn *badger.Txn, block *blocks.Block, undoData []SpentTXO) {
+		err := txn.Set(undoKey(block.Hash), serializeUndoData(undoData))
+		utils.Handle(err)
+		indexBlock(txn, block)
+	})
+	if report.Status != utils.Verified {
+		for _, hash := range hashList[report.BadHeight:] {
+			bc.MarkInvalid(hash)
+		}
+		newTip := hashList[report.BadHeight-1]
+		err := bc.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("lasthash"), newTip)
+		})
+		utils.Handle(err)
+	}
+	tip, found := bc.GetBlock(hashList[report.BlockCount-1])
+	utils.Assert(found, "Last block not found.")
+	bc.setTip(tip)
+	utxoSet.MarkComplete()
+	return report
+}
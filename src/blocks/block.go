@@ -2,13 +2,16 @@ package blocks
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/transaction"
 	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/AntonyMei/Blockchain/src/wallet"
 	"strconv"
+	"time"
 )
 
 type Block struct {
@@ -18,33 +21,67 @@ type Block struct {
 	Data            []byte
 	TransactionList []*transaction.Transaction
 	Height          int
+	// Timestamp: time (in milliseconds) when mining of this block started
+	Timestamp int64
 	// proof of work
 	Nonce      int
 	Difficulty int
 }
 
-func CreateBlock(_data string, txList []*transaction.Transaction, _prevHash []byte,
-	_difficulty int, prevHeight int, isGenesis bool) *Block {
-	// create block with given data and difficulty
+func CreateBlock(ctx context.Context, _data string, txList []*transaction.Transaction, _prevHash []byte,
+	_difficulty int, prevHeight int, timestamp int64) (*Block, utils.MiningStatus) {
+	// create block with given data and difficulty, timestamp is chain time in milliseconds
 	newBlock := &Block{PrevHash: _prevHash, Hash: []byte{}, Data: []byte(_data),
-		TransactionList: txList, Nonce: 0, Difficulty: _difficulty, Height: prevHeight + 1}
-	pow := CreateProofOfWork(newBlock)
-	nonce, hash := pow.GenerateNonceHash(isGenesis)
-	newBlock.Nonce = nonce
-	newBlock.Hash = hash[:]
-	return newBlock
+		TransactionList: txList, Nonce: 0, Difficulty: _difficulty, Height: prevHeight + 1,
+		Timestamp: timestamp}
+	return newBlock, newBlock.mine(ctx, false)
 }
 
-func Genesis(_difficulty int) *Block {
-	// Genesis block is a fixed thing
+func (b *Block) mine(ctx context.Context, singleThreadMode bool) utils.MiningStatus {
+	// search nonce of block in place
+	pow := CreateProofOfWork(b)
+	nonce, hash, status := pow.GenerateNonceHash(ctx, singleThreadMode)
+	if status != utils.MiningSucceeded {
+		return status
+	}
+	b.Nonce = nonce
+	b.Hash = hash[:]
+	return status
+}
+
+func GenesisTemplate(params *config.ChainParams, addressFormat config.WalletParams) (*Block, error) {
+	// genesis block derived from chain spec, without nonce and hash
+	// its coinbase pays premine, or block reward to genesis data if there is no premine
+	// premine addresses must have the address format of the network
 	input := transaction.TxInput{SourceTxID: []byte{}, TxOutputIdx: -1, Sig: config.CoinbaseSig}
-	output := transaction.TxOutput{Value: config.MiningReward, Address: []byte(config.GenesisData)}
-	token := make([]byte, 32)
-	tx := transaction.Transaction{TxID: token, TxInputList: []transaction.TxInput{input},
-		TxOutputList: []transaction.TxOutput{output}}
+	outputs := []transaction.TxOutput{{Value: params.Reward(0), PubKeyHash: []byte(params.GenesisData)}}
+	if len(params.Premine) > 0 {
+		outputs = []transaction.TxOutput{}
+		for _, allocation := range params.Premine {
+			address, err := hex.DecodeString(allocation.Address)
+			if err != nil || !wallet.ValidateAddress(address, addressFormat) {
+				return nil, fmt.Errorf("premine address %s is not valid", allocation.Address)
+			}
+			outputs = append(outputs, transaction.NewTxOutput(allocation.Amount, address))
+		}
+	}
+	tx := transaction.Transaction{Token: make([]byte, 32), TxInputList: []transaction.TxInput{input},
+		TxOutputList: outputs}
 	tx.SetID()
-	return CreateBlock(config.GenesisData, []*transaction.Transaction{&tx}, []byte{}, _difficulty,
-		-1, true)
+	return &Block{PrevHash: []byte{}, Hash: []byte{}, Data: []byte(params.GenesisData),
+		TransactionList: []*transaction.Transaction{&tx}, Nonce: 0, Difficulty: params.InitialDifficulty,
+		Height: 0, Timestamp: params.GenesisTimestamp}, nil
+}
+
+func Genesis(params *config.ChainParams, addressFormat config.WalletParams) (*Block, error) {
+	// Genesis block is a fixed thing for given chain spec, single thread mining finds the same nonce everywhere
+	genesis, err := GenesisTemplate(params, addressFormat)
+	if err != nil {
+		return nil, err
+	}
+	status := genesis.mine(context.Background(), true)
+	utils.Assert(status == utils.MiningSucceeded, "Failed to mine genesis block.")
+	return genesis, nil
 }
 
 func (b *Block) Serialize() []byte {
@@ -63,16 +100,9 @@ func Deserialize(stream []byte) *Block {
 	return &block
 }
 
-func (b *Block) GetTransactionsHash() []byte {
-	// gather hash value of all transactions, which is their ID
-	var txHashList [][]byte
-	for _, tx := range b.TransactionList {
-		txHashList = append(txHashList, tx.TxID)
-	}
-
-	// hash the list to one final hash
-	finalHash := sha256.Sum256(bytes.Join(txHashList, []byte{}))
-	return finalHash[:]
+func (b *Block) GetMerkleRoot() []byte {
+	// merkle root commits to all transactions, and allows inclusion proof of a single one
+	return b.GetMerkleTree().Root()
 }
 
 func (b *Block) Log2Terminal() {
@@ -83,6 +113,8 @@ func (b *Block) Log2Terminal() {
 	fmt.Printf("Nonce: %v\n", b.Nonce)
 	fmt.Printf("Difficulty: %v\n", b.Difficulty)
 	fmt.Printf("Block Height: %d\n", b.Height)
+	fmt.Printf("Timestamp: %v\n", time.UnixMilli(b.Timestamp).Format(time.RFC3339))
+	fmt.Printf("Merkle Root: %x\n", b.GetMerkleRoot())
 	pow := CreateProofOfWork(b)
 	fmt.Printf("Hash Validated: %s\n", strconv.FormatBool(pow.ValidateNonce()))
 	for _, tx := range b.TransactionList {
@@ -0,0 +1,51 @@
+package blocks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+)
+
+type BlockHeader struct {
+	// everything of a block except its transactions, MerkleRoot commits to them
+	// headers are enough to check proof of work, so that they can be synchronized first
+	PrevHash   []byte
+	Hash       []byte
+	Data       []byte
+	MerkleRoot []byte
+	Height     int
+	Timestamp  int64
+	Nonce      int
+	Difficulty int
+}
+
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{PrevHash: b.PrevHash, Hash: b.Hash, Data: b.Data, MerkleRoot: b.GetMerkleRoot(),
+		Height: b.Height, Timestamp: b.Timestamp, Nonce: b.Nonce, Difficulty: b.Difficulty}
+}
+
+func (h *BlockHeader) ValidateProofOfWork(minDifficulty int) bool {
+	// same check as ProofOfWorkWrapper.ValidateNonce, difficulty is checked first since
+	// target is 2^(256-difficulty)
+	if h.Difficulty < minDifficulty || h.Difficulty > 256 {
+		return false
+	}
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-h.Difficulty))
+	var intHash big.Int
+	hash := sha256.Sum256(prepareProofOfWorkData(h.PrevHash, h.Data, h.MerkleRoot, h.Timestamp, h.Nonce,
+		h.Difficulty))
+	intHash.SetBytes(hash[:])
+	return intHash.Cmp(target) == -1 && bytes.Compare(hash[:], h.Hash) == 0
+}
+
+func (h *BlockHeader) Work() *big.Int {
+	return difficultyWork(h.Difficulty)
+}
+
+func (h *BlockHeader) Matches(b *Block) bool {
+	// check that block is the one described by header, transactions are covered by MerkleRoot
+	return bytes.Compare(h.Hash, b.Hash) == 0 && bytes.Compare(h.PrevHash, b.PrevHash) == 0 &&
+		bytes.Compare(h.Data, b.Data) == 0 && bytes.Compare(h.MerkleRoot, b.GetMerkleRoot()) == 0 &&
+		h.Height == b.Height && h.Timestamp == b.Timestamp && h.Nonce == b.Nonce && h.Difficulty == b.Difficulty
+}
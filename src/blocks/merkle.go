@@ -0,0 +1,170 @@
+package blocks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/src/utils"
+)
+
+// leaf and internal nodes are hashed with different prefixes, so that an
+// internal node can never be passed off as a leaf (second preimage attack)
+const (
+	merkleLeafPrefix = byte(0x00)
+	merkleNodePrefix = byte(0x01)
+)
+
+type MerkleTree struct {
+	// Levels[0] holds the leaf hashes, the last level holds only the root
+	Levels [][][]byte
+}
+
+type MerkleProofStep struct {
+	// Hash: hash of the sibling node on this level
+	// IsLeft: whether the sibling is on the left side of the path
+	Hash   []byte
+	IsLeft bool
+}
+
+type MerkleProof struct {
+	// TxID: the transaction this proof is generated for
+	// Root: merkle root of the block that contains the transaction
+	// Steps: siblings from leaf level up to (not including) the root
+	TxID  []byte
+	Root  []byte
+	Steps []MerkleProofStep
+}
+
+func hashMerkleLeaf(data []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{{merkleLeafPrefix}, data}, []byte{}))
+	return hash[:]
+}
+
+func hashMerkleNode(left []byte, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{{merkleNodePrefix}, left, right}, []byte{}))
+	return hash[:]
+}
+
+func CreateMerkleTree(dataList [][]byte) *MerkleTree {
+	// an empty tree has a single level that contains hash of nothing
+	tree := MerkleTree{}
+	if len(dataList) == 0 {
+		emptyHash := sha256.Sum256([]byte{})
+		tree.Levels = [][][]byte{{emptyHash[:]}}
+		return &tree
+	}
+
+	// hash leaves
+	var level [][]byte
+	for _, data := range dataList {
+		level = append(level, hashMerkleLeaf(data))
+	}
+	tree.Levels = append(tree.Levels, level)
+
+	// build the tree bottom up, the last node is paired with itself if a level has odd length
+	for len(level) > 1 {
+		var nextLevel [][]byte
+		for idx := 0; idx < len(level); idx += 2 {
+			right := level[idx]
+			if idx+1 < len(level) {
+				right = level[idx+1]
+			}
+			nextLevel = append(nextLevel, hashMerkleNode(level[idx], right))
+		}
+		tree.Levels = append(tree.Levels, nextLevel)
+		level = nextLevel
+	}
+	return &tree
+}
+
+func (tree *MerkleTree) Root() []byte {
+	return tree.Levels[len(tree.Levels)-1][0]
+}
+
+func (tree *MerkleTree) GenerateProof(leafIdx int) []MerkleProofStep {
+	// collect sibling of the node on the path from leaf to root at each level
+	var steps []MerkleProofStep
+	idx := leafIdx
+	for _, level := range tree.Levels[:len(tree.Levels)-1] {
+		if idx%2 == 0 {
+			siblingIdx := idx + 1
+			if siblingIdx >= len(level) {
+				siblingIdx = idx
+			}
+			steps = append(steps, MerkleProofStep{Hash: level[siblingIdx], IsLeft: false})
+		} else {
+			steps = append(steps, MerkleProofStep{Hash: level[idx-1], IsLeft: true})
+		}
+		idx /= 2
+	}
+	return steps
+}
+
+func (b *Block) GetMerkleTree() *MerkleTree {
+	// leaves of the tree are TxIDs in block order
+	var txHashList [][]byte
+	for _, tx := range b.TransactionList {
+		txHashList = append(txHashList, tx.TxID)
+	}
+	return CreateMerkleTree(txHashList)
+}
+
+func (b *Block) GenerateMerkleProof(txID []byte) (*MerkleProof, bool) {
+	// generate inclusion proof for given TxID, returns false if tx is not in this block
+	for idx, tx := range b.TransactionList {
+		if bytes.Compare(tx.TxID, txID) == 0 {
+			tree := b.GetMerkleTree()
+			proof := MerkleProof{TxID: txID, Root: tree.Root(), Steps: tree.GenerateProof(idx)}
+			return &proof, true
+		}
+	}
+	return nil, false
+}
+
+func (proof *MerkleProof) Verify(root []byte) bool {
+	// recompute root from TxID and siblings, then compare with the given root
+	if bytes.Compare(proof.Root, root) != 0 {
+		return false
+	}
+	hash := hashMerkleLeaf(proof.TxID)
+	for _, step := range proof.Steps {
+		if step.IsLeft {
+			hash = hashMerkleNode(step.Hash, hash)
+		} else {
+			hash = hashMerkleNode(hash, step.Hash)
+		}
+	}
+	return bytes.Compare(hash, root) == 0
+}
+
+func (proof *MerkleProof) Serialize() []byte {
+	// serialize a proof into byte stream, so that it can be handed to others
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(proof))
+	return result.Bytes()
+}
+
+func DeserializeMerkleProof(stream []byte) (*MerkleProof, error) {
+	// proofs usually come from others, so errors are returned instead of panicking
+	var proof MerkleProof
+	var decoder = gob.NewDecoder(bytes.NewReader(stream))
+	err := decoder.Decode(&proof)
+	if err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+func (proof *MerkleProof) Log2Terminal() {
+	fmt.Printf("[Merkle Proof] TxID %x\n", proof.TxID)
+	fmt.Printf("Merkle Root: %x\n", proof.Root)
+	for idx, step := range proof.Steps {
+		side := "right"
+		if step.IsLeft {
+			side = "left"
+		}
+		fmt.Printf("Level %v: %x (%s)\n", idx, step.Hash, side)
+	}
+}
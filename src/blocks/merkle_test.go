@@ -0,0 +1,87 @@
+package blocks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testLeaves(count int) [][]byte {
+	var leaves [][]byte
+	for idx := 0; idx < count; idx++ {
+		leaves = append(leaves, []byte{byte(idx), 0xab})
+	}
+	return leaves
+}
+
+func TestMerkleProofEveryLeaf(t *testing.T) {
+	// odd levels pair their last node with itself, proofs of all leaves must still verify
+	for count := 1; count <= 9; count++ {
+		leaves := testLeaves(count)
+		tree := CreateMerkleTree(leaves)
+		for idx, leaf := range leaves {
+			proof := MerkleProof{TxID: leaf, Root: tree.Root(), Steps: tree.GenerateProof(idx)}
+			if !proof.Verify(tree.Root()) {
+				t.Fatalf("%v leaves: proof of leaf %v does not verify", count, idx)
+			}
+			// the proof only holds for its own leaf
+			other := MerkleProof{TxID: leaves[(idx+1)%count], Root: tree.Root(), Steps: proof.Steps}
+			if count > 1 && other.Verify(tree.Root()) {
+				t.Fatalf("%v leaves: proof of leaf %v verifies another leaf", count, idx)
+			}
+		}
+	}
+}
+
+func TestMerkleProofOddLevels(t *testing.T) {
+	// with 3 leaves, the last one is its own sibling on leaf level
+	leaves := testLeaves(3)
+	tree := CreateMerkleTree(leaves)
+	steps := tree.GenerateProof(2)
+	if len(steps) != 2 || steps[0].IsLeft || !bytes.Equal(steps[0].Hash, hashMerkleLeaf(leaves[2])) {
+		t.Fatalf("unexpected proof of last leaf: %+v", steps)
+	}
+	expected := hashMerkleNode(hashMerkleNode(hashMerkleLeaf(leaves[0]), hashMerkleLeaf(leaves[1])),
+		hashMerkleNode(hashMerkleLeaf(leaves[2]), hashMerkleLeaf(leaves[2])))
+	if !bytes.Equal(tree.Root(), expected) {
+		t.Fatalf("root is %x, expect %x", tree.Root(), expected)
+	}
+}
+
+func TestMerkleProofRejectsTampering(t *testing.T) {
+	leaves := testLeaves(5)
+	tree := CreateMerkleTree(leaves)
+	proof := MerkleProof{TxID: leaves[3], Root: tree.Root(), Steps: tree.GenerateProof(3)}
+
+	// another root
+	if proof.Verify(CreateMerkleTree(testLeaves(4)).Root()) {
+		t.Fatal("proof verifies against another root")
+	}
+	// flipped side of a sibling
+	proof.Steps[0].IsLeft = !proof.Steps[0].IsLeft
+	if proof.Verify(tree.Root()) {
+		t.Fatal("proof with a flipped sibling verifies")
+	}
+	proof.Steps[0].IsLeft = !proof.Steps[0].IsLeft
+	// an internal node passed off as a leaf
+	internal := MerkleProof{TxID: append(append([]byte{}, tree.Levels[0][2]...), tree.Levels[0][3]...),
+		Root: tree.Root(), Steps: tree.GenerateProof(3)[1:]}
+	if internal.Verify(tree.Root()) {
+		t.Fatal("internal node verifies as a leaf")
+	}
+}
+
+func TestMerkleProofSerializeRoundTrip(t *testing.T) {
+	leaves := testLeaves(6)
+	tree := CreateMerkleTree(leaves)
+	proof := MerkleProof{TxID: leaves[5], Root: tree.Root(), Steps: tree.GenerateProof(5)}
+	loaded, err := DeserializeMerkleProof(proof.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Verify(tree.Root()) {
+		t.Fatal("deserialized proof does not verify")
+	}
+	if _, err := DeserializeMerkleProof([]byte("not a proof")); err == nil {
+		t.Fatal("garbage is decoded as a proof")
+	}
+}
@@ -2,8 +2,10 @@ package blocks
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/utils"
 	"math"
 	"math/big"
@@ -14,31 +16,71 @@ import (
 type ProofOfWorkWrapper struct {
 	Block  *Block
 	Target *big.Int
+	// MaxNonce: nonce is searched in [0, MaxNonce)
+	MaxNonce int64
 }
 
 func CreateProofOfWork(block *Block) *ProofOfWorkWrapper {
 	// we use target to ensure that the high bits of hash are 0
 	target := big.NewInt(1)
 	target.Lsh(target, uint(256-block.Difficulty))
-	pow := &ProofOfWorkWrapper{block, target}
+	pow := &ProofOfWorkWrapper{block, target, math.MaxInt64}
 	return pow
 }
 
-func FindNonce(pow *ProofOfWorkWrapper, workId int, totalWorker int,
-	resultChan chan int, killSigChan chan struct{}, workloadChan chan int) {
+func (pow *ProofOfWorkWrapper) PrepareData(nonce int, merkleRoot []byte) []byte {
+	// merkle root is passed in so that it is not recomputed for every nonce
+	return prepareProofOfWorkData(pow.Block.PrevHash, pow.Block.Data, merkleRoot, pow.Block.Timestamp, nonce,
+		pow.Block.Difficulty)
+}
+
+func prepareProofOfWorkData(prevHash []byte, data []byte, merkleRoot []byte, timestamp int64, nonce int,
+	difficulty int) []byte {
+	// everything hashed by proof of work, shared by blocks and block headers
+	powData := bytes.Join([][]byte{prevHash, data,
+		merkleRoot,
+		utils.Int2Hex(timestamp),
+		utils.Int2Hex(int64(nonce)),
+		utils.Int2Hex(int64(difficulty))}, []byte{})
+	return powData
+}
+
+func CalculateNextDifficulty(params *config.ChainParams, prevDifficulty int, actualTimespan int64,
+	expectedTimespan int64) int {
+	// each unit of difficulty doubles the expected work, so the adjustment is
+	// log2 of how much faster the blocks came than expected
+	ratio := float64(expectedTimespan) / math.Max(float64(actualTimespan), 1)
+	adjustment := int(math.Round(math.Log2(ratio)))
+	if adjustment > params.MaxDifficultyAdjustment {
+		adjustment = params.MaxDifficultyAdjustment
+	}
+	if adjustment < -params.MaxDifficultyAdjustment {
+		adjustment = -params.MaxDifficultyAdjustment
+	}
+	nextDifficulty := prevDifficulty + adjustment
+	if nextDifficulty < params.MinDifficulty {
+		nextDifficulty = params.MinDifficulty
+	}
+	if nextDifficulty > 255 {
+		nextDifficulty = 255
+	}
+	return nextDifficulty
+}
+
+func FindNonce(ctx context.Context, pow *ProofOfWorkWrapper, workId int, totalWorker int,
+	resultChan chan int, workloadChan chan int) {
+	// search nonce in [workId * chunkSize, (workId + 1) * chunkSize) until found or ctx is done
 	var intHash big.Int
 	var hash [32]byte
-	chunkSize := int64(math.MaxInt64 / totalWorker)
+	chunkSize := pow.MaxNonce / int64(totalWorker)
+	merkleRoot := pow.Block.GetMerkleRoot()
 	for nonce := int64(workId) * chunkSize; nonce < int64(workId+1)*chunkSize; {
 		select {
-		case <-killSigChan:
+		case <-ctx.Done():
 			workloadChan <- int(nonce - int64(workId)*chunkSize)
 			return
 		default:
-			powData := bytes.Join([][]byte{pow.Block.PrevHash, pow.Block.Data,
-				pow.Block.GetTransactionsHash(),
-				utils.Int2Hex(int64(nonce)),
-				utils.Int2Hex(int64(pow.Block.Difficulty))}, []byte{})
+			powData := pow.PrepareData(int(nonce), merkleRoot)
 			hash = sha256.Sum256(powData)
 			intHash.SetBytes(hash[:])
 			if intHash.Cmp(pow.Target) == -1 {
@@ -50,61 +92,84 @@ func FindNonce(pow *ProofOfWorkWrapper, workId int, totalWorker int,
 			}
 		}
 	}
+	// the whole chunk is searched without result
+	workloadChan <- int(chunkSize)
 }
 
-func (pow *ProofOfWorkWrapper) GenerateNonceHash(singleThreadMode bool) (int, []byte) {
-	// Spawn goroutines to find nonce
+func (pow *ProofOfWorkWrapper) GenerateNonceHash(ctx context.Context, singleThreadMode bool) (int, []byte, utils.MiningStatus) {
+	// Spawn goroutines to find nonce, they stop when one of them succeeds, all of them
+	// run out of nonce, or ctx is cancelled from outside
 	start := time.Now().UnixMilli()
 	cpuNum := runtime.NumCPU()
 	routineNum := int(math.Max(1, float64(cpuNum-4)))
 	if singleThreadMode {
 		routineNum = 1
 	}
-	resultChan := make(chan int)
-	workloadChan := make(chan int)
-	killSigChan := make(chan struct{})
-	defer close(resultChan)
+	resultChan := make(chan int, routineNum)
+	workloadChan := make(chan int, routineNum)
+	workerCtx, killWorkers := context.WithCancel(ctx)
+	defer killWorkers()
 	for i := 0; i < routineNum; i++ {
-		go FindNonce(pow, i, routineNum, resultChan, killSigChan, workloadChan)
+		go FindNonce(workerCtx, pow, i, routineNum, resultChan, workloadChan)
 	}
-	nonce := <-resultChan
-	close(killSigChan) // This will kill all go routines
-	end := time.Now().UnixMilli()
 
-	// calculate total work
+	// wait for all workers and calculate total work, a worker always reports
+	// its result before its workload, so the first result kills all others
+	nonce := -1
 	totalWorkload := 0
 	for i := 0; i < routineNum; i++ {
 		workload := <-workloadChan
 		totalWorkload += workload
+		select {
+		case result := <-resultChan:
+			if nonce == -1 {
+				nonce = result
+				killWorkers()
+			}
+		default:
+		}
+	}
+	end := time.Now().UnixMilli()
+	// a million hash per second
+	hashRate := (float64(totalWorkload) / math.Max(float64(end-start), 1)) / 1000
+	fmt.Printf("Hash rate: %fMH/s.\n", hashRate)
+	if nonce == -1 {
+		if ctx.Err() != nil {
+			return -1, []byte{}, utils.MiningCancelled
+		}
+		return -1, []byte{}, utils.MiningExhausted
 	}
 
 	// return nonce, hash
 	var intHash big.Int
 	var hash [32]byte
-	powData := bytes.Join([][]byte{pow.Block.PrevHash, pow.Block.Data,
-		pow.Block.GetTransactionsHash(),
-		utils.Int2Hex(int64(nonce)),
-		utils.Int2Hex(int64(pow.Block.Difficulty))}, []byte{})
+	powData := pow.PrepareData(nonce, pow.Block.GetMerkleRoot())
 	hash = sha256.Sum256(powData)
 	intHash.SetBytes(hash[:])
 	if intHash.Cmp(pow.Target) == -1 {
-		// a million hash per second
-		hashRate := (float64(totalWorkload) / math.Max(float64(end-start), 1)) / 1000
-		fmt.Printf("Hash rate: %fMH/s.\n", hashRate)
-		return nonce, hash[:]
+		return nonce, hash[:], utils.MiningSucceeded
 	} else {
 		panic("Wrong nonce returned by worker!")
 	}
 }
 
 func (pow *ProofOfWorkWrapper) ValidateNonce() bool {
-	// check that nonce can really make initial bits of hash value 0
+	// check that nonce can really make initial bits of hash value 0, and that the
+	// hash stored in block is the one we get
 	var intHash big.Int
-	powData := bytes.Join([][]byte{pow.Block.PrevHash, pow.Block.Data,
-		pow.Block.GetTransactionsHash(),
-		utils.Int2Hex(int64(pow.Block.Nonce)),
-		utils.Int2Hex(int64(pow.Block.Difficulty))}, []byte{})
+	powData := pow.PrepareData(pow.Block.Nonce, pow.Block.GetMerkleRoot())
 	hash := sha256.Sum256(powData)
 	intHash.SetBytes(hash[:])
-	return intHash.Cmp(pow.Target) == -1
+	return intHash.Cmp(pow.Target) == -1 && bytes.Compare(hash[:], pow.Block.Hash) == 0
+}
+
+func (b *Block) Work() *big.Int {
+	return difficultyWork(b.Difficulty)
+}
+
+func difficultyWork(difficulty int) *big.Int {
+	// expected number of hashes needed to mine a block with this difficulty
+	work := big.NewInt(1)
+	work.Lsh(work, uint(difficulty))
+	return work
 }
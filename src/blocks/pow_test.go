@@ -0,0 +1,40 @@
+package blocks
+
+import (
+	"testing"
+
+	"github.com/AntonyMei/Blockchain/config"
+)
+
+func TestCalculateNextDifficulty(t *testing.T) {
+	params := config.Default().Chain
+	params.MinDifficulty = 4
+	params.MaxDifficultyAdjustment = 2
+	expected := int64(1000)
+	cases := []struct {
+		name           string
+		prevDifficulty int
+		actualTimespan int64
+		nextDifficulty int
+	}{
+		{"on time", 10, 1000, 10},
+		{"twice as fast", 10, 500, 11},
+		{"twice as slow", 10, 2000, 9},
+		// log2 is rounded, 1.4 times faster is closer to no change
+		{"slightly fast", 10, 714, 10},
+		{"slightly faster", 10, 700, 11},
+		// adjustment is bounded by MaxDifficultyAdjustment in both directions
+		{"much faster", 10, 10, 12},
+		{"much slower", 10, 100000, 8},
+		{"no time", 10, 0, 12},
+		{"negative time", 10, -5000, 12},
+		// difficulty stays within [MinDifficulty, 255]
+		{"at min", 5, 100000, 4},
+		{"at max", 254, 10, 255},
+	}
+	for _, c := range cases {
+		if next := CalculateNextDifficulty(&params, c.prevDifficulty, c.actualTimespan, expected); next != c.nextDifficulty {
+			t.Errorf("%s: got %v, expect %v", c.name, next, c.nextDifficulty)
+		}
+	}
+}
@@ -2,21 +2,31 @@ package cli
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/blockcache"
 	"github.com/AntonyMei/Blockchain/src/blockchain"
 	"github.com/AntonyMei/Blockchain/src/blocks"
 	"github.com/AntonyMei/Blockchain/src/network"
+	"github.com/AntonyMei/Blockchain/src/rpc"
 	"github.com/AntonyMei/Blockchain/src/transaction"
 	"github.com/AntonyMei/Blockchain/src/utils"
 	"github.com/AntonyMei/Blockchain/src/wallet"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Cli struct {
+	Config       *config.Config
 	Wallets      *wallet.Wallets
 	Blockchain   *blockchain.BlockChain
 	UserName     string
@@ -24,42 +34,64 @@ type Cli struct {
 	Node         *network.Node
 	PendingTxMap *blockchain.PendingTXs
 	UTXOSet      *blockchain.UTXOSet
+
+	// rpcServer: nil if RPC server is not running
+	rpcServer *rpc.Server
+
+	// chainMu: blocks join chain one at a time, whether they come from cache, sync or generate
+	chainMu sync.Mutex
+
+	// mining sessions that are currently running
+	miningMu            sync.Mutex
+	miningSessions      map[int]*miningSession
+	nextMiningSessionID int
+}
+
+type miningSession struct {
+	cancel  context.CancelFunc
+	stopped bool
 }
 
 // Basic
 
-func InitializeCli(userName string, ip string, port string) *Cli {
+func InitializeCli(cfg *config.Config, userName string, ip string, port string) *Cli {
 	// initialize wallets
-	wallets, err := wallet.InitializeWallets(userName)
-	if err == nil {
+	wallets, err := wallet.InitializeWallets(cfg, userName)
+	if err != nil {
+		fmt.Printf("New wallet seed created, write down its mnemonic for backup:\n%s\n", wallets.Mnemonic)
+		fmt.Printf("Wallet file has no passphrase, set one with 'passphrase'.\n")
+	} else if wallets.IsLocked() {
+		fmt.Printf("Load wallets succeeded, wallets are locked until 'unlock'.\n")
+	} else {
 		fmt.Printf("Load wallets succeeded.\n")
 	}
 
-	// initialize UTXO set
-	utxoset, err2 := blockchain.InitUTXOSet(userName)
-	if err2 == nil {
-		fmt.Printf("Recovered UTXO set from disk.\n")
-	}
-
 	// initialize blockchain
-	chain := blockchain.InitBlockChain(wallets, userName)
+	chain := blockchain.InitBlockChain(cfg, userName)
+
+	// initialize UTXO set, it is stored together with blockchain
+	utxoset := blockchain.InitUTXOSet(chain)
 
 	// initialize network node
-	node := network.InitializeNode(wallets, chain, network.NetworkMetaData{Ip: ip, Port: port})
-	node.Serve()
+	node := network.InitializeNode(cfg, userName, wallets, chain, network.NetworkMetaData{Ip: ip, Port: port})
+	utils.Handle(node.Start(context.Background()))
 
 	// initialize cli
-	cli := Cli{Wallets: wallets, Blockchain: chain, Node: node, UTXOSet: utxoset}
-	cli.BlockCache = blockcache.InitBlockCache(10, chain.LastHash)
-	cli.PendingTxMap = blockchain.InitPendingTXs()
+	cli := Cli{Config: cfg, Wallets: wallets, Blockchain: chain, Node: node, UTXOSet: utxoset}
+	cli.miningSessions = make(map[int]*miningSession)
+	cli.BlockCache = blockcache.InitBlockCache(10, cfg.Chain.MinDifficulty, chain.LastHash, func(hash []byte) bool {
+		_, found := chain.GetBlock(hash)
+		return found
+	})
+	cli.PendingTxMap = blockchain.InitPendingTXs(utxoset, cfg.Mempool, chain.Params.NetworkID, chain.Clock)
+
+	// reorg of chain
+	chain.SetReorgFunc(cli.HandleReorg)
 
 	// transaction from network
 	node.SetCliTransactionFunc(cli.HandleTxFromNetwork)
 	node.SetCliBlockFunc(cli.HandleBlockFromNetwork)
-	allBlocks := chain.GetAllBlocks()
-	for _, block := range allBlocks {
-		node.AddBlock(block)
-	}
+	node.SetCliGetTxFunc(cli.PendingTxMap.GetTxByID)
 
 	// perform some magic op
 	transaction.MagicOp()
@@ -69,6 +101,10 @@ func InitializeCli(userName string, ip string, port string) *Cli {
 func (cli *Cli) Loop(reader *bufio.Reader) {
 	s := make(chan string)
 	e := make(chan error)
+	// next: the next line is only read once a command is handled, since commands may
+	// read a passphrase from stdin themselves
+	next := make(chan bool)
+	handling := false
 
 	go func() {
 		for true {
@@ -79,6 +115,7 @@ func (cli *Cli) Loop(reader *bufio.Reader) {
 			} else {
 				s <- line
 			}
+			<-next
 			time.Sleep(10 * time.Millisecond)
 		}
 	}()
@@ -87,8 +124,13 @@ func (cli *Cli) Loop(reader *bufio.Reader) {
 
 MainLoop:
 	for {
+		if handling {
+			next <- true
+			handling = false
+		}
 		select {
 		case text := <-s:
+			handling = true
 			inputList := utils.ParseInput(text)
 			// main loop
 			if len(inputList) == 0 {
@@ -105,7 +147,81 @@ MainLoop:
 				if !utils.CheckArgumentCount(inputList, 3) {
 					continue
 				}
-				cli.CreateWallet(inputList[2])
+				cli.CreateWallet(inputList[2], wallet.ReceiveChain)
+			} else if utils.Match(inputList, []string{"mk", "change"}) {
+				// create wallet on change chain of HD wallets
+				// syntax: mk change [name]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.CreateWallet(inputList[2], wallet.ChangeChain)
+			} else if utils.Match(inputList, []string{"ls", "mnemonic"}) {
+				// print mnemonic of wallet seed
+				// syntax: ls mnemonic
+				if !utils.CheckArgumentCount(inputList, 2) {
+					continue
+				}
+				cli.PrintMnemonic()
+			} else if utils.Match(inputList, []string{"restore", "wallet"}) {
+				// restore HD wallets from mnemonic, -f drops used wallets of current seed
+				// syntax: restore wallet (-f) [word 1] [word 2] ...
+				force := len(inputList) > 2 && inputList[2] == "-f"
+				words := inputList[2:]
+				if force {
+					words = inputList[3:]
+				}
+				if len(words) == 0 {
+					fmt.Printf("Syntax error: restore wallet (-f) [word 1] [word 2] ...\n")
+					continue
+				}
+				cli.RestoreWallets(strings.Join(words, " "), force)
+			} else if utils.Match(inputList, []string{"unlock"}) {
+				// unlock wallets so that they can sign, they are locked again after timeout
+				// passphrase is asked for without echo
+				// syntax: unlock (-t [seconds])
+				if len(inputList) != 1 && (len(inputList) != 3 || inputList[1] != "-t") {
+					fmt.Printf("Syntax error: unlock (-t [seconds])\n")
+					continue
+				}
+				timeout := config.WalletUnlockTimeout
+				if len(inputList) == 3 {
+					parsedTimeout, err := strconv.Atoi(inputList[2])
+					if err != nil || parsedTimeout <= 0 {
+						fmt.Printf("Syntax error: could not parse timeout.\n")
+						continue
+					}
+					timeout = parsedTimeout
+				}
+				passphrase, err := readPassphrase("Passphrase: ", reader)
+				if err != nil {
+					fmt.Printf("Error: %v.\n", err)
+					continue
+				}
+				cli.UnlockWallets(passphrase, timeout)
+			} else if utils.Match(inputList, []string{"lock"}) {
+				// lock wallets
+				// syntax: lock
+				if !utils.CheckArgumentCount(inputList, 1) {
+					continue
+				}
+				cli.LockWallets()
+			} else if utils.Match(inputList, []string{"passphrase"}) {
+				// change passphrase of wallet file, both are asked for without echo
+				// syntax: passphrase
+				if !utils.CheckArgumentCount(inputList, 1) {
+					continue
+				}
+				oldPassphrase, err := readPassphrase("Old passphrase: ", reader)
+				if err != nil {
+					fmt.Printf("Error: %v.\n", err)
+					continue
+				}
+				newPassphrase, err := readNewPassphrase(reader)
+				if err != nil {
+					fmt.Printf("Error: %v.\n", err)
+					continue
+				}
+				cli.ChangePassphrase(oldPassphrase, newPassphrase)
 			} else if utils.Match(inputList, []string{"ls", "wallet"}) {
 				// list wallet
 				// syntax: ls wallet [name/all]
@@ -121,17 +237,32 @@ MainLoop:
 				}
 				cli.ListKnownAddress(inputList[2])
 			} else if utils.Match(inputList, []string{"mk", "tx"}) {
-				// create new tx
-				// syntax: mk tx -n [tx name] -s [sender name] -r [receiver name 1]:[amount 1] ...
-				if len(inputList) < 8 || inputList[2] != "-n" || inputList[4] != "-s" || inputList[6] != "-r" {
-					fmt.Printf("Syntax error: mk tx -n [tx name] -s [sender name] -r [receiver name 1]:[amount 1] ...\n")
+				// create new tx, fee is 0 if not given
+				// syntax: mk tx -n [tx name] -s [sender name] (-f [fee]) -r [receiver name 1]:[amount 1] ...
+				if len(inputList) < 8 || inputList[2] != "-n" || inputList[4] != "-s" {
+					fmt.Printf("Syntax error: mk tx -n [tx name] -s [sender name] (-f [fee]) -r [receiver name 1]:[amount 1] ...\n")
 					continue
 				}
 				txName := inputList[3]
 				senderName := inputList[5]
+				fee := 0
+				receiverStart := 7
+				if inputList[6] == "-f" {
+					parsedFee, err := strconv.Atoi(inputList[7])
+					if err != nil || parsedFee < 0 {
+						fmt.Printf("Syntax error: could not parse fee.\n")
+						continue
+					}
+					fee = parsedFee
+					receiverStart = 9
+				}
+				if len(inputList) <= receiverStart || inputList[receiverStart-1] != "-r" {
+					fmt.Printf("Syntax error: mk tx -n [tx name] -s [sender name] (-f [fee]) -r [receiver name 1]:[amount 1] ...\n")
+					continue
+				}
 				var receiverNameList []string
 				var amountList []int
-				for idx := 7; idx < len(inputList); idx++ {
+				for idx := receiverStart; idx < len(inputList); idx++ {
 					splitList := strings.Split(inputList[idx], ":")
 					if len(splitList) != 2 || len(splitList[0]) == 0 || len(splitList[1]) == 0 {
 						fmt.Printf("Syntax error: could not parse receiver list.\n")
@@ -145,13 +276,20 @@ MainLoop:
 					}
 					amountList = append(amountList, amount)
 				}
-				cli.CreateTransaction(txName, senderName, receiverNameList, amountList)
+				cli.CreateTransaction(txName, senderName, receiverNameList, amountList, fee)
 			} else if utils.Match(inputList, []string{"ls", "tx"}) {
 				// list all TXes
 				// syntax: ls tx
 				cli.ListPendingTransactions()
+			} else if utils.Match(inputList, []string{"mine", "stop"}) {
+				// stop all running mining
+				// syntax: mine stop
+				if !utils.CheckArgumentCount(inputList, 2) {
+					continue
+				}
+				cli.StopMining()
 			} else if utils.Match(inputList, []string{"mine"}) {
-				// mine a new block
+				// mine a new block, pending TXes with highest fee rate are picked if -tx is not given
 				// syntax: mine -n [miner name] -d [block description] -tx [tx name 1] ...
 				if len(inputList) < 5 || inputList[1] != "-n" || inputList[3] != "-d" || len(inputList) == 6 {
 					fmt.Printf("Syntax error: mine -n [miner name] -d [block description] -tx [tx name 1] ...\n")
@@ -170,10 +308,73 @@ MainLoop:
 					}
 				}
 				go cli.MineBlock(minerName, blockDescription, txNameList)
+			} else if utils.Match(inputList, []string{"generate"}) {
+				// regtest only, mine blocks one after another, they are on chain once this returns
+				// syntax: generate [count] [miner name]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.GenerateBlocks(inputList[1], inputList[2])
+			} else if utils.Match(inputList, []string{"mocktime"}) {
+				// regtest only, set chain time in milliseconds, 0 for system time
+				// syntax: mocktime [milliseconds]
+				if !utils.CheckArgumentCount(inputList, 2) {
+					continue
+				}
+				cli.SetMockTime(inputList[1])
 			} else if utils.Match(inputList, []string{"ls", "chain"}) {
 				// print the chain
 				// syntax: ls chain
 				cli.PrintBlockchain()
+			} else if utils.Match(inputList, []string{"ls", "block"}) {
+				// print block on chain with given height
+				// syntax: ls block [height]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.PrintBlock(inputList[2])
+			} else if utils.Match(inputList, []string{"ls", "history"}) {
+				// list all outputs received by a wallet or known address
+				// syntax: ls history [name]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.ListHistory(inputList[2])
+			} else if utils.Match(inputList, []string{"find", "tx"}) {
+				// find a transaction on chain
+				// syntax: find tx [tx id]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.FindTransaction(inputList[2])
+			} else if utils.Match(inputList, []string{"mk", "proof"}) {
+				// generate merkle proof of a transaction
+				// syntax: mk proof [tx id]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.GenerateMerkleProof(inputList[2])
+			} else if utils.Match(inputList, []string{"verify", "proof"}) {
+				// verify a merkle proof generated by mk proof
+				// syntax: verify proof [proof]
+				if !utils.CheckArgumentCount(inputList, 3) {
+					continue
+				}
+				cli.VerifyMerkleProof(inputList[2])
+			} else if utils.Match(inputList, []string{"verify", "chain"}) {
+				// replay chain from genesis and check UTXO set and indexes against it
+				// syntax: verify chain
+				if !utils.CheckArgumentCount(inputList, 2) {
+					continue
+				}
+				cli.VerifyChain()
+			} else if utils.Match(inputList, []string{"reindex"}) {
+				// rebuild UTXO set and indexes by replaying chain from genesis
+				// syntax: reindex
+				if !utils.CheckArgumentCount(inputList, 1) {
+					continue
+				}
+				cli.Reindex()
 			} else if utils.Match(inputList, []string{"ping"}) {
 				// ping
 				if !utils.CheckArgumentCount(inputList, 3) {
@@ -186,6 +387,30 @@ MainLoop:
 					continue
 				}
 				cli.CheckConnection()
+			} else if utils.Match(inputList, []string{"ls", "sync"}) {
+				// show progress of block synchronization
+				// syntax: ls sync
+				if !utils.CheckArgumentCount(inputList, 2) {
+					continue
+				}
+				cli.PrintSyncStatus()
+			} else if utils.Match(inputList, []string{"rpc", "start"}) {
+				// start RPC server on local interface, a random auth token is generated if none is given
+				// syntax: rpc start [port] (-t [token])
+				if len(inputList) == 3 {
+					cli.StartRPC(inputList[2], "")
+				} else if len(inputList) == 5 && inputList[3] == "-t" {
+					cli.StartRPC(inputList[2], inputList[4])
+				} else {
+					fmt.Printf("Syntax error: rpc start [port] (-t [token])\n")
+				}
+			} else if utils.Match(inputList, []string{"rpc", "stop"}) {
+				// stop RPC server
+				// syntax: rpc stop
+				if !utils.CheckArgumentCount(inputList, 2) {
+					continue
+				}
+				cli.StopRPC()
 			} else if utils.Match(inputList, []string{"broadcast"}) {
 				// broadcast user data
 				if !utils.CheckArgumentCount(inputList, 2) {
@@ -201,48 +426,180 @@ MainLoop:
 			}
 			fmt.Println()
 		case <-e:
+			handling = true
 			continue
 		case <-time.After(time.Duration(10) * time.Millisecond):
 			// handle blocks from network
 			cli.HandleBlock()
 
 			// ping a random node to catch up chain
-			cli.Node.RandomPing(cli.Blockchain.BlockHeight)
+			cli.Node.RandomPing(cli.Blockchain.Tip().Height)
 		case <-tick:
-			// broadcast all private users' id
-			accountNames := cli.Wallets.GetAllWalletNames()
-			for _, name := range accountNames {
-				wallet := cli.Wallets.GetWallet(name)
-				user_meta := network.UserMetaData{Name: name, PublicKey: wallet.PublicKey, WalletAddr: wallet.Address()}
-				cli.Node.BroadcastUserMessage(user_meta)
-			}
+			cli.broadcastUsers()
 		}
 	}
 }
 
+func (cli *Cli) Run(ctx context.Context) {
+	// non-interactive mode, does what Loop does in background until ctx is done, then exits
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			cli.Exit()
+			return
+		case <-time.After(time.Duration(10) * time.Millisecond):
+			cli.HandleBlock()
+			cli.Node.RandomPing(cli.Blockchain.Tip().Height)
+		case <-ticker.C:
+			cli.broadcastUsers()
+		}
+	}
+}
+
+func (cli *Cli) broadcastUsers() {
+	// broadcast all private users' id
+	accountNames := cli.Wallets.GetAllWalletNames()
+	for _, name := range accountNames {
+		wallet := cli.Wallets.GetWallet(name)
+		user_meta := network.UserMetaData{Name: name, PublicKey: wallet.PublicKey,
+			WalletAddr: wallet.Address(cli.Wallets.Params)}
+		cli.Node.BroadcastUserMessage(user_meta)
+	}
+}
+
+func readPassphrase(prompt string, reader *bufio.Reader) (string, error) {
+	// passphrase is read from terminal without echo, or as a line of reader (stdin) when
+	// stdin is not a terminal, so that it never appears on command line or in history
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Print(prompt)
+		passphrase, err := terminal.ReadPassword(fd)
+		fmt.Println()
+		return string(passphrase), err
+	}
+	return readLine(reader)
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	// a line without its line break, the last line may have none
+	line, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readNewPassphrase(reader *bufio.Reader) (string, error) {
+	// new passphrase is typed twice
+	passphrase, err := readPassphrase("New passphrase: ", reader)
+	if err != nil {
+		return "", err
+	}
+	repeated, err := readPassphrase("Repeat new passphrase: ", reader)
+	if err != nil {
+		return "", err
+	}
+	if passphrase != repeated {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
 func (cli *Cli) Exit() {
-	cli.Wallets.SaveFile()
-	cli.UTXOSet.SaveFile()
+	if cli.rpcServer != nil {
+		cli.StopRPC()
+	}
+	// no message is handled once node is stopped, so that chain can be closed
+	cli.Node.Stop()
+	if err := cli.Wallets.SaveFile(); err != nil {
+		fmt.Printf("Error: %v.\n", err)
+	}
+	cli.Node.ConnectionPool.SaveFile()
 	cli.Blockchain.Exit()
 }
 
 // Wallets
 
-func (cli *Cli) CreateWallet(name string) {
-	if name == "All" || name == "all" {
-		fmt.Printf("All / all is reserved name.\n")
+func (cli *Cli) CreateWallet(name string, chain uint32) {
+	res, err := cli.createWallet(name, chain)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
 		return
 	}
+	fmt.Printf("Wallet: %s\n", name)
+	fmt.Printf("Address: %x\n", res.Address(cli.Wallets.Params))
+	fmt.Printf("Path: %s\n", res.Path)
+}
+
+func (cli *Cli) createWallet(name string, chain uint32) (*wallet.Wallet, error) {
+	if name == "All" || name == "all" {
+		return nil, errors.New("All / all is reserved name")
+	}
 	if tmp := cli.Wallets.GetWallet(name); tmp != nil {
-		fmt.Printf("Wallet with name %s already exists.\n", name)
-		return
+		return nil, fmt.Errorf("wallet with name %s already exists", name)
+	}
+	addr, err := cli.Wallets.DeriveWallet(name, chain)
+	if err != nil {
+		return nil, err
 	}
-	addr := cli.Wallets.CreateWallet(name)
-	fmt.Printf("Wallet: %s\n", name)
-	fmt.Printf("Address: %x\n", addr)
 	// put this address into known addresses
 	res := cli.Wallets.GetWallet(name)
 	cli.Wallets.AddKnownAddress(name, &wallet.KnownAddress{Address: addr, PublicKey: res.PrivateKey.PublicKey})
+	return res, nil
+}
+
+func (cli *Cli) PrintMnemonic() {
+	if cli.Wallets.IsLocked() {
+		fmt.Printf("Error: %v.\n", wallet.ErrWalletLocked)
+		return
+	}
+	fmt.Printf("Mnemonic: %s\n", cli.Wallets.Mnemonic)
+}
+
+func (cli *Cli) UnlockWallets(passphrase string, timeout int) {
+	err := cli.Wallets.Unlock(passphrase, time.Duration(timeout)*time.Second)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		return
+	}
+	fmt.Printf("Wallets unlocked for %v seconds.\n", timeout)
+}
+
+func (cli *Cli) LockWallets() {
+	cli.Wallets.Lock()
+	fmt.Printf("Wallets locked.\n")
+}
+
+func (cli *Cli) ChangePassphrase(oldPassphrase string, newPassphrase string) {
+	err := cli.Wallets.ChangePassphrase(oldPassphrase, newPassphrase)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		return
+	}
+	fmt.Printf("Passphrase changed.\n")
+}
+
+func (cli *Cli) RestoreWallets(mnemonic string, force bool) {
+	// HD wallets of the old seed are replaced by those found on chain for the new one
+	found, err := cli.Wallets.Restore(mnemonic, func(w *wallet.Wallet) bool {
+		return len(cli.Blockchain.GetAddressHistory(w.PubKeyHash())) > 0
+	}, force)
+	if err == wallet.ErrSeedInUse {
+		fmt.Printf("Error: %v, back up 'ls mnemonic' and use 'restore wallet -f ...'.\n", err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		return
+	}
+	fmt.Printf("Restored %v wallet(s) that have been used on chain.\n", found)
+	for _, name := range cli.Wallets.GetAllWalletNames() {
+		res := cli.Wallets.GetWallet(name)
+		cli.Wallets.AddKnownAddress(name, &wallet.KnownAddress{Address: res.Address(cli.Wallets.Params),
+			PublicKey: res.PrivateKey.PublicKey})
+	}
 }
 
 func (cli *Cli) ListWallet(name string) {
@@ -259,10 +616,13 @@ func (cli *Cli) _listWallet(name string) {
 		fmt.Printf("Error: no wallet with name %s.\n", name)
 		return
 	}
-	addr := res.Address()
+	addr := res.Address(cli.Wallets.Params)
 	fmt.Printf("Wallet: %s\n", name)
 	fmt.Printf("Address: %x\n", addr)
-	balance := cli.Blockchain.GetBalance(addr, &res.PrivateKey.PublicKey)
+	if res.Path != "" {
+		fmt.Printf("Path: %s\n", res.Path)
+	}
+	balance := cli.UTXOSet.GetBalance(wallet.AddressToPubKeyHash(addr))
 	fmt.Printf("Balance: %v\n", balance)
 }
 
@@ -297,78 +657,365 @@ func (cli *Cli) _listAllKnownAddresses() {
 	}
 }
 
-func (cli *Cli) CreateTransaction(txName string, sender string, receiverList []string, amountList []int) string {
+func (cli *Cli) CreateTransaction(txName string, sender string, receiverList []string, amountList []int,
+	fee int) string {
 	// check input shape
 	if len(receiverList) != len(amountList) {
 		fmt.Printf("Error: receiver list and amount list shape mismatch.\n")
-	}
-
-	// get sender wallet and receiver addresses
-	fromWallet := cli.Wallets.GetWallet(sender)
-	if fromWallet == nil {
-		fmt.Printf("Error: No wallet with name %s.\n", sender)
 		return ""
 	}
+
+	// get receiver addresses
 	var toAddrList [][]byte
 	for _, receiver := range receiverList {
-		receiverAddr := cli.Wallets.GetKnownAddress(receiver)
-		if receiverAddr == nil {
-			fmt.Printf("Error: No known address with name %s.\n", receiver)
+		receiverAddr, err := cli.knownAddress(receiver)
+		if err != nil {
+			fmt.Printf("Error: %v.\n", err)
 			return ""
 		}
-		toAddrList = append(toAddrList, receiverAddr.Address)
+		toAddrList = append(toAddrList, receiverAddr)
 	}
 
-	// create TX and put into pending zone
-	newTX := cli.Blockchain.GenerateTransaction(fromWallet, toAddrList, amountList)
-	txKey := txName + "::" + string(utils.Base58Encode(newTX.TxID[:8]))
-	cli.PendingTxMap.AddTransaction(txKey, newTX)
+	txKey, _, err := cli.sendTransaction(txName, sender, toAddrList, amountList, fee)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		return ""
+	}
 	fmt.Printf("New transaction: %s.\n", txKey)
-
-	// broadcast transaction
-	cli.Node.BroadcastTransaction(txKey, newTX)
 	return txKey
 }
 
+func (cli *Cli) knownAddress(name string) ([]byte, error) {
+	receiverAddr := cli.Wallets.GetKnownAddress(name)
+	if receiverAddr == nil {
+		return nil, fmt.Errorf("no known address with name %s", name)
+	}
+	if !wallet.ValidateAddress(receiverAddr.Address, cli.Wallets.Params) {
+		return nil, fmt.Errorf("known address of %s is invalid", name)
+	}
+	return receiverAddr.Address, nil
+}
+
+func (cli *Cli) sendTransaction(txName string, sender string, toAddrList [][]byte, amountList []int,
+	fee int) (string, *transaction.Transaction, error) {
+	// create TX from wallet of sender, put it into pending zone and broadcast it
+	fromWallet := cli.Wallets.GetWallet(sender)
+	if fromWallet == nil {
+		return "", nil, fmt.Errorf("no wallet with name %s", sender)
+	}
+	newTX, err := cli.Blockchain.GenerateTransaction(cli.UTXOSet, cli.PendingTxMap, fromWallet, toAddrList,
+		amountList, fee)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create transaction: %v", err)
+	}
+	txKey := txName + "::" + string(utils.Base58Encode(newTX.TxID[:8]))
+	status := cli.PendingTxMap.AddTransaction(txKey, newTX)
+	if status != utils.TXAccepted {
+		return "", nil, fmt.Errorf("transaction rejected by pending zone: %v", status.String())
+	}
+	cli.Node.BroadcastTransaction(newTX)
+	return txKey, newTX, nil
+}
+
 func (cli *Cli) ListPendingTransactions() {
 	cli.PendingTxMap.ListPendingTransactions()
 }
 
-func (cli *Cli) MineBlock(minerName string, description string, txNameList []string) {
-	// get miner wallet
+func (cli *Cli) MineBlock(minerName string, description string, txNameList []string) utils.MiningStatus {
+	_, status, err := cli.mineBlock(minerName, description, txNameList)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+	}
+	return status
+}
+
+func (cli *Cli) mineBlock(minerName string, description string, txNameList []string) (*blocks.Block,
+	utils.MiningStatus, error) {
+	// returns the mined block if mining succeeds, it is put into block cache
 	minerWallet := cli.Wallets.GetWallet(minerName)
 	if minerWallet == nil {
-		fmt.Printf("Error: No wallet with name %s.\n", minerName)
+		return nil, utils.MiningCancelled, fmt.Errorf("no wallet with name %s", minerName)
+	}
+	for {
+		// get tx from pending tx list, txes may be mined by others after a restart
+		var blockTXList []*transaction.Transaction
+		fees := 0
+		if len(txNameList) == 0 {
+			blockTXList, fees = cli.blockTemplate(minerWallet.Address(cli.Wallets.Params))
+		}
+		for _, txName := range txNameList {
+			tx := cli.PendingTxMap.GetTx(txName)
+			if tx == nil {
+				fmt.Printf("Warning: no pending transaction with name %s, skipped.\n", txName)
+				continue
+			}
+			blockTXList = append(blockTXList, tx)
+			fees += cli.PendingTxMap.GetFee(txName)
+		}
+		// mine a new block, this is cancelled if chain tip changes or user stops mining
+		sessionID, ctx := cli.startMiningSession()
+		newBlock, status := cli.Blockchain.MineBlock(ctx, minerWallet.Address(cli.Wallets.Params), description,
+			blockTXList, fees)
+		stopped := cli.endMiningSession(sessionID)
+		fmt.Printf("Mining result: %v.\n", status.String())
+		if status == utils.MiningSucceeded {
+			// put the block into the cache
+			cli.BlockCache.AddBlock(newBlock, "")
+			return newBlock, status, nil
+		}
+		if status == utils.MiningExhausted || stopped {
+			return nil, status, nil
+		}
+		fmt.Printf("Chain tip changed, restart mining on block %x.\n", cli.Blockchain.Tip().Hash)
+	}
+}
+
+func (cli *Cli) blockTemplate(minerAddr []byte) ([]*transaction.Transaction, int) {
+	// pending TXes with highest fee rate that fit into a block next to coinbase, and their total fee
+	pickedNames, txList, fees := cli.PendingTxMap.BuildBlockTemplate(cli.Blockchain.Params.MaxBlockTXBytes -
+		transaction.CoinbaseTx(minerAddr, cli.Blockchain.Params.Reward(cli.Blockchain.Tip().Height+1), 0).Size())
+	fmt.Printf("Picked %v pending transaction(s), total fee %v.\n", len(pickedNames), fees)
+	return txList, fees
+}
+
+func (cli *Cli) GenerateBlocks(countString string, minerName string) {
+	count, err := strconv.Atoi(countString)
+	if err != nil || count <= 0 {
+		fmt.Printf("Syntax error: could not parse block count.\n")
 		return
 	}
-	// get tx and remove from pending tx list
-	var blockTXList []*transaction.Transaction
-	for _, txName := range txNameList {
-		tx := cli.PendingTxMap.GetTx(txName)
-		if tx == nil {
-			fmt.Printf("Error: no transaction with name %s.\n", txName)
-			return
+	minerWallet := cli.Wallets.GetWallet(minerName)
+	if minerWallet == nil {
+		fmt.Printf("Error: no wallet with name %s.\n", minerName)
+		return
+	}
+	generated, err := cli.generateBlocks(count, minerWallet.Address(cli.Wallets.Params))
+	fmt.Printf("Generated %v block(s), chain height %v.\n", len(generated), cli.Blockchain.Tip().Height)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+	}
+}
+
+func (cli *Cli) generateBlocks(count int, minerAddr []byte) ([]*blocks.Block, error) {
+	// regtest only, mine count blocks with pending TXes, each of them joins chain before the next
+	// one is mined, so that they are on chain once this returns
+	if !cli.Blockchain.Params.Regtest {
+		return nil, errors.New("blocks can only be generated in regtest")
+	}
+	var generated []*blocks.Block
+	for idx := 0; idx < count; idx++ {
+		cli.chainMu.Lock()
+		txList, fees := cli.blockTemplate(minerAddr)
+		block, status := cli.Blockchain.MineBlock(context.Background(), minerAddr, config.GeneratedBlockData, txList, fees)
+		accepted := false
+		if status == utils.MiningSucceeded {
+			cli.addBlock(block, "", true)
+			accepted = bytes.Compare(cli.Blockchain.LastHash, block.Hash) == 0
+		}
+		cli.chainMu.Unlock()
+		if !accepted {
+			return generated, fmt.Errorf("block %v of %v is not accepted (%v)", idx+1, count, status.String())
 		}
-		blockTXList = append(blockTXList, tx)
+		generated = append(generated, block)
+	}
+	return generated, nil
+}
+
+func (cli *Cli) SetMockTime(timeString string) {
+	milliseconds, err := strconv.ParseInt(timeString, 10, 64)
+	if err != nil || milliseconds < 0 {
+		fmt.Printf("Syntax error: could not parse time.\n")
+		return
+	}
+	if err := cli.setMockTime(milliseconds); err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		return
+	}
+	fmt.Printf("Chain time is %v.\n", cli.Blockchain.Clock.Now().Format(time.RFC3339))
+}
+
+func (cli *Cli) setMockTime(milliseconds int64) error {
+	// regtest only, pending transactions share the clock of the chain, 0 uses system time again
+	if !cli.Blockchain.Params.Regtest {
+		return errors.New("mock time is only available in regtest")
+	}
+	cli.Blockchain.Clock.SetMockTime(milliseconds)
+	return nil
+}
+
+func (cli *Cli) startMiningSession() (int, context.Context) {
+	cli.miningMu.Lock()
+	defer cli.miningMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	sessionID := cli.nextMiningSessionID
+	cli.nextMiningSessionID += 1
+	cli.miningSessions[sessionID] = &miningSession{cancel: cancel}
+	return sessionID, ctx
+}
+
+func (cli *Cli) endMiningSession(sessionID int) bool {
+	// returns whether the session is stopped by user
+	cli.miningMu.Lock()
+	defer cli.miningMu.Unlock()
+	session := cli.miningSessions[sessionID]
+	session.cancel()
+	delete(cli.miningSessions, sessionID)
+	return session.stopped
+}
+
+func (cli *Cli) RestartMining() {
+	// cancel all running mining sessions, they will restart on the new tip
+	cli.miningMu.Lock()
+	defer cli.miningMu.Unlock()
+	for _, session := range cli.miningSessions {
+		session.cancel()
+	}
+}
+
+func (cli *Cli) StopMining() {
+	// cancel all running mining sessions without restarting them
+	cli.miningMu.Lock()
+	defer cli.miningMu.Unlock()
+	fmt.Printf("Stop %v mining session(s).\n", len(cli.miningSessions))
+	for _, session := range cli.miningSessions {
+		session.stopped = true
+		session.cancel()
 	}
-	// mine a new block
-	newBlock := cli.Blockchain.MineBlock(minerWallet.Address(), description, blockTXList)
-	// put the block into the cache
-	cli.BlockCache.AddBlock(newBlock)
 }
 
 func (cli *Cli) PrintBlockchain() {
 	cli.Blockchain.Log2Terminal()
 }
 
+func (cli *Cli) PrintBlock(rawHeight string) {
+	height, err := strconv.Atoi(rawHeight)
+	if err != nil {
+		fmt.Printf("Error: could not parse height %s.\n", rawHeight)
+		return
+	}
+	block, found := cli.Blockchain.GetBlockByHeight(height)
+	if !found {
+		fmt.Printf("Error: no block at height %v.\n", height)
+		return
+	}
+	block.Log2Terminal()
+}
+
+func (cli *Cli) FindTransaction(rawTxID string) {
+	txID, err := hex.DecodeString(rawTxID)
+	if err != nil {
+		fmt.Printf("Error: could not parse tx id %s.\n", rawTxID)
+		return
+	}
+	tx, block, found := cli.Blockchain.FindTransaction(txID)
+	if !found {
+		fmt.Printf("Error: no transaction with id %s on chain.\n", rawTxID)
+		return
+	}
+	fmt.Printf("Transaction is in block %x at height %v.\n", block.Hash, block.Height)
+	tx.Log2Terminal()
+}
+
+func (cli *Cli) ListHistory(name string) {
+	// name can be either a wallet of ours or a known address
+	var address []byte
+	if res := cli.Wallets.GetWallet(name); res != nil {
+		address = res.Address(cli.Wallets.Params)
+	} else if res := cli.Wallets.GetKnownAddress(name); res != nil && wallet.ValidateAddress(res.Address, cli.Wallets.Params) {
+		address = res.Address
+	} else {
+		fmt.Printf("Error: no wallet or known address with name %s.\n", name)
+		return
+	}
+	outpoints := cli.Blockchain.GetAddressHistory(wallet.AddressToPubKeyHash(address))
+	fmt.Printf("Found %v output(s) received by %s.\n", len(outpoints), name)
+	for _, outpoint := range outpoints {
+		tx, block, found := cli.Blockchain.FindTransaction(outpoint.TxID)
+		if !found {
+			continue
+		}
+		fmt.Printf("    Height %v, TX %x, output %v: %v coins.\n", block.Height, outpoint.TxID,
+			outpoint.TxOutputIdx, tx.TxOutputList[outpoint.TxOutputIdx].Value)
+	}
+}
+
+func (cli *Cli) VerifyChain() {
+	report := cli.Blockchain.VerifyChain(cli.UTXOSet)
+	report.Log2Terminal()
+	if report.IsConsistent() {
+		fmt.Printf("Chain is consistent.\n")
+	} else {
+		fmt.Printf("Chain is not consistent, run reindex to rebuild it.\n")
+	}
+}
+
+func (cli *Cli) Reindex() {
+	// no block joins chain while it is rebuilt
+	cli.chainMu.Lock()
+	defer cli.chainMu.Unlock()
+	oldTip := cli.Blockchain.LastHash
+	report := cli.Blockchain.Reindex(cli.UTXOSet)
+	report.Log2Terminal()
+	if bytes.Compare(oldTip, cli.Blockchain.LastHash) != 0 {
+		fmt.Printf("Best chain cut back to height %v.\n", cli.Blockchain.BlockHeight)
+		cli.BlockCache.SetLastHash(cli.Blockchain.LastHash)
+		cli.RestartMining()
+		cli.RevalidatePendingTXs()
+	}
+}
+
+func (cli *Cli) GenerateMerkleProof(rawTxID string) {
+	txID, err := hex.DecodeString(rawTxID)
+	if err != nil {
+		fmt.Printf("Error: could not parse tx id %s.\n", rawTxID)
+		return
+	}
+	proof, block, found := cli.Blockchain.GenerateMerkleProof(txID)
+	if !found {
+		fmt.Printf("Error: no transaction with id %s on chain.\n", rawTxID)
+		return
+	}
+	fmt.Printf("Transaction is in block %x at height %v.\n", block.Hash, block.Height)
+	proof.Log2Terminal()
+	fmt.Printf("Proof: %x\n", proof.Serialize())
+}
+
+func (cli *Cli) VerifyMerkleProof(rawProof string) {
+	stream, err := hex.DecodeString(rawProof)
+	if err != nil {
+		fmt.Printf("Error: could not parse proof.\n")
+		return
+	}
+	proof, err := blocks.DeserializeMerkleProof(stream)
+	if err != nil {
+		fmt.Printf("Error: could not decode proof: %v.\n", err)
+		return
+	}
+	block, valid := cli.Blockchain.VerifyMerkleProof(proof)
+	if block == nil {
+		fmt.Printf("Error: no block with merkle root %x on chain.\n", proof.Root)
+		return
+	}
+	fmt.Printf("Transaction %x in block %x: %v.\n", proof.TxID, block.Hash, strconv.FormatBool(valid))
+}
+
 // Network
 
 func (cli *Cli) Ping(ip string, port string) {
-	cli.Node.SendPingMessage(network.NetworkMetaData{Ip: ip, Port: port}, cli.Blockchain.BlockHeight)
+	meta := network.NetworkMetaData{Ip: ip, Port: port}
+	cli.Node.ConnectionPool.AddPeer(meta, utils.PeerManual)
+	cli.Node.SendPingMessage(meta, cli.Blockchain.Tip().Height)
 }
 
 func (cli *Cli) CheckConnection() {
 	cli.Node.ConnectionPool.ShowPool()
+	cli.Node.ShowConnections()
+	cli.Node.ShowBans()
+}
+
+func (cli *Cli) PrintSyncStatus() {
+	status := cli.Node.GetSyncStatus()
+	status.Log2Terminal()
 }
 
 func (cli *Cli) Broadcast(name string) {
@@ -377,39 +1024,94 @@ func (cli *Cli) Broadcast(name string) {
 		fmt.Printf("Error: no wallet with name %s.\n", name)
 		return
 	}
-	user_meta := network.UserMetaData{Name: name, PublicKey: wallet.PublicKey, WalletAddr: wallet.Address()}
+	user_meta := network.UserMetaData{Name: name, PublicKey: wallet.PublicKey,
+		WalletAddr: wallet.Address(cli.Wallets.Params)}
 	cli.Node.BroadcastUserMessage(user_meta)
 }
 
-func (cli *Cli) HandleTxFromNetwork(txKey string, tx *transaction.Transaction) {
-	cur_tx := cli.PendingTxMap.GetTx(txKey)
-	if cur_tx == nil {
-		cli.PendingTxMap.AddTransaction(txKey, tx)
+func (cli *Cli) HandleTxFromNetwork(txKey string, tx *transaction.Transaction, meta network.NetworkMetaData) {
+	// only transactions accepted by pending zone are relayed
+	status := cli.PendingTxMap.AddTransaction(txKey, tx)
+	if status == utils.TXAccepted {
 		// fmt.Printf("Receive transaction from network: %s.\n", txKey)
 
 		// broadcast again
-		cli.Node.BroadcastTransaction(txKey, tx)
+		cli.Node.BroadcastTransaction(tx)
+	} else if status == utils.TXInvalid {
+		cli.Node.Misbehave(meta.Address(), config.InvalidTXScore, "invalid transaction "+txKey)
 	}
 }
 
-func (cli *Cli) HandleBlockFromNetwork(block *blocks.Block) {
-	// puts the block into a cache
-	cli.BlockCache.AddBlock(block)
+func (cli *Cli) HandleBlockFromNetwork(block *blocks.Block, meta network.NetworkMetaData) {
+	// puts the block into a cache, and asks the sender for parent of orphan blocks
+	status := cli.BlockCache.AddBlock(block, meta.Address())
+	if status == blockcache.Orphaned {
+		cli.Node.SendBlockHashRetrieveMessage(meta, block.PrevHash)
+	} else if status == blockcache.Invalid {
+		cli.Node.Misbehave(meta.Address(), config.InvalidBlockScore, fmt.Sprintf("block %x with invalid proof of work", block.Hash))
+	}
 }
 
 func (cli *Cli) HandleBlock() {
-	// handle block from cache
-	block := cli.BlockCache.PopBlock()
+	// handle block from cache, then blocks downloaded by sync in chain order
+	cli.chainMu.Lock()
+	defer cli.chainMu.Unlock()
+	block, peer := cli.BlockCache.PopBlock()
 	if block != nil {
-		validBlock := cli.Blockchain.AddBlock(block, cli.UTXOSet)
-		if validBlock {
-			cli.UTXOSet.DumpBlock(block)
-			cli.BlockCache.SetLastHash(cli.Blockchain.LastHash)
-			cli.RemoveMinedTXs(block)
-			cli.Node.AddBlock(block)
-			cli.Node.BroadcastBlockSource(block)
+		cli.addBlock(block, peer, true)
+	}
+	for block, peer = cli.Node.PopSyncBlock(); block != nil; block, peer = cli.Node.PopSyncBlock() {
+		cli.addBlock(block, peer, false)
+	}
+}
+
+func (cli *Cli) addBlock(block *blocks.Block, peer string, announce bool) {
+	// blocks downloaded by sync are not announced, peers behind us sync from us as well
+	tipChanged := cli.Blockchain.AddBlock(block, cli.UTXOSet)
+	if _, stored := cli.Blockchain.GetBlock(block.Hash); stored && !cli.Blockchain.IsInvalid(block.Hash) {
+		// orphans waiting for this block can be handled now
+		cli.BlockCache.ConnectOrphans(block.Hash)
+	} else {
+		// the block fails validation, or it is invalid once connected
+		cli.Node.Misbehave(peer, config.InvalidBlockScore, fmt.Sprintf("invalid block %x", block.Hash))
+		cli.Node.InvalidateSyncHeader(block.Hash)
+	}
+	if tipChanged {
+		cli.BlockCache.SetLastHash(cli.Blockchain.LastHash)
+		cli.RestartMining()
+		cli.RemoveMinedTXs(block)
+		cli.RevalidatePendingTXs()
+		if announce {
+			cli.Node.BroadcastBlockInv(block)
+		}
+	}
+}
+
+func (cli *Cli) HandleReorg(event *blockchain.ReorgEvent) {
+	// put transactions of disconnected blocks back into pending zone, unless
+	// they are also contained in the new chain
+	event.Log2Terminal()
+	connectedTxs := make(map[string]bool)
+	for _, block := range event.Connected {
+		for _, tx := range block.TransactionList {
+			connectedTxs[hex.EncodeToString(tx.TxID)] = true
+		}
+	}
+	// older blocks first, so that parents enter pending zone before their children
+	for blockIdx := len(event.Disconnected) - 1; blockIdx >= 0; blockIdx-- {
+		for _, tx := range event.Disconnected[blockIdx].TransactionList {
+			if tx.IsCoinbase() || connectedTxs[hex.EncodeToString(tx.TxID)] {
+				continue
+			}
+			txKey := "Reorg::" + string(utils.Base58Encode(tx.TxID[:8]))
+			if cli.PendingTxMap.AddTransaction(txKey, tx) == utils.TXAccepted {
+				fmt.Printf("Transaction %s returned to pending zone.\n", txKey)
+			}
 		}
 	}
+	for _, block := range event.Connected {
+		cli.RemoveMinedTXs(block)
+	}
 }
 
 func (cli *Cli) RemoveMinedTXs(block *blocks.Block) {
@@ -428,17 +1130,44 @@ func (cli *Cli) RemoveMinedTXs(block *blocks.Block) {
 	}
 }
 
+func (cli *Cli) RevalidatePendingTXs() {
+	// pending transactions may conflict with the new chain tip
+	dropped := cli.PendingTxMap.Revalidate()
+	if dropped > 0 {
+		fmt.Printf("Dropped %v pending transaction(s) that are no longer valid.\n", dropped)
+	}
+}
+
 func (cli *Cli) PrintHelp() {
 	fmt.Println("[1] print help              help")
 	fmt.Println("[2] create wallet           mk wallet [name]")
-	fmt.Println("    create new TX           mk tx -n [tx name] -s [sender name] -r [receiver name 1]:[amount 1] ...")
+	fmt.Println("    create change wallet    mk change [name]")
+	fmt.Println("    restore from mnemonic   restore wallet (-f) [word 1] [word 2] ...")
+	fmt.Println("    create new TX           mk tx -n [tx name] -s [sender name] (-f [fee]) -r [receiver name 1]:[amount 1] ...")
 	fmt.Println("    mine a new block        mine -n [miner name] -d [block description] -tx [tx name 1] ...")
+	fmt.Println("    stop mining             mine stop")
+	fmt.Println("    generate blocks         generate [count] [miner name]   (regtest)")
+	fmt.Println("    set chain time          mocktime [milliseconds]         (regtest)")
+	fmt.Println("    unlock wallets          unlock (-t [seconds])")
+	fmt.Println("    lock wallets            lock")
+	fmt.Println("    change passphrase       passphrase")
 	fmt.Println("[3] list wallet             ls wallet [name/all]")
+	fmt.Println("    print wallet mnemonic   ls mnemonic")
 	fmt.Println("    list peer syntax        ls peer [name/all]")
 	fmt.Println("    list all pending TXes   ls tx")
 	fmt.Println("    print whole chain       ls chain")
+	fmt.Println("    print a block           ls block [height]")
+	fmt.Println("    list received outputs   ls history [name]")
+	fmt.Println("    find a transaction      find tx [tx id]")
+	fmt.Println("    prove a transaction     mk proof [tx id]")
+	fmt.Println("    verify a proof          verify proof [proof]")
+	fmt.Println("    verify whole chain      verify chain")
+	fmt.Println("    rebuild UTXO & indexes  reindex")
 	fmt.Println("[4] ping a node             ping [ip] [port]")
 	fmt.Println("    broadcast user name     broadcast [user name]")
 	fmt.Println("    list known nodes        ls connection")
-	fmt.Println("[5] exit                    exit")
+	fmt.Println("    show sync progress      ls sync")
+	fmt.Println("[5] start RPC server        rpc start [port] (-t [token])")
+	fmt.Println("    stop RPC server         rpc stop")
+	fmt.Println("[6] exit                    exit")
 }
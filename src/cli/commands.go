@@ -0,0 +1,643 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/rpc"
+	"github.com/AntonyMei/Blockchain/src/wallet"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Non-interactive commands: 'node start' runs a node until it is interrupted, all other
+// commands run once against the RPC server of a running node and exit
+
+type command struct {
+	// path: words that select command, e.g. "wallet create"
+	path  string
+	usage string
+	run   func(args []string) error
+}
+
+// usageError makes a command exit with code 2
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func newUsageError(format string, args ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, args...)}
+}
+
+func commands() []command {
+	return []command{
+		{"node start", "run a node until interrupted", runNodeStart},
+		{"node peers", "list peers in connection pool", clientCommand("node peers", "getpeers")},
+		{"node sync", "show sync status", clientCommand("node sync", "getsyncstatus")},
+		{"node connect", "connect to a peer: --peer [host:port]", runNodeConnect},
+		{"chain info", "show height, best hash and difficulty of chain", clientCommand("chain info", "getblockchaininfo")},
+		{"chain block", "show a block: --height [height] | --hash [hash]", runChainBlock},
+		{"chain tx", "show a transaction: --id [tx id]", runChainTx},
+		{"wallet create", "create a wallet: --name [name] (--change)", runWalletCreate},
+		{"wallet list", "list wallets with balance", clientCommand("wallet list", "listwallets")},
+		{"wallet addresses", "list known addresses", clientCommand("wallet addresses", "listknownaddresses")},
+		{"wallet balance", "show balance: --name [wallet or known name] | --address [address]", runWalletBalance},
+		{"wallet history", "show history: --name [wallet or known name] | --address [address]", runWalletHistory},
+		{"wallet unlock", "unlock wallets, passphrase is asked for or read from stdin: (--passphrase-file [path]) (--timeout [seconds])", runWalletUnlock},
+		{"wallet lock", "lock wallets", clientCommand("wallet lock", "lock")},
+		{"tx send", "send a transaction: --from [wallet] --to [receiver=amount,...] (--fee [fee]) (--name [name])", runTxSend},
+		{"tx pending", "list pending transactions", clientCommand("tx pending", "listpending")},
+		{"mine", "mine a block: --miner [wallet] (--description [text]) (--tx [name,...])", runMine},
+		{"generate", "regtest: mine blocks on chain: --blocks [count] --to [wallet or known name] | --address [address]", runGenerate},
+		{"node mocktime", "regtest: set chain time: --time [milliseconds since epoch, 0 for system time]", runNodeMockTime},
+	}
+}
+
+func RunCommand(args []string) int {
+	// returns exit code: 0 on success, 1 if command fails and 2 on wrong usage
+	var matched *command
+	var rest []string
+	cmds := commands()
+	for idx := range cmds {
+		words := strings.Fields(cmds[idx].path)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmds[idx].path {
+			matched = &cmds[idx]
+			rest = args[len(words):]
+			break
+		}
+	}
+	if matched == nil {
+		if len(args) > 0 && args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(os.Stderr, "Unknown command %s.\n", strings.Join(args, " "))
+			PrintCommandUsage()
+			return 2
+		}
+		PrintCommandUsage()
+		return 0
+	}
+	err := matched.run(rest)
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		fmt.Fprintf(os.Stderr, "Run 'blockchain %s -h' for usage.\n", matched.path)
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		return 1
+	}
+}
+
+func PrintCommandUsage() {
+	fmt.Println("Usage: blockchain [command] [flags]")
+	fmt.Println("    (no command) | console    interactive mode")
+	for _, cmd := range commands() {
+		fmt.Printf("    %-23s%s\n", cmd.path, cmd.usage)
+	}
+	fmt.Println("Commands other than 'node start' talk to a running node, they take --datadir, --user,")
+	fmt.Println("--rpc and --rpc-token to find it, and --json to print results as JSON.")
+}
+
+// node
+
+func runNodeStart(args []string) error {
+	// flags that are given overwrite config file and environment
+	fs := flag.NewFlagSet("node start", flag.ContinueOnError)
+	configPath := addConfigFlag(fs)
+	datadir := fs.String("datadir", config.PersistentStoragePath, "directory that holds data of all users")
+	user := fs.String("user", "node", "user whose wallets, chain and peers are used")
+	listen := fs.String("listen", config.DefaultListenAddress, "address peers reach this node at, host:port")
+	peers := fs.String("peers", "", "peers to connect to, host:port,...")
+	rpcPort := fs.String("rpc-port", config.DefaultRPCPort, "port of RPC server on "+config.RPCHost+", empty to disable")
+	rpcToken := fs.String("rpc-token", "", "RPC auth token, random if empty")
+	chainSpec := fs.String("chain-spec", "", "YAML or JSON chain spec, replaces chain section of config")
+	regtest := fs.Bool("regtest", false, "join a local regtest chain instead, unless --chain-spec is given")
+	console := fs.Bool("console", false, "read interactive commands from stdin")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := validateUser(*user); err != nil {
+		return err
+	}
+	cfg, err := config.Resolve(*configPath, os.LookupEnv, func(cfg *config.Config) {
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "datadir":
+				cfg.DataDir = *datadir
+			case "chain-spec":
+				cfg.ChainSpec = *chainSpec
+			case "regtest":
+				if *regtest {
+					cfg.Chain = config.RegtestChainParams()
+				}
+			case "listen":
+				cfg.Network.Listen = *listen
+			case "peers":
+				cfg.Network.Peers = splitList(*peers)
+			case "rpc-port":
+				cfg.RPC.Port = *rpcPort
+			case "rpc-token":
+				cfg.RPC.Token = *rpcToken
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// premine addresses are checked here, so that a bad chain spec is an error instead of a panic
+	if _, err := blocks.GenesisTemplate(&cfg.Chain, cfg.Wallet); err != nil {
+		return err
+	}
+	userPath := cfg.UserPath(*user)
+	if err := os.MkdirAll(userPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	host, port := cfg.ListenAddress()
+	cli := InitializeCli(cfg, *user, host, port)
+	for _, peer := range cfg.Network.Peers {
+		peerHost, peerPort, _ := net.SplitHostPort(peer)
+		cli.Ping(peerHost, peerPort)
+	}
+	if cfg.RPC.Port != "" {
+		// the token is saved for commands run by the same user
+		token, err := cli.startRPC(cfg.RPC.Port, cfg.RPC.Token)
+		if err != nil {
+			cli.Exit()
+			return err
+		}
+		tokenPath := userPath + config.RPCTokenFileName
+		if err := ioutil.WriteFile(tokenPath, []byte(token), 0600); err != nil {
+			cli.Exit()
+			return err
+		}
+		defer os.Remove(tokenPath)
+		fmt.Printf("RPC server listening at %s, auth token saved in %s\n",
+			net.JoinHostPort(config.RPCHost, cfg.RPC.Port), tokenPath)
+	}
+	if *console {
+		cli.Loop(bufio.NewReader(os.Stdin))
+		return nil
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cli.Run(ctx)
+	fmt.Println("Node stopped.")
+	return nil
+}
+
+func runNodeConnect(args []string) error {
+	fs := flag.NewFlagSet("node connect", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	peer := fs.String("peer", "", "peer to connect to, host:port")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(*peer)
+	if err != nil {
+		return newUsageError("could not parse --peer %s", *peer)
+	}
+	return options.call("ping", rpc.PingParams{Ip: host, Port: port})
+}
+
+// chain
+
+func runChainBlock(args []string) error {
+	fs := flag.NewFlagSet("chain block", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	height := fs.Int("height", -1, "height of block on best chain")
+	hash := fs.String("hash", "", "hash of block")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*height < 0) == (*hash == "") {
+		return newUsageError("expect exactly one of --height and --hash")
+	}
+	params := rpc.GetBlockParams{Hash: *hash}
+	if *height >= 0 {
+		params.Height = *height
+	}
+	return options.call("getblock", params)
+}
+
+func runChainTx(args []string) error {
+	fs := flag.NewFlagSet("chain tx", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	txID := fs.String("id", "", "id of transaction")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlag("id", *txID); err != nil {
+		return err
+	}
+	return options.call("gettransaction", rpc.GetTransactionParams{TxID: *txID})
+}
+
+// wallet
+
+func runWalletCreate(args []string) error {
+	fs := flag.NewFlagSet("wallet create", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	name := fs.String("name", "", "name of new wallet")
+	change := fs.Bool("change", false, "derive wallet on change chain")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlag("name", *name); err != nil {
+		return err
+	}
+	return options.call("createwallet", rpc.CreateWalletParams{Name: *name, Change: *change})
+}
+
+func runWalletBalance(args []string) error {
+	return runAddressCommand("wallet balance", "getbalance", args)
+}
+
+func runWalletHistory(args []string) error {
+	return runAddressCommand("wallet history", "gethistory", args)
+}
+
+func runAddressCommand(path string, method string, args []string) error {
+	// commands that take a wallet or known name, or an address
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	options := addClientFlags(fs)
+	name := fs.String("name", "", "wallet or known address name")
+	address := fs.String("address", "", "address in hex")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*name == "") == (*address == "") {
+		return newUsageError("expect exactly one of --name and --address")
+	}
+	return options.call(method, rpc.GetBalanceParams{Name: *name, Address: *address})
+}
+
+func runWalletUnlock(args []string) error {
+	fs := flag.NewFlagSet("wallet unlock", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	passphraseFile := fs.String("passphrase-file", "", "file whose first line is passphrase of wallet file")
+	timeout := fs.Int("timeout", config.WalletUnlockTimeout, "seconds until wallets are locked again, 0 for never")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	// passphrase is never taken from command line, where other users and shell history see it
+	var passphrase string
+	if *passphraseFile != "" {
+		file, err := os.Open(*passphraseFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if passphrase, err = readLine(bufio.NewReader(file)); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if passphrase, err = readPassphrase("Passphrase: ", bufio.NewReader(os.Stdin)); err != nil {
+			return err
+		}
+	}
+	return options.call("unlock", rpc.UnlockParams{Passphrase: passphrase, Timeout: *timeout})
+}
+
+// transactions and mining
+
+func runTxSend(args []string) error {
+	fs := flag.NewFlagSet("tx send", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	from := fs.String("from", "", "wallet that pays")
+	to := fs.String("to", "", "receivers with amounts, receiver=amount,..., receiver is a known name or an address")
+	fee := fs.Int("fee", 0, "transaction fee")
+	name := fs.String("name", "tx", "name of transaction in pending zone")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlag("from", *from); err != nil {
+		return err
+	}
+	if err := requireFlag("to", *to); err != nil {
+		return err
+	}
+	cfg, err := options.config()
+	if err != nil {
+		return err
+	}
+	var payments []rpc.Payment
+	for _, item := range splitList(*to) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return newUsageError("expect receiver=amount, got %s", item)
+		}
+		amount, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return newUsageError("could not parse amount %s", parts[1])
+		}
+		payments = append(payments, newPayment(parts[0], amount, cfg.Wallet))
+	}
+	return options.call("sendtransaction", rpc.SendTransactionParams{Name: *name, From: *from, To: payments, Fee: *fee})
+}
+
+func newPayment(receiver string, amount int, addressFormat config.WalletParams) rpc.Payment {
+	// receiver is an address if it decodes into one, otherwise a known name
+	if decoded, err := hex.DecodeString(receiver); err == nil && wallet.ValidateAddress(decoded, addressFormat) {
+		return rpc.Payment{Address: receiver, Amount: amount}
+	}
+	return rpc.Payment{Name: receiver, Amount: amount}
+}
+
+func runMine(args []string) error {
+	fs := flag.NewFlagSet("mine", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	miner := fs.String("miner", "", "wallet that receives mining reward")
+	description := fs.String("description", "", "data of block")
+	txs := fs.String("tx", "", "names of pending transactions, name,..., picked by fee rate if empty")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := requireFlag("miner", *miner); err != nil {
+		return err
+	}
+	return options.call("mine", rpc.MineParams{Miner: *miner, Description: *description, Transactions: splitList(*txs)})
+}
+
+func runGenerate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	count := fs.Int("blocks", 1, "number of blocks")
+	name := fs.String("to", "", "wallet or known address name that receives mining reward")
+	address := fs.String("address", "", "address in hex that receives mining reward")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*name == "") == (*address == "") {
+		return newUsageError("expect exactly one of --to and --address")
+	}
+	if *count <= 0 {
+		return newUsageError("--blocks must be positive")
+	}
+	return options.call("generate", rpc.GenerateParams{Blocks: *count, Name: *name, Address: *address})
+}
+
+func runNodeMockTime(args []string) error {
+	fs := flag.NewFlagSet("node mocktime", flag.ContinueOnError)
+	options := addClientFlags(fs)
+	milliseconds := fs.Int64("time", -1, "milliseconds since epoch, 0 for system time")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *milliseconds < 0 {
+		return newUsageError("--time is required and must not be negative")
+	}
+	return options.call("setmocktime", rpc.SetMockTimeParams{Time: *milliseconds})
+}
+
+// helpers
+
+type clientOptions struct {
+	configPath *string
+	datadir    *string
+	user       *string
+	address    *string
+	token      *string
+	asJSON     *bool
+	fs         *flag.FlagSet
+}
+
+func addClientFlags(fs *flag.FlagSet) *clientOptions {
+	return &clientOptions{
+		configPath: addConfigFlag(fs),
+		datadir:    fs.String("datadir", config.PersistentStoragePath, "directory that holds data of all users"),
+		user:       fs.String("user", "node", "user whose node is called, its token file is read"),
+		address:    fs.String("rpc", "", "address of RPC server, port of config on "+config.RPCHost+" if empty"),
+		token:      fs.String("rpc-token", "", "RPC auth token, from config or token file of user if empty"),
+		asJSON:     fs.Bool("json", false, "print result as JSON"),
+		fs:         fs,
+	}
+}
+
+func (o *clientOptions) config() (*config.Config, error) {
+	// config of the node that is called
+	return config.Resolve(*o.configPath, os.LookupEnv, func(cfg *config.Config) {
+		o.fs.Visit(func(f *flag.Flag) {
+			if f.Name == "datadir" {
+				cfg.DataDir = *o.datadir
+			}
+		})
+	})
+}
+
+func (o *clientOptions) call(method string, params interface{}) error {
+	// call method on RPC server and print its result
+	if err := validateUser(*o.user); err != nil {
+		return err
+	}
+	cfg, err := o.config()
+	if err != nil {
+		return err
+	}
+	address := *o.address
+	if address == "" {
+		if cfg.RPC.Port == "" {
+			return errors.New("rpc server is disabled in config and no --rpc is given")
+		}
+		address = net.JoinHostPort(config.RPCHost, cfg.RPC.Port)
+	}
+	token := *o.token
+	if token == "" {
+		token = cfg.RPC.Token
+	}
+	if token == "" {
+		content, err := ioutil.ReadFile(cfg.UserPath(*o.user) + config.RPCTokenFileName)
+		if err != nil {
+			return fmt.Errorf("no --rpc-token and could not read token file (is node running?): %v", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	client := rpc.NewClient(address, token, time.Duration(config.RPCClientTimeout)*time.Millisecond)
+	var result json.RawMessage
+	if err := client.Call(method, params, &result); err != nil {
+		return err
+	}
+	return printResult(result, *o.asJSON)
+}
+
+func addConfigFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv(config.EnvPrefix+"_CONFIG"), "YAML or JSON config file")
+}
+
+func clientCommand(path string, method string) func(args []string) error {
+	// commands that only take client flags and call a method without params
+	return func(args []string) error {
+		fs := flag.NewFlagSet(path, flag.ContinueOnError)
+		options := addClientFlags(fs)
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		return options.call(method, nil)
+	}
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	// flag package prints its own message, so usage errors are only counted
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return newUsageError("%v", err)
+	}
+	if fs.NArg() > 0 {
+		return newUsageError("unexpected argument %s", fs.Arg(0))
+	}
+	return nil
+}
+
+func requireFlag(name string, value string) error {
+	if value == "" {
+		return newUsageError("--%s is required", name)
+	}
+	return nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func validateUser(user string) error {
+	// data of user is at [datadir]/[user]
+	if user == "" || strings.ContainsAny(user, `/\`) || user == "." || user == ".." {
+		return newUsageError("invalid user %s", user)
+	}
+	return nil
+}
+
+// output
+
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+func printResult(result json.RawMessage, asJSON bool) error {
+	// human readable output keeps the order of fields in result
+	if asJSON {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, result, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(indented.String())
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(result))
+	decoder.UseNumber()
+	value, err := decodeOrdered(decoder)
+	if err != nil {
+		return err
+	}
+	printValue(value, "")
+	return nil
+}
+
+func decodeOrdered(decoder *json.Decoder) (interface{}, error) {
+	// objects become []jsonField, arrays []interface{}
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+	if delim == '{' {
+		fields := []jsonField{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, jsonField{key: fmt.Sprint(key), value: value})
+		}
+		_, err = decoder.Token()
+		return fields, err
+	}
+	values := []interface{}{}
+	for decoder.More() {
+		value, err := decodeOrdered(decoder)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	_, err = decoder.Token()
+	return values, err
+}
+
+func printValue(value interface{}, indent string) {
+	switch v := value.(type) {
+	case nil:
+		// methods without result
+	case []jsonField:
+		for _, field := range v {
+			switch child := field.value.(type) {
+			case []jsonField:
+				fmt.Printf("%s%s:\n", indent, field.key)
+				printValue(child, indent+"    ")
+			case []interface{}:
+				if len(child) == 0 {
+					fmt.Printf("%s%s: none\n", indent, field.key)
+				} else {
+					fmt.Printf("%s%s:\n", indent, field.key)
+					printValue(child, indent+"    ")
+				}
+			default:
+				fmt.Printf("%s%s: %v\n", indent, field.key, child)
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 && indent == "" {
+			fmt.Println("none")
+		}
+		for idx, item := range v {
+			if _, isObject := item.([]jsonField); !isObject {
+				printValue(item, indent)
+				continue
+			}
+			if idx > 0 {
+				fmt.Println()
+			}
+			printValue(item, indent)
+		}
+	default:
+		fmt.Printf("%s%v\n", indent, v)
+	}
+}
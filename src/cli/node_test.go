@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/wallet"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) string {
+	// a port nothing listens on right now
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+func startTestNode(t *testing.T, cfg *config.Config, userName string, port string) (*Cli, func()) {
+	// node of userName with a wallet of the same name runs in background like 'node start',
+	// stop exits it and waits until it is gone
+	if err := os.MkdirAll(cfg.UserPath(userName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cli := InitializeCli(cfg, userName, "localhost", port)
+	if _, err := cli.createWallet(userName, wallet.ReceiveChain); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		cli.Run(ctx)
+		close(done)
+	}()
+	return cli, func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitForTip(t *testing.T, from *Cli, to *Cli) {
+	// wait until to has the same best chain as from
+	expected := from.Blockchain.Tip()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if tip := to.Blockchain.Tip(); bytes.Equal(tip.Hash, expected.Hash) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("chain is not synced: height %v, expect %v", to.Blockchain.Tip().Height, expected.Height)
+}
+
+func TestRegtestNodesSync(t *testing.T) {
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	cfg.Chain = config.RegtestChainParams()
+	alicePort, bobPort := freePort(t), freePort(t)
+	alice, stopAlice := startTestNode(t, cfg, "alice", alicePort)
+	bob, stopBob := startTestNode(t, cfg, "bob", bobPort)
+
+	// bob is behind alice when they connect, so headers and blocks are synced first
+	miner := alice.Wallets.GetWallet("alice")
+	if _, err := alice.generateBlocks(5, miner.Address(alice.Wallets.Params)); err != nil {
+		t.Fatal(err)
+	}
+	bob.Ping("localhost", alicePort)
+	waitForTip(t, alice, bob)
+
+	// new blocks of alice are announced afterwards
+	if _, err := alice.generateBlocks(2, miner.Address(alice.Wallets.Params)); err != nil {
+		t.Fatal(err)
+	}
+	waitForTip(t, alice, bob)
+
+	// ports are free once nodes are stopped
+	stopBob()
+	stopAlice()
+	for _, port := range []string{alicePort, bobPort} {
+		listener, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			t.Fatalf("port %s is not released: %v", port, err)
+		}
+		listener.Close()
+	}
+}
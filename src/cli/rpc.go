@@ -0,0 +1,391 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/network"
+	"github.com/AntonyMei/Blockchain/src/rpc"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/AntonyMei/Blockchain/src/wallet"
+	"net"
+	"time"
+)
+
+// RPC methods do what the commands of the same name do, but return typed results
+
+func (cli *Cli) StartRPC(port string, token string) {
+	// a random token is generated if none is given
+	token, err := cli.startRPC(port, token)
+	if err != nil {
+		fmt.Printf("Error: %v.\n", err)
+		return
+	}
+	fmt.Printf("RPC server listening at %s, auth token: %s\n", net.JoinHostPort(config.RPCHost, port), token)
+}
+
+func (cli *Cli) startRPC(port string, token string) (string, error) {
+	// returns the token server accepts
+	if cli.rpcServer != nil {
+		return "", errors.New("rpc server is running")
+	}
+	if token == "" {
+		randomToken := make([]byte, config.RPCTokenLength)
+		_, err := rand.Read(randomToken)
+		utils.Handle(err)
+		token = hex.EncodeToString(randomToken)
+	}
+	server := rpc.NewServer(token)
+	cli.registerRPCMethods(server)
+	if err := server.Start(net.JoinHostPort(config.RPCHost, port)); err != nil {
+		return "", err
+	}
+	cli.rpcServer = server
+	return token, nil
+}
+
+func (cli *Cli) StopRPC() {
+	if cli.rpcServer == nil {
+		fmt.Printf("Error: rpc server is not running.\n")
+		return
+	}
+	if err := cli.rpcServer.Stop(); err != nil {
+		fmt.Printf("Error: %v.\n", err)
+	}
+	cli.rpcServer = nil
+	fmt.Printf("RPC server stopped.\n")
+}
+
+func (cli *Cli) registerRPCMethods(server *rpc.Server) {
+	// chain
+	server.Register("getblockchaininfo", cli.rpcGetBlockchainInfo)
+	server.Register("getblock", cli.rpcGetBlock)
+	server.Register("gettransaction", cli.rpcGetTransaction)
+	// wallets
+	server.Register("listwallets", cli.rpcListWallets)
+	server.Register("createwallet", cli.rpcCreateWallet)
+	server.Register("listknownaddresses", cli.rpcListKnownAddresses)
+	server.Register("getbalance", cli.rpcGetBalance)
+	server.Register("gethistory", cli.rpcGetHistory)
+	server.Register("unlock", cli.rpcUnlock)
+	server.Register("lock", cli.rpcLock)
+	// pending zone and mining
+	server.Register("sendtransaction", cli.rpcSendTransaction)
+	server.Register("listpending", cli.rpcListPending)
+	server.Register("mine", cli.rpcMine)
+	server.Register("stopmining", cli.rpcStopMining)
+	// regtest
+	server.Register("generate", cli.rpcGenerate)
+	server.Register("setmocktime", cli.rpcSetMockTime)
+	// network
+	server.Register("getpeers", cli.rpcGetPeers)
+	server.Register("getsyncstatus", cli.rpcGetSyncStatus)
+	server.Register("ping", cli.rpcPing)
+}
+
+func decodeHex(name string, value string) ([]byte, error) {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, rpc.NewError(rpc.InvalidParams, "could not parse %s %s", name, value)
+	}
+	return decoded, nil
+}
+
+func (cli *Cli) resolveAddress(name string, address string) ([]byte, error) {
+	// name can be either a wallet of ours or a known address, address is used if name is empty
+	if name != "" {
+		if res := cli.Wallets.GetWallet(name); res != nil {
+			return res.Address(cli.Wallets.Params), nil
+		}
+		return cli.knownAddress(name)
+	}
+	decoded, err := decodeHex("address", address)
+	if err != nil {
+		return nil, err
+	}
+	if !wallet.ValidateAddress(decoded, cli.Wallets.Params) {
+		return nil, rpc.NewError(rpc.InvalidParams, "address %s is invalid", address)
+	}
+	return decoded, nil
+}
+
+func (cli *Cli) rpcGetBlockchainInfo(params json.RawMessage) (interface{}, error) {
+	// handlers run on goroutines of RPC server, so tip is read as a snapshot
+	tip := cli.Blockchain.Tip()
+	return rpc.BlockchainInfo{Height: tip.Height, BestHash: hex.EncodeToString(tip.Hash),
+		Difficulty: tip.Difficulty, Work: cli.Blockchain.GetCumulativeWork(tip.Hash).String()}, nil
+}
+
+func (cli *Cli) rpcGetBlock(params json.RawMessage) (interface{}, error) {
+	var p rpc.GetBlockParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	var block *blocks.Block
+	var found bool
+	if p.Hash != "" {
+		hash, err := decodeHex("hash", p.Hash)
+		if err != nil {
+			return nil, err
+		}
+		block, found = cli.Blockchain.GetBlock(hash)
+	} else {
+		block, found = cli.Blockchain.GetBlockByHeight(p.Height)
+	}
+	if !found {
+		return nil, errors.New("block not found")
+	}
+	return rpc.NewBlockResult(block), nil
+}
+
+func (cli *Cli) rpcGetTransaction(params json.RawMessage) (interface{}, error) {
+	var p rpc.GetTransactionParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	txID, err := decodeHex("tx id", p.TxID)
+	if err != nil {
+		return nil, err
+	}
+	if txKey, tx := cli.PendingTxMap.GetTxByID(txID); tx != nil {
+		return rpc.GetTransactionResult{Transaction: rpc.NewTransactionResult(tx), Pending: true, Name: txKey}, nil
+	}
+	tx, block, found := cli.Blockchain.FindTransaction(txID)
+	if !found {
+		return nil, fmt.Errorf("no transaction with id %s", p.TxID)
+	}
+	return rpc.GetTransactionResult{Transaction: rpc.NewTransactionResult(tx),
+		BlockHash: hex.EncodeToString(block.Hash), BlockHeight: block.Height}, nil
+}
+
+func (cli *Cli) rpcListWallets(params json.RawMessage) (interface{}, error) {
+	results := []rpc.WalletResult{}
+	for _, name := range cli.Wallets.GetAllWalletNames() {
+		res := cli.Wallets.GetWallet(name)
+		address := res.Address(cli.Wallets.Params)
+		results = append(results, rpc.WalletResult{Name: name, Address: hex.EncodeToString(address),
+			Path: res.Path, Balance: cli.UTXOSet.GetBalance(wallet.AddressToPubKeyHash(address))})
+	}
+	return results, nil
+}
+
+func (cli *Cli) rpcCreateWallet(params json.RawMessage) (interface{}, error) {
+	var p rpc.CreateWalletParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	chain := wallet.ReceiveChain
+	if p.Change {
+		chain = wallet.ChangeChain
+	}
+	res, err := cli.createWallet(p.Name, uint32(chain))
+	if err != nil {
+		return nil, err
+	}
+	return rpc.WalletResult{Name: p.Name, Address: hex.EncodeToString(res.Address(cli.Wallets.Params)),
+		Path: res.Path}, nil
+}
+
+func (cli *Cli) rpcListKnownAddresses(params json.RawMessage) (interface{}, error) {
+	results := []rpc.KnownAddressResult{}
+	names, addresses := cli.Wallets.GetAllKnownAddress()
+	for idx, name := range names {
+		results = append(results, rpc.KnownAddressResult{Name: name, Address: hex.EncodeToString(addresses[idx].Address)})
+	}
+	return results, nil
+}
+
+func (cli *Cli) rpcGetBalance(params json.RawMessage) (interface{}, error) {
+	var p rpc.GetBalanceParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	address, err := cli.resolveAddress(p.Name, p.Address)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.BalanceResult{Address: hex.EncodeToString(address), Balance: cli.UTXOSet.GetBalance(wallet.AddressToPubKeyHash(address))}, nil
+}
+
+func (cli *Cli) rpcGetHistory(params json.RawMessage) (interface{}, error) {
+	var p rpc.GetHistoryParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	address, err := cli.resolveAddress(p.Name, p.Address)
+	if err != nil {
+		return nil, err
+	}
+	results := []rpc.HistoryEntry{}
+	for _, outpoint := range cli.Blockchain.GetAddressHistory(wallet.AddressToPubKeyHash(address)) {
+		tx, block, found := cli.Blockchain.FindTransaction(outpoint.TxID)
+		if !found {
+			continue
+		}
+		results = append(results, rpc.HistoryEntry{Height: block.Height, TxID: hex.EncodeToString(outpoint.TxID),
+			TxOutputIdx: outpoint.TxOutputIdx, Value: tx.TxOutputList[outpoint.TxOutputIdx].Value})
+	}
+	return results, nil
+}
+
+func (cli *Cli) rpcUnlock(params json.RawMessage) (interface{}, error) {
+	var p rpc.UnlockParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	return nil, cli.Wallets.Unlock(p.Passphrase, time.Duration(p.Timeout)*time.Second)
+}
+
+func (cli *Cli) rpcLock(params json.RawMessage) (interface{}, error) {
+	cli.Wallets.Lock()
+	return nil, nil
+}
+
+func (cli *Cli) rpcSendTransaction(params json.RawMessage) (interface{}, error) {
+	var p rpc.SendTransactionParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p.To) == 0 {
+		return nil, rpc.NewError(rpc.InvalidParams, "no receiver")
+	}
+	var toAddrList [][]byte
+	var amountList []int
+	for _, payment := range p.To {
+		var address []byte
+		var err error
+		if payment.Name != "" {
+			address, err = cli.knownAddress(payment.Name)
+		} else {
+			address, err = cli.resolveAddress("", payment.Address)
+		}
+		if err != nil {
+			return nil, err
+		}
+		toAddrList = append(toAddrList, address)
+		amountList = append(amountList, payment.Amount)
+	}
+	txKey, tx, err := cli.sendTransaction(p.Name, p.From, toAddrList, amountList, p.Fee)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.SendTransactionResult{Name: txKey, TxID: hex.EncodeToString(tx.TxID)}, nil
+}
+
+func (cli *Cli) rpcListPending(params json.RawMessage) (interface{}, error) {
+	results := []rpc.PendingTransactionResult{}
+	for _, entry := range cli.PendingTxMap.GetAllEntries() {
+		results = append(results, rpc.PendingTransactionResult{Name: entry.Key, TxID: hex.EncodeToString(entry.Tx.TxID),
+			Size: entry.Size, Fee: entry.Fee, ArrivalTime: entry.ArrivalTime})
+	}
+	return results, nil
+}
+
+func (cli *Cli) rpcMine(params json.RawMessage) (interface{}, error) {
+	// returns once mining ends, the block joins chain shortly after
+	var p rpc.MineParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	block, status, err := cli.mineBlock(p.Miner, p.Description, p.Transactions)
+	if err != nil {
+		return nil, err
+	}
+	result := rpc.MineResult{Status: status.String()}
+	if block != nil {
+		result.Hash = hex.EncodeToString(block.Hash)
+		result.Height = block.Height
+	}
+	return result, nil
+}
+
+func (cli *Cli) rpcStopMining(params json.RawMessage) (interface{}, error) {
+	cli.StopMining()
+	return nil, nil
+}
+
+func (cli *Cli) rpcGenerate(params json.RawMessage) (interface{}, error) {
+	// returns once all blocks are on chain
+	var p rpc.GenerateParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Blocks <= 0 {
+		return nil, rpc.NewError(rpc.InvalidParams, "blocks must be positive")
+	}
+	address, err := cli.resolveAddress(p.Name, p.Address)
+	if err != nil {
+		return nil, err
+	}
+	generated, err := cli.generateBlocks(p.Blocks, address)
+	if err != nil {
+		return nil, err
+	}
+	result := rpc.GenerateResult{Hashes: []string{}, Height: cli.Blockchain.Tip().Height}
+	for _, block := range generated {
+		result.Hashes = append(result.Hashes, hex.EncodeToString(block.Hash))
+	}
+	return result, nil
+}
+
+func (cli *Cli) rpcSetMockTime(params json.RawMessage) (interface{}, error) {
+	var p rpc.SetMockTimeParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Time < 0 {
+		return nil, rpc.NewError(rpc.InvalidParams, "time must not be negative")
+	}
+	return nil, cli.setMockTime(p.Time)
+}
+
+func (cli *Cli) rpcGetPeers(params json.RawMessage) (interface{}, error) {
+	connections := make(map[string]network.ConnectionInfo)
+	for _, info := range cli.Node.GetConnections() {
+		connections[info.Meta.Address()] = info
+	}
+	heights := make(map[string]int)
+	for _, peer := range cli.Node.GetSyncStatus().Peers {
+		heights[peer.Address] = peer.Height
+	}
+	results := []rpc.PeerResult{}
+	for _, peer := range cli.Node.ConnectionPool.GetPeers() {
+		address := peer.Meta.Address()
+		result := rpc.PeerResult{Address: address, Source: peer.Source.String(), RTT: peer.RTT.Microseconds(),
+			Failures: peer.Failures, Height: heights[address]}
+		if !peer.LastSeen.IsZero() {
+			result.LastSeen = peer.LastSeen.UnixMilli()
+		}
+		if info, connected := connections[address]; connected {
+			result.Connected = true
+			result.Inbound = info.Inbound
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (cli *Cli) rpcGetSyncStatus(params json.RawMessage) (interface{}, error) {
+	status := cli.Node.GetSyncStatus()
+	result := rpc.SyncStatusResult{ChainHeight: status.ChainHeight, HeaderHeight: status.HeaderHeight,
+		SyncPeer: status.SyncPeer, InFlight: status.InFlight, Downloaded: status.Downloaded,
+		Peers: []rpc.PeerSyncResult{}}
+	for _, peer := range status.Peers {
+		result.Peers = append(result.Peers, rpc.PeerSyncResult{Address: peer.Address, Height: peer.Height,
+			InFlight: peer.InFlight, Stalled: peer.Stalled})
+	}
+	return result, nil
+}
+
+func (cli *Cli) rpcPing(params json.RawMessage) (interface{}, error) {
+	var p rpc.PingParams
+	if err := rpc.DecodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	cli.Ping(p.Ip, p.Port)
+	return nil, nil
+}
@@ -1,58 +1,253 @@
 package network
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"sort"
 	"sync"
-	"fmt"
+	"time"
 )
 
+type PeerInfo struct {
+	// LastSeen: when we last heard from peer, zero if never
+	// LastAttempt: when dialing or sending to peer last failed
+	// Failures: failed dials and sends in a row, RTT: smoothed round trip time of handshakes
+	Meta        NetworkMetaData
+	Source      utils.PeerSource
+	LastSeen    time.Time
+	LastAttempt time.Time
+	RTT         time.Duration
+	Failures    int
+}
+
+func (info *PeerInfo) weight() float64 {
+	// reliable peers are picked more often: failures and slow round trips lower the weight,
+	// and peers we never heard from count half
+	weight := 1.0 / float64(1+info.Failures)
+	if info.LastSeen.IsZero() {
+		weight /= 2
+	}
+	if info.RTT > 0 {
+		weight /= 1 + float64(info.RTT)/float64(100*time.Millisecond)
+	}
+	return weight
+}
+
+func (info *PeerInfo) available(now time.Time) bool {
+	// after a failure, peer is not tried again until backoff ends
+	if info.Failures == 0 {
+		return true
+	}
+	backoff := time.Duration(config.PeerRetryBackoff) * time.Millisecond << (info.Failures - 1)
+	return now.Sub(info.LastAttempt) >= backoff
+}
+
 type ConnectionPool struct {
-	pool []NetworkMetaData
-	mu sync.RWMutex
+	// peers: address book keyed by address peers listen on
+	// self: addresses of node itself, they are never added
+	// path: where address book is saved, maxSize: bound of address book
+	peers   map[string]*PeerInfo
+	self    map[string]bool
+	path    string
+	maxSize int
+	mu      sync.RWMutex
 }
 
-func InitializeConnectionPool() *ConnectionPool {
-	cp := ConnectionPool{}
+func InitializeConnectionPool(self NetworkMetaData, path string, maxSize int) *ConnectionPool {
+	cp := ConnectionPool{peers: make(map[string]*PeerInfo), self: map[string]bool{self.Address(): true}, path: path,
+		maxSize: maxSize}
 	return &cp
 }
 
-func (cp *ConnectionPool) AddPeer(peer_meta NetworkMetaData) bool {
+func (cp *ConnectionPool) AddPeer(peer_meta NetworkMetaData, source utils.PeerSource) bool {
+	// returns whether peer is new, a full pool makes room by removing its least reliable
+	// peer among those that have failed or never been heard from
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	for _, meta := range cp.pool {
-		if(meta.Ip == peer_meta.Ip && meta.Port == peer_meta.Port) {
+	address := peer_meta.Address()
+	if _, exists := cp.peers[address]; exists || cp.self[address] {
+		return false
+	}
+	if len(cp.peers) >= cp.maxSize {
+		var worst *PeerInfo
+		for _, info := range cp.peers {
+			if info.Failures == 0 && !info.LastSeen.IsZero() {
+				continue
+			}
+			if worst == nil || info.weight() < worst.weight() {
+				worst = info
+			}
+		}
+		if worst == nil {
 			return false
 		}
-	  }
-	cp.pool = append(cp.pool, peer_meta)
+		delete(cp.peers, worst.Meta.Address())
+	}
+	cp.peers[address] = &PeerInfo{Meta: peer_meta, Source: source}
 	return true
 }
 
 func (cp *ConnectionPool) ExistsPeer(peer_meta NetworkMetaData) bool {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	_, exists := cp.peers[peer_meta.Address()]
+	return exists
+}
+
+func (cp *ConnectionPool) RemovePeer(address string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	delete(cp.peers, address)
+}
+
+func (cp *ConnectionPool) MarkSelf(address string) {
+	// another address of node itself, e.g. learned from peers
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	delete(cp.peers, address)
+	cp.self[address] = true
+}
+
+func (cp *ConnectionPool) MarkSeen(address string, rtt time.Duration) {
+	// rtt is 0 if there is no new sample
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	info, exists := cp.peers[address]
+	if !exists {
+		return
+	}
+	info.LastSeen = time.Now()
+	info.Failures = 0
+	if rtt > 0 {
+		if info.RTT == 0 {
+			info.RTT = rtt
+		} else {
+			info.RTT = (3*info.RTT + rtt) / 4
+		}
+	}
+}
+
+func (cp *ConnectionPool) MarkFailure(address string) {
+	// peers that fail MaxPeerFailures times in a row are removed
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
-	for _, meta := range cp.pool {
-		if(meta.Ip == peer_meta.Ip && meta.Port == peer_meta.Port) {
-		  return true
+	info, exists := cp.peers[address]
+	if !exists {
+		return
+	}
+	info.Failures += 1
+	info.LastAttempt = time.Now()
+	if info.Failures >= config.MaxPeerFailures {
+		delete(cp.peers, address)
+		fmt.Printf("Peer %s removed after %d failures.\n", address, info.Failures)
+	}
+}
+
+func (cp *ConnectionPool) EvictStale(connected map[string]bool) int {
+	// remove peers that are not connected and have not been heard from for PeerExpiry
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	expiry := time.Duration(config.PeerExpiry) * time.Millisecond
+	evicted := 0
+	for address, info := range cp.peers {
+		if !connected[address] && !info.LastSeen.IsZero() && time.Since(info.LastSeen) > expiry {
+			delete(cp.peers, address)
+			evicted += 1
 		}
-	  }
-	return false
+	}
+	return evicted
 }
 
 func (cp *ConnectionPool) GetAlivePeers(count int) []NetworkMetaData {
+	// pick at most count distinct peers, weighted by reliability, peers waiting for retry
+	// after a failure are skipped
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
+	type candidate struct {
+		meta NetworkMetaData
+		key  float64
+	}
+	var candidates []candidate
+	now := time.Now()
+	for _, info := range cp.peers {
+		if !info.available(now) {
+			continue
+		}
+		// weighted sampling without replacement, larger keys win
+		key := math.Pow(rand.Float64(), 1/info.weight())
+		candidates = append(candidates, candidate{meta: info.Meta, key: key})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].key > candidates[j].key
+	})
 	var picked_peers []NetworkMetaData
-	for i := 0; i < count; i++ {
-		randomIndex := rand.Intn(len(cp.pool))
-		picked_peers = append(picked_peers, cp.pool[randomIndex])
+	for idx := 0; idx < len(candidates) && idx < count; idx++ {
+		picked_peers = append(picked_peers, candidates[idx].meta)
 	}
 	return picked_peers
 }
 
+func (cp *ConnectionPool) GetPeers() []PeerInfo {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	var peers []PeerInfo
+	for _, info := range cp.peers {
+		peers = append(peers, *info)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Meta.Address() < peers[j].Meta.Address()
+	})
+	return peers
+}
+
 func (cp *ConnectionPool) ShowPool() {
-	fmt.Printf("Found %d peers in connection pool.\n", len(cp.pool))
-	for _, peer := range cp.pool {
-		fmt.Printf("    Ip=%s, Port=%s\n", peer.Ip, peer.Port)
+	peers := cp.GetPeers()
+	fmt.Printf("Found %d peers in connection pool.\n", len(peers))
+	for _, peer := range peers {
+		lastSeen := "never"
+		if !peer.LastSeen.IsZero() {
+			lastSeen = time.Since(peer.LastSeen).Round(time.Second).String() + " ago"
+		}
+		fmt.Printf("    Ip=%s, Port=%s, source=%s, last seen %s, rtt=%v, failures=%d\n", peer.Meta.Ip,
+			peer.Meta.Port, peer.Source.String(), lastSeen, peer.RTT.Round(time.Microsecond), peer.Failures)
 	}
-}
\ No newline at end of file
+}
+
+func (cp *ConnectionPool) SaveFile() {
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(cp.GetPeers())
+	utils.Handle(err)
+	err = ioutil.WriteFile(cp.path, content.Bytes(), 0644)
+	utils.Handle(err)
+}
+
+func (cp *ConnectionPool) LoadFile() error {
+	// peers in address book are dialed again as they are picked
+	if _, err := os.Stat(cp.path); os.IsNotExist(err) {
+		return err
+	}
+	fileContent, err := ioutil.ReadFile(cp.path)
+	utils.Handle(err)
+	var peers []PeerInfo
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&peers); err != nil {
+		return err
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for idx := range peers {
+		address := peers[idx].Meta.Address()
+		if !cp.self[address] && len(cp.peers) < cp.maxSize {
+			cp.peers[address] = &peers[idx]
+		}
+	}
+	return nil
+}
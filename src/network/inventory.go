@@ -0,0 +1,213 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/transaction"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"time"
+)
+
+// transactions and blocks are announced by hash with inv messages, peers that lack them
+// ask for bodies with getdata; we remember what each peer knows so that nothing is
+// announced back to where it comes from
+
+const (
+	InvTX = iota
+	InvBlock
+)
+
+type InvItem struct {
+	Type int
+	Hash []byte
+}
+
+func (item InvItem) key() string {
+	return string(rune('0'+item.Type)) + string(item.Hash)
+}
+
+type inventorySet struct {
+	// items are forgotten in the order they are added once there are MaxKnownInventory of them
+	items map[string]bool
+	order []string
+}
+
+func (set *inventorySet) add(key string) {
+	if set.items[key] {
+		return
+	}
+	if len(set.order) >= config.MaxKnownInventory {
+		delete(set.items, set.order[0])
+		set.order = set.order[1:]
+	}
+	set.items[key] = true
+	set.order = append(set.order, key)
+}
+
+func (nd *Node) markKnown(address string, item InvItem) {
+	nd.invMu.Lock()
+	defer nd.invMu.Unlock()
+	set, ok := nd.knownInventory[address]
+	if !ok {
+		set = &inventorySet{items: make(map[string]bool)}
+		nd.knownInventory[address] = set
+	}
+	set.add(item.key())
+}
+
+func (nd *Node) isKnown(address string, item InvItem) bool {
+	nd.invMu.Lock()
+	defer nd.invMu.Unlock()
+	set, ok := nd.knownInventory[address]
+	return ok && set.items[item.key()]
+}
+
+func (nd *Node) startRequest(item InvItem) bool {
+	// returns false if item has been asked from some peer recently
+	nd.invMu.Lock()
+	defer nd.invMu.Unlock()
+	timeout := time.Duration(config.GetDataTimeout) * time.Millisecond
+	if len(nd.requested) >= config.MaxKnownInventory {
+		// forget requests that are never answered
+		for key, requestTime := range nd.requested {
+			if time.Since(requestTime) >= timeout {
+				delete(nd.requested, key)
+			}
+		}
+	}
+	if requestTime, ok := nd.requested[item.key()]; ok && time.Since(requestTime) < timeout {
+		return false
+	}
+	nd.requested[item.key()] = time.Now()
+	return true
+}
+
+func (nd *Node) isRequested(item InvItem) bool {
+	nd.invMu.Lock()
+	defer nd.invMu.Unlock()
+	requestTime, ok := nd.requested[item.key()]
+	return ok && time.Since(requestTime) < time.Duration(config.GetDataTimeout)*time.Millisecond
+}
+
+func (nd *Node) finishRequest(item InvItem) {
+	nd.invMu.Lock()
+	defer nd.invMu.Unlock()
+	delete(nd.requested, item.key())
+}
+
+func (nd *Node) hasItem(item InvItem) bool {
+	if item.Type == InvBlock {
+		_, found := nd.Chain.GetBlock(item.Hash)
+		return found || nd.Chain.IsInvalid(item.Hash)
+	}
+	if _, tx := nd.CliGetTx(item.Hash); tx != nil {
+		return true
+	}
+	_, _, found := nd.Chain.FindTransaction(item.Hash)
+	return found
+}
+
+func (nd *Node) SendInvMessage(meta NetworkMetaData, items []InvItem) {
+	msg := CreateInvMessage(nd.Meta, items)
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(msg))
+
+	nd.SendMessage("inv", meta, &result)
+}
+
+func (nd *Node) SendGetDataMessage(meta NetworkMetaData, items []InvItem) {
+	msg := CreateGetDataMessage(nd.Meta, items)
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(msg))
+
+	nd.SendMessage("getdata", meta, &result)
+}
+
+func (nd *Node) SendTransactionMessage(meta NetworkMetaData, txKey string, tx *transaction.Transaction) {
+	msg := CreateTransactionMessage(nd.Meta, txKey, tx)
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(msg))
+
+	nd.SendMessage("transaction", meta, &result)
+}
+
+func (nd *Node) announce(item InvItem) {
+	// announce to connected peers that do not know the item yet
+	for _, pc := range nd.connectedPeers() {
+		if nd.isKnown(pc.Meta.Address(), item) {
+			continue
+		}
+		nd.markKnown(pc.Meta.Address(), item)
+		nd.SendInvMessage(pc.Meta, []InvItem{item})
+	}
+}
+
+func (nd *Node) BroadcastTransaction(tx *transaction.Transaction) {
+	nd.announce(InvItem{Type: InvTX, Hash: tx.TxID})
+}
+
+func (nd *Node) BroadcastBlockInv(block *blocks.Block) {
+	if block == nil {
+		return
+	}
+	nd.announce(InvItem{Type: InvBlock, Hash: block.Hash})
+}
+
+func (nd *Node) HandleInvMessage(peer NetworkMetaData, body []byte) error {
+	var msg InvMessage
+	var decoder = gob.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if len(msg.Items) > config.MaxKnownInventory {
+		return errors.New("too many items in inv message")
+	}
+
+	// ask for items we lack, unless they have been asked from another peer
+	var wanted []InvItem
+	for _, item := range msg.Items {
+		if item.Type != InvTX && item.Type != InvBlock {
+			return errors.New("unknown inventory type")
+		}
+		nd.markKnown(peer.Address(), item)
+		if !nd.hasItem(item) && nd.startRequest(item) {
+			wanted = append(wanted, item)
+		}
+	}
+	if len(wanted) > 0 {
+		nd.SendGetDataMessage(peer, wanted)
+	}
+	return nil
+}
+
+func (nd *Node) HandleGetDataMessage(peer NetworkMetaData, body []byte) error {
+	var msg GetDataMessage
+	var decoder = gob.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if len(msg.Items) > config.MaxKnownInventory {
+		return errors.New("too many items in getdata message")
+	}
+
+	// items we no longer have are skipped
+	for _, item := range msg.Items {
+		nd.markKnown(peer.Address(), item)
+		if item.Type == InvTX {
+			if txKey, tx := nd.CliGetTx(item.Hash); tx != nil {
+				nd.SendTransactionMessage(peer, txKey, tx)
+			}
+		} else if item.Type == InvBlock {
+			if block, found := nd.Chain.GetBlock(item.Hash); found {
+				nd.SendBlockMessage(peer, block)
+			}
+		}
+	}
+	return nil
+}
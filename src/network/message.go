@@ -1,6 +1,7 @@
 package network
 
 import (
+	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/transaction"
 	"github.com/AntonyMei/Blockchain/src/blocks"
 )
@@ -10,6 +11,24 @@ type NetworkMetaData struct {
 	Port string
 }
 
+func (meta NetworkMetaData) Address() string {
+	return meta.Ip + ":" + meta.Port
+}
+
+type VersionMessage struct {
+	// Meta: address the peer listens on
+	Meta NetworkMetaData
+	ProtocolVersion int
+	GenesisHash []byte
+	BestHeight int
+	NodeID string
+}
+
+func CreateVersionMessage(Meta NetworkMetaData, GenesisHash []byte, BestHeight int, NodeID string) VersionMessage {
+	msg := VersionMessage{Meta, config.ProtocolVersion, GenesisHash, BestHeight, NodeID}
+	return msg
+}
+
 type UserMetaData struct {
 	Name string
 	PublicKey []byte
@@ -70,19 +89,58 @@ func CreateBlockMessage(Meta NetworkMetaData, Block *blocks.Block) BlockMessage
 type BlockRetrieveMessage struct {
 	Meta NetworkMetaData
 	BlockHeight int
+	// BlockHash: if not empty, block is retrieved by hash instead of height
+	BlockHash []byte
 }
 
 func CreateBlockRetrieveMessage(Meta NetworkMetaData, BlockHeight int) BlockRetrieveMessage {
-	msg := BlockRetrieveMessage{Meta, BlockHeight}
+	msg := BlockRetrieveMessage{Meta, BlockHeight, []byte{}}
 	return msg
 }
 
-type BlockSourceMessage struct {
+func CreateBlockHashRetrieveMessage(Meta NetworkMetaData, BlockHash []byte) BlockRetrieveMessage {
+	msg := BlockRetrieveMessage{Meta, -1, BlockHash}
+	return msg
+}
+
+type InvMessage struct {
 	Meta NetworkMetaData
-	BlockHeight int
+	Items []InvItem
 }
 
-func CreateBlockSourceMessage(Meta NetworkMetaData, BlockHeight int) BlockSourceMessage {
-	msg := BlockSourceMessage{Meta, BlockHeight}
+func CreateInvMessage(Meta NetworkMetaData, Items []InvItem) InvMessage {
+	msg := InvMessage{Meta, Items}
 	return msg
-}
\ No newline at end of file
+}
+
+type GetDataMessage struct {
+	Meta NetworkMetaData
+	Items []InvItem
+}
+
+func CreateGetDataMessage(Meta NetworkMetaData, Items []InvItem) GetDataMessage {
+	msg := GetDataMessage{Meta, Items}
+	return msg
+}
+
+type GetHeadersMessage struct {
+	Meta NetworkMetaData
+	// Locator: hashes from our header tip back to genesis, peer answers with headers
+	// after the first of them on its best chain
+	Locator [][]byte
+}
+
+func CreateGetHeadersMessage(Meta NetworkMetaData, Locator [][]byte) GetHeadersMessage {
+	msg := GetHeadersMessage{Meta, Locator}
+	return msg
+}
+
+type HeadersMessage struct {
+	Meta NetworkMetaData
+	Headers []*blocks.BlockHeader
+}
+
+func CreateHeadersMessage(Meta NetworkMetaData, Headers []*blocks.BlockHeader) HeadersMessage {
+	msg := HeadersMessage{Meta, Headers}
+	return msg
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"net"
+	"time"
+)
+
+// peers that send malformed messages, invalid blocks or invalid transactions collect a
+// misbehavior score, and are banned for a while once it reaches MaxMisbehaviorScore;
+// both are kept per IP that connections come from, which a peer can not choose
+
+func (nd *Node) peerIP(address string) string {
+	// IP of the connection known by address, or host of address if there is none
+	nd.connMu.Lock()
+	pc, ok := nd.conns[address]
+	nd.connMu.Unlock()
+	if ok {
+		return pc.remoteIP
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+func (nd *Node) Misbehave(address string, score int, reason string) {
+	// address is the key of connection the peer is on (see peerConn.Meta), local blocks and
+	// transactions have empty address; score and ban go to IP of the connection
+	if address == "" {
+		return
+	}
+	ip := nd.peerIP(address)
+	nd.banMu.Lock()
+	nd.scores[ip] += score
+	total := nd.scores[ip]
+	banned := total >= config.MaxMisbehaviorScore
+	if banned {
+		delete(nd.scores, ip)
+		nd.bans[ip] = time.Now().Add(time.Duration(config.BanDuration) * time.Millisecond)
+	}
+	nd.banMu.Unlock()
+	fmt.Printf("Peer %s (%s) misbehaves (%s), score %d.\n", address, ip, reason, total)
+
+	// drop all connections from banned IP
+	if banned {
+		fmt.Printf("Ban %s for %v seconds.\n", ip, config.BanDuration/1000)
+		for _, pc := range nd.connectedPeers() {
+			if pc.remoteIP == ip {
+				pc.close()
+				nd.removeConn(pc.Meta.Address(), pc)
+			}
+		}
+	}
+}
+
+func (nd *Node) IsBanned(ip string) bool {
+	nd.banMu.Lock()
+	defer nd.banMu.Unlock()
+	until, ok := nd.bans[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(nd.bans, ip)
+		return false
+	}
+	return true
+}
+
+func (nd *Node) ShowBans() {
+	nd.banMu.Lock()
+	defer nd.banMu.Unlock()
+	for ip, until := range nd.bans {
+		if time.Now().Before(until) {
+			fmt.Printf("    %s banned until %s\n", ip, until.Format(time.RFC3339))
+		}
+	}
+	for ip, score := range nd.scores {
+		fmt.Printf("    %s misbehavior score %d\n", ip, score)
+	}
+}
@@ -2,14 +2,15 @@ package network
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"encoding/gob"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-    "net/url"
+	"net"
 	"time"
 	"sync"
 	"sync/atomic"
+	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/utils"
 	"github.com/AntonyMei/Blockchain/src/wallet"
 	"github.com/AntonyMei/Blockchain/src/blocks"
@@ -22,249 +23,254 @@ type Node struct {
 	Wallets *wallet.Wallets
 	Chain *blockchain.BlockChain
 	Meta NetworkMetaData
+	Config *config.Config
 	mu sync.Mutex
-	Blocks []*blocks.Block
-	CliHandleTxFromNetwork func(string, *transaction.Transaction)
-	CliHandleBlockFromNetwork func(*blocks.Block)
+	CliHandleTxFromNetwork func(string, *transaction.Transaction, NetworkMetaData)
+	CliHandleBlockFromNetwork func(*blocks.Block, NetworkMetaData)
+	CliGetTx func([]byte) (string, *transaction.Transaction)
 
 	//stats
 	Total_send_bytes uint64
 	Total_recv_bytes uint64
 
-	// last block time
-	last_retrieve_time time.Time
-	refreshed_time bool
+	// NodeID: random id sent in handshake, used to detect connections to ourselves
+	// conns: connections that passed handshake, keyed by address peer listens on
+	// connsClosed: set by Stop, no connection is made or accepted until node starts again
+	// reserved: inbound (true) and outbound (false) slots held by connections in dial or handshake
+	// verifyDials: dials in flight to each IP that check claimed listen addresses
+	NodeID string
+	conns map[string]*peerConn
+	connsClosed bool
+	reserved map[bool]int
+	verifyDials map[string]int
+	connMu sync.Mutex
+	handlers map[string]func(NetworkMetaData, []byte) error
+
+	// scores: misbehavior score of peers, bans: when bans of peers end
+	scores map[string]int
+	bans map[string]time.Time
+	banMu sync.Mutex
+
+	// knownInventory: what each peer has seen, requested: when we ask for items
+	knownInventory map[string]*inventorySet
+	requested map[string]time.Time
+	invMu sync.Mutex
+
+	// headerSync: state of headers-first sync with peers ahead of us
+	headerSync *headerSync
+
+	// listener and loops run between Start and Stop, workers: goroutines Stop waits for
+	listener net.Listener
+	stopLoops context.CancelFunc
+	lifeMu sync.Mutex
+	workers sync.WaitGroup
 }
 
-func InitializeNode(w *wallet.Wallets, chain *blockchain.BlockChain, meta NetworkMetaData) *Node {
-	nd := Node{ConnectionPool: InitializeConnectionPool(), Wallets: w, Chain: chain, Meta: meta}
-	nd.ConnectionPool.AddPeer(nd.Meta)
-	nd.last_retrieve_time = time.Now()
-	nd.refreshed_time = true
+func InitializeNode(cfg *config.Config, userName string, w *wallet.Wallets, chain *blockchain.BlockChain,
+	meta NetworkMetaData) *Node {
+	// peers saved last time are loaded into connection pool
+	peerPath := cfg.UserPath(userName) + config.PeerFileName
+	nd := Node{ConnectionPool: InitializeConnectionPool(meta, peerPath, cfg.Network.MaxAddressBook), Wallets: w,
+		Chain: chain, Meta: meta, Config: cfg}
+	nd.NodeID = newNodeID()
+	nd.conns = make(map[string]*peerConn)
+	nd.reserved = make(map[bool]int)
+	nd.verifyDials = make(map[string]int)
+	nd.scores = make(map[string]int)
+	nd.bans = make(map[string]time.Time)
+	nd.knownInventory = make(map[string]*inventorySet)
+	nd.requested = make(map[string]time.Time)
+	nd.headerSync = newHeaderSync()
+	nd.handlers = map[string]func(NetworkMetaData, []byte) error{
+		"ping": nd.HandlePingMessage,
+		"peers": nd.HandlePeersMessage,
+		"user": nd.HandleUserMessage,
+		"block": nd.HandleBlockMessage,
+		"inv": nd.HandleInvMessage,
+		"getdata": nd.HandleGetDataMessage,
+		"getheaders": nd.HandleGetHeadersMessage,
+		"headers": nd.HandleHeadersMessage,
+		"block_retrieve": nd.HandleBlockRetrieveMessage,
+		"transaction": nd.HandleTransactionMessage,
+	}
+	_ = nd.ConnectionPool.LoadFile()
 	return &nd
 }
 
-func (nd *Node) SetCliTransactionFunc(f func(string, *transaction.Transaction)) {
+func (nd *Node) SetCliTransactionFunc(f func(string, *transaction.Transaction, NetworkMetaData)) {
 	nd.CliHandleTxFromNetwork = f
 }
 
-func (nd *Node) SetCliBlockFunc(f func(*blocks.Block)) {
+func (nd *Node) SetCliBlockFunc(f func(*blocks.Block, NetworkMetaData)) {
 	nd.CliHandleBlockFromNetwork = f
 }
 
-func PrintHeader(w http.ResponseWriter, req *http.Request) {
-	for name, headers := range req.Header {
-        for _, h := range headers {
-            fmt.Fprintf(w, "%v: %v\n", name, h)
-        }
-    }
-}
-
-func (nd *Node) AddBlock(newBlock *blocks.Block) {
-	if newBlock == nil {
-		return
-	}
-	nd.mu.Lock()
-	defer nd.mu.Unlock()
-	// if already exists, do not add the block
-	for _, block := range nd.Blocks {
-		if bytes.Compare(block.Hash, newBlock.Hash) == 0 {
-			return
-		}
-	}
-	nd.Blocks = append(nd.Blocks, newBlock)
-	nd.refreshed_time = true // refresh time when new block is added
+func (nd *Node) SetCliGetTxFunc(f func([]byte) (string, *transaction.Transaction)) {
+	nd.CliGetTx = f
 }
 
 func (nd *Node) GetBlock(blockHeight int) *blocks.Block {
-	nd.mu.Lock()
-	defer nd.mu.Unlock()
-	for _, block := range nd.Blocks {
-		if block.Height == blockHeight {
-			return block
-		}
+	// blocks are served from height index of chain
+	block, found := nd.Chain.GetBlockByHeight(blockHeight)
+	if !found {
+		return nil
 	}
-	return nil
+	return block
 }
 
-func (nd *Node) HandlePingMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
-
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
-
+func (nd *Node) HandlePingMessage(peer NetworkMetaData, body []byte) error {
 	var msg PingMessage
 	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
 
-	// fmt.Printf("Receive PING message from http://%s:%s with block height %d.\n", msg.Meta.Ip, msg.Meta.Port, msg.BlockHeight)
+	// fmt.Printf("Receive PING message from http://%s:%s with block height %d.\n", peer.Ip, peer.Port, msg.BlockHeight)
 	
-	nd.SendPeersMessage(msg.Meta)
-	
-	if nd.ConnectionPool.AddPeer(msg.Meta) {
-		nd.SendPingMessage(msg.Meta, nd.Chain.BlockHeight)
-	}
+	nd.SendPeersMessage(peer)
 
-	// synchronize block according to block height
-	if msg.BlockHeight < nd.Chain.BlockHeight {
-		/*block := nd.GetBlock(msg.BlockHeight + 1)
-		if block != nil {
-			nd.SendBlockMessage(msg.Meta, block)
-		}*/
-		nd.SendBlockSourceMessage(msg.Meta, nd.Chain.BlockHeight)
-	}
-}
+	// inbound peers are put into connection pool once their listen address is verified,
+	// see verifyListenAddress
 
-func (nd *Node) HandlePeersMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
+	// peers ahead of us are synchronized with in sync loop
+	nd.notePeerHeight(peer.Address(), msg.BlockHeight)
+	return nil
+}
 
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
 
+func (nd *Node) HandlePeersMessage(peer NetworkMetaData, body []byte) error {
 	var msg PeersMessage
 	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
 
-	// fmt.Printf("Receive PEERS message from http://%s:%s.\n", msg.Meta.Ip, msg.Meta.Port)
+	// fmt.Printf("Receive PEERS message from http://%s:%s.\n", peer.Ip, peer.Port)
 
 	for _, peer := range msg.Peers {
-		if nd.ConnectionPool.AddPeer(peer) {
-			nd.SendPingMessage(peer, nd.Chain.BlockHeight)
+		if nd.ConnectionPool.AddPeer(peer, utils.PeerGossip) {
+			nd.SendPingMessage(peer, nd.Chain.Tip().Height)
 		}
 	}
+	return nil
 }
 
-func (nd *Node) HandleUserMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
-
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
 
+func (nd *Node) HandleUserMessage(peer NetworkMetaData, body []byte) error {
 	var msg UserMessage
 	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
 
-	// fmt.Printf("Receive USER message from http://%s:%s. Name=%s\n", msg.Meta.Ip, msg.Meta.Port, msg.UserMeta.Name)
+	// fmt.Printf("Receive USER message from http://%s:%s. Name=%s\n", peer.Ip, peer.Port, msg.UserMeta.Name)
 
+	if !wallet.ValidateAddress(msg.UserMeta.WalletAddr, nd.Config.Wallet) {
+		return errors.New("user message with invalid wallet address")
+	}
 	nd.Wallets.AddKnownAddress(msg.UserMeta.Name, &wallet.KnownAddress{PublicKey: wallet.DeserializePublicKey(msg.UserMeta.PublicKey), Address: msg.UserMeta.WalletAddr})
+	return nil
 }
 
-func (nd *Node) HandleTransactionMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
-
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
 
+func (nd *Node) HandleTransactionMessage(peer NetworkMetaData, body []byte) error {
 	var msg TransactionMessage
 	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
 	
-	//fmt.Printf("Get Transaction from Ip=%s Port=%s.\n", msg.Meta.Ip, msg.Meta.Port)
+	//fmt.Printf("Get Transaction from Ip=%s Port=%s.\n", peer.Ip, peer.Port)
 
+	if msg.Transaction == nil {
+		return errors.New("transaction message without transaction")
+	}
 	txKey := msg.TxKey
 	tx := msg.Transaction
-	nd.CliHandleTxFromNetwork(txKey, tx)
-}
-
-func (nd *Node) HandleBlockSourceMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
-
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
-
-	var msg BlockSourceMessage
-	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
-
-	//fmt.Println("Handle block source", msg.BlockHeight, msg.Meta.Port, nd.Chain.BlockHeight)
-
-	/*nd.mu.Lock()
-	defer nd.mu.Unlock()*/
-	if (msg.BlockHeight > nd.Chain.BlockHeight && (nd.refreshed_time || time.Since(nd.last_retrieve_time).Milliseconds() > 1000)) {
-		//fmt.Println("[Node] BlockSource", msg.Meta.Ip, msg.Meta.Port, msg.BlockHeight, nd.Chain.BlockHeight, nd.refreshed_time, time.Since(nd.last_retrieve_time).Milliseconds())
-		nd.SendBlockRetrieveMessage(msg.Meta, nd.Chain.BlockHeight + 1)
-		nd.last_retrieve_time = time.Now()
-		nd.refreshed_time = false
-	}
+	item := InvItem{Type: InvTX, Hash: tx.TxID}
+	nd.markKnown(peer.Address(), item)
+	nd.finishRequest(item)
+	nd.CliHandleTxFromNetwork(txKey, tx, peer)
+	return nil
 }
 
-func (nd *Node) HandleBlockRetrieveMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
-
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
 
+func (nd *Node) HandleBlockRetrieveMessage(peer NetworkMetaData, body []byte) error {
 	var msg BlockRetrieveMessage
 	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
 
 	//fmt.Println("Handle block retrieve")
 
-	block := nd.GetBlock(msg.BlockHeight)
+	// blocks asked by hash may be on side chains, so they are read from chain
+	var block *blocks.Block
+	if len(msg.BlockHash) > 0 {
+		block, _ = nd.Chain.GetBlock(msg.BlockHash)
+	} else {
+		block = nd.GetBlock(msg.BlockHeight)
+	}
 	if block != nil {
-		nd.SendBlockMessage(msg.Meta, block)
+		nd.SendBlockMessage(peer, block)
 	}
+	return nil
 }
 
-func (nd *Node) HandleBlockMessage(w http.ResponseWriter, req *http.Request) {
-	PrintHeader(w, req)
-
-	// send acknowledgement back
-	fmt.Fprintf(w, "ACK")
-	body, err := ioutil.ReadAll(req.Body)
-	utils.Handle(err)
-	atomic.AddUint64(&nd.Total_recv_bytes, uint64(len(body)))
 
+func (nd *Node) HandleBlockMessage(peer NetworkMetaData, body []byte) error {
 	var msg BlockMessage
 	var decoder = gob.NewDecoder(bytes.NewReader(body))
-	utils.Handle(decoder.Decode(&msg))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
 	
 	//fmt.Println("Handle block")
 
-	//fmt.Printf("Get Block from Ip=%s Port=%s.\n", msg.Meta.Ip, msg.Meta.Port)
+	//fmt.Printf("Get Block from Ip=%s Port=%s.\n", peer.Ip, peer.Port)
 
-	nd.CliHandleBlockFromNetwork(msg.Block)
+	if msg.Block == nil {
+		return errors.New("block message without block")
+	}
+	for _, tx := range msg.Block.TransactionList {
+		if tx == nil {
+			return errors.New("block with empty transaction")
+		}
+	}
+	item := InvItem{Type: InvBlock, Hash: msg.Block.Hash}
+	nd.markKnown(peer.Address(), item)
+	nd.finishRequest(item)
+	// blocks downloaded by sync wait there until their parents are stored
+	if isSyncBlock, err := nd.receiveSyncBlock(msg.Block, peer); isSyncBlock || err != nil {
+		return err
+	}
+	nd.CliHandleBlockFromNetwork(msg.Block, peer)
 	//fmt.Println("Handle block finished")
+	return nil
 }
 
-func (nd *Node) SendMessage(channel string, meta NetworkMetaData, buf *bytes.Buffer) {
-	c := http.Client{Timeout: time.Duration(10) * time.Second}
 
-	s := fmt.Sprintf("http://%s:%s/%s", meta.Ip, meta.Port, channel)
-	url, err := url.Parse(s)
-	utils.Handle(err)
+func (nd *Node) SendMessage(channel string, meta NetworkMetaData, buf *bytes.Buffer) {
+	// peers that can not be reached are skipped, a broken connection is dialed again next time
+	// node itself is in connection pool, but there is nothing to send to it
+	if meta.Address() == nd.Meta.Address() {
+		return
+	}
+	pc, err := nd.getConn(meta)
+	if err != nil {
+		return
+	}
 
 	//if channel == "block" {
 	//	fmt.Println("Block size", uint64(len(buf.Bytes())), "bytes")
 	//}
 
-	atomic.AddUint64(&nd.Total_send_bytes, uint64(len(buf.Bytes())))
-	resp, err := c.Post(url.String(), "", bytes.NewBuffer(buf.Bytes()))
-	if err != nil {
-		return
+	atomic.AddUint64(&nd.Total_send_bytes, uint64(frameHeaderLength+len(buf.Bytes())))
+	if err := pc.send(channel, buf.Bytes()); err != nil {
+		pc.close()
+		nd.removeConn(meta.Address(), pc)
+		nd.ConnectionPool.MarkFailure(meta.Address())
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	utils.Assert((string(body)[len(string(body))-3:] == "ACK"), fmt.Sprintf("response = ACK, but get %s\n", body))
-	defer resp.Body.Close()
 }
 
 func (nd *Node) SendPeersMessage(meta NetworkMetaData) {
@@ -295,13 +301,8 @@ func (nd *Node) RandomPing(blockHeight int) {
 	var encoder = gob.NewEncoder(&result)
 	utils.Handle(encoder.Encode(msg))
 
-	var SentPeer = make(map[NetworkMetaData]bool)
 	for _, peer := range peers {
-		_, exist := SentPeer[peer]
-		if !exist {
-			SentPeer[peer] = true
-			nd.SendMessage("ping", peer, &result)
-		}
+		nd.SendMessage("ping", peer, &result)
 	}
 }
 
@@ -317,17 +318,6 @@ func (nd *Node) SendBlockMessage(meta NetworkMetaData, block *blocks.Block) {
 	//fmt.Println("Block length", len(block.TransactionList))
 }
 
-func (nd *Node) SendBlockSourceMessage(meta NetworkMetaData, blockHeight int) {
-	msg := CreateBlockSourceMessage(nd.Meta, blockHeight)
-	var result bytes.Buffer
-	var encoder = gob.NewEncoder(&result)
-	utils.Handle(encoder.Encode(msg))
-
-	// fmt.Println("Send block source")
-
-	nd.SendMessage("block_source", meta, &result)
-}
-
 func (nd *Node) SendBlockRetrieveMessage(meta NetworkMetaData, blockHeight int) {
 	msg := CreateBlockRetrieveMessage(nd.Meta, blockHeight)
 	var result bytes.Buffer
@@ -339,27 +329,13 @@ func (nd *Node) SendBlockRetrieveMessage(meta NetworkMetaData, blockHeight int)
 	nd.SendMessage("block_retrieve", meta, &result)
 }
 
-func (nd *Node) BroadcastBlockSource(block *blocks.Block) {
-	if block == nil {
-		return
-	}
-	//fmt.Printf("Broadcast block with Hash %x.\n", block.Hash)
-	peers := nd.ConnectionPool.GetAlivePeers(50)
-	
-	msg := CreateBlockSourceMessage(nd.Meta, block.Height)
+func (nd *Node) SendBlockHashRetrieveMessage(meta NetworkMetaData, blockHash []byte) {
+	msg := CreateBlockHashRetrieveMessage(nd.Meta, blockHash)
 	var result bytes.Buffer
 	var encoder = gob.NewEncoder(&result)
-	utils.Handle(encoder.Encode(msg))
+	utils.Handle(encoder.Encode(&msg))
 
-	var SentPeer = make(map[NetworkMetaData]bool)
-	for _, peer := range peers {
-		_, exist := SentPeer[peer]
-		if !exist {
-			//fmt.Printf("Send block to Ip=%s, Port=%s.\n", peer.Ip, peer.Port)
-			SentPeer[peer] = true
-			nd.SendMessage("block_source", peer, &result)
-		}
-	}
+	nd.SendMessage("block_retrieve", meta, &result)
 }
 
 func (nd *Node) BroadcastUserMessage(userMeta UserMetaData) {
@@ -370,72 +346,99 @@ func (nd *Node) BroadcastUserMessage(userMeta UserMetaData) {
 	var encoder = gob.NewEncoder(&result)
 	utils.Handle(encoder.Encode(msg))
 
-	var SentPeer = make(map[NetworkMetaData]bool)
 	for _, peer := range peers {
-		_, exist := SentPeer[peer]
-		if !exist {
-			SentPeer[peer] = true
-			nd.SendMessage("user", peer, &result)
-		}
+		nd.SendMessage("user", peer, &result)
 	}
 }
 
-func (nd *Node) BroadcastTransaction(txKey string, tx *transaction.Transaction) {
-	//fmt.Printf("Broadcast transaction %s.\n", txKey)
-	peers := nd.ConnectionPool.GetAlivePeers(50)
-
-	msg := CreateTransactionMessage(nd.Meta, txKey, tx)
-	var result bytes.Buffer
-	var encoder = gob.NewEncoder(&result)
-	utils.Handle(encoder.Encode(msg))
-
-	var SentPeer = make(map[NetworkMetaData]bool)
-	for _, peer := range peers {
-		_, exist := SentPeer[peer]
-		if !exist {
-			SentPeer[peer] = true
-			nd.SendMessage("transaction", peer, &result)
-		}
+func (nd *Node) Start(ctx context.Context) error {
+	// listen for peers, and sync with them until ctx is done or Stop is called
+	nd.lifeMu.Lock()
+	defer nd.lifeMu.Unlock()
+	if nd.listener != nil {
+		return errors.New("node is running already")
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", nd.Meta.Port))
+	if err != nil {
+		return err
 	}
+	loopCtx, stopLoops := context.WithCancel(ctx)
+	nd.listener = listener
+	nd.stopLoops = stopLoops
+	nd.openConns()
+	fmt.Printf("Listening at port %s\n", nd.Meta.Port)
+
+	nd.goWorker(func() { nd.acceptLoop(listener) })
+	nd.goWorker(func() { nd.syncLoop(loopCtx) })
+	nd.goWorker(func() { nd.peerLoop(loopCtx) })
+	nd.goWorker(func() {
+		// ctx given by caller stops this run as well
+		<-loopCtx.Done()
+		nd.stopRun(listener)
+	})
+	return nil
+}
 
+func (nd *Node) Stop() {
+	// stop accepting peers and close all connections, then wait for messages being handled,
+	// the port is free once this returns
+	nd.lifeMu.Lock()
+	listener := nd.listener
+	nd.lifeMu.Unlock()
+	nd.stopRun(listener)
+	nd.workers.Wait()
 }
 
-func (nd *Node) BroadcastBlock(block *blocks.Block) {
-	if block == nil {
+func (nd *Node) stopRun(listener net.Listener) {
+	// stop the run started with listener, nothing happens if it has stopped already,
+	// so that a late stop never ends a run started after it
+	nd.lifeMu.Lock()
+	defer nd.lifeMu.Unlock()
+	if listener == nil || nd.listener != listener {
 		return
 	}
-	//fmt.Printf("Broadcast block with Hash %x.\n", block.Hash)
-	peers := nd.ConnectionPool.GetAlivePeers(50)
-	
-	msg := CreateBlockMessage(nd.Meta, block)
-	var result bytes.Buffer
-	var encoder = gob.NewEncoder(&result)
-	utils.Handle(encoder.Encode(msg))
+	nd.stopLoops()
+	nd.listener.Close()
+	nd.listener = nil
+	nd.closeConns()
+}
 
-	var SentPeer = make(map[NetworkMetaData]bool)
-	for _, peer := range peers {
-		_, exist := SentPeer[peer]
-		if !exist {
-			//fmt.Printf("Send block to Ip=%s, Port=%s.\n", peer.Ip, peer.Port)
-			SentPeer[peer] = true
-			nd.SendMessage("block", peer, &result)
+func (nd *Node) goWorker(f func()) {
+	nd.workers.Add(1)
+	go func() {
+		defer nd.workers.Done()
+		f()
+	}()
+}
+
+func (nd *Node) acceptLoop(listener net.Listener) {
+	// ends when listener is closed by Stop
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
 		}
+		nd.goWorker(func() { nd.acceptConn(conn) })
 	}
 }
 
-func (nd *Node) Serve() error {
-	http.HandleFunc("/ping", nd.HandlePingMessage)
-	http.HandleFunc("/peers", nd.HandlePeersMessage)
-	http.HandleFunc("/user", nd.HandleUserMessage)
-	http.HandleFunc("/block", nd.HandleBlockMessage)
-	http.HandleFunc("/block_source", nd.HandleBlockSourceMessage)
-	http.HandleFunc("/block_retrieve", nd.HandleBlockRetrieveMessage)
-	http.HandleFunc("/transaction", nd.HandleTransactionMessage)
-
-	go func() {
-		fmt.Printf("Listening at port %s\n", nd.Meta.Port)
-		err := http.ListenAndServe(fmt.Sprintf(":%s", nd.Meta.Port), nil)
-		utils.Handle(err)
-	}()
-	return nil
-}
\ No newline at end of file
+func (nd *Node) peerLoop(ctx context.Context) {
+	// remove stale peers and save address book from time to time
+	ticker := time.NewTicker(time.Duration(config.PeerMaintenanceInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		connected := make(map[string]bool)
+		for _, pc := range nd.connectedPeers() {
+			connected[pc.Meta.Address()] = true
+		}
+		if evicted := nd.ConnectionPool.EvictStale(connected); evicted > 0 {
+			fmt.Printf("Removed %d stale peer(s) from connection pool.\n", evicted)
+		}
+		nd.ConnectionPool.SaveFile()
+	}
+}
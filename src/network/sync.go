@@ -0,0 +1,529 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/blockchain"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// Nodes that are behind catch up with headers-first sync: headers are asked from a single
+// sync peer and checked (proof of work included) before any block is downloaded, then blocks
+// of the header chain are fetched from all peers that have them, within a sliding window that
+// starts at the first block we lack. Downloaded blocks are handed to cli in chain order by
+// PopSyncBlock.
+
+type blockRequest struct {
+	Peer string
+	Time time.Time
+}
+
+type syncBlock struct {
+	Block *blocks.Block
+	Peer  string
+}
+
+type headerSync struct {
+	// headers: header chain whose blocks are not all stored yet, parent of headers[0] is
+	// stored in chain; headerMap indexes headers by hash
+	headers   []*blocks.BlockHeader
+	headerMap map[string]*blocks.BlockHeader
+	// syncPeer: address of the peer headers are asked from, empty if there is none
+	syncPeer     string
+	headersAsked time.Time
+	// peerHeights: best height reported by peers
+	// syncedHeights: height of peer when header sync with it ends, it is not asked for
+	// headers again until it reports a greater height
+	peerHeights   map[string]int
+	syncedHeights map[string]int
+	// inFlight: blocks requested by hash, stalled: when stalled peers can be asked again
+	inFlight map[string]*blockRequest
+	stalled  map[string]time.Time
+	// downloaded: blocks waiting until their parents are stored
+	downloaded   map[string]*syncBlock
+	lastProgress time.Time
+	mu           sync.Mutex
+}
+
+func newHeaderSync() *headerSync {
+	return &headerSync{headerMap: make(map[string]*blocks.BlockHeader), peerHeights: make(map[string]int),
+		syncedHeights: make(map[string]int), inFlight: make(map[string]*blockRequest),
+		stalled: make(map[string]time.Time), downloaded: make(map[string]*syncBlock)}
+}
+
+func (hs *headerSync) reset() {
+	// drop header chain and everything downloaded for it
+	hs.headers = nil
+	hs.headerMap = make(map[string]*blocks.BlockHeader)
+	hs.inFlight = make(map[string]*blockRequest)
+	hs.downloaded = make(map[string]*syncBlock)
+}
+
+func (hs *headerSync) truncate(idx int) {
+	// drop headers[idx:]
+	for _, header := range hs.headers[idx:] {
+		delete(hs.headerMap, string(header.Hash))
+		delete(hs.inFlight, string(header.Hash))
+		delete(hs.downloaded, string(header.Hash))
+	}
+	hs.headers = hs.headers[:idx]
+}
+
+func (hs *headerSync) addHeader(header *blocks.BlockHeader) {
+	// header extends header chain, or forks from it (or from chain) somewhere before its tip
+	idx := len(hs.headers)
+	for idx > 0 && bytes.Compare(hs.headers[idx-1].Hash, header.PrevHash) != 0 {
+		idx--
+	}
+	hs.truncate(idx)
+	hs.headers = append(hs.headers, header)
+	hs.headerMap[string(header.Hash)] = header
+}
+
+func (hs *headerSync) prune(chain *blockchain.BlockChain) {
+	// drop headers whose blocks are stored, header chain is given up once it has an invalid block
+	for len(hs.headers) > 0 {
+		hash := hs.headers[0].Hash
+		if chain.IsInvalid(hash) {
+			fmt.Printf("[Sync] Block %x is invalid, header chain dropped.\n", hash)
+			hs.reset()
+			return
+		}
+		if _, stored := chain.GetBlock(hash); !stored {
+			return
+		}
+		delete(hs.headerMap, string(hash))
+		delete(hs.inFlight, string(hash))
+		delete(hs.downloaded, string(hash))
+		hs.headers = hs.headers[1:]
+	}
+}
+
+func (hs *headerSync) tipHeight(chain *blockchain.BlockChain) int {
+	if len(hs.headers) == 0 {
+		return chain.Tip().Height
+	}
+	return hs.headers[len(hs.headers)-1].Height
+}
+
+func (hs *headerSync) hasMoreWork(chain *blockchain.BlockChain) bool {
+	// blocks are only downloaded for a header chain with more cumulative work than best chain
+	if len(hs.headers) == 0 {
+		return false
+	}
+	work := new(big.Int).Set(chain.GetCumulativeWork(hs.headers[0].PrevHash))
+	for _, header := range hs.headers {
+		work.Add(work, header.Work())
+	}
+	return work.Cmp(chain.GetCumulativeWork(chain.Tip().Hash)) > 0
+}
+
+func (hs *headerSync) peerHeight(pc *peerConn) int {
+	// height from handshake, or a greater one reported later
+	if height := hs.peerHeights[pc.Meta.Address()]; height > pc.Version.BestHeight {
+		return height
+	}
+	return pc.Version.BestHeight
+}
+
+func (hs *headerSync) isStalled(address string, now time.Time) bool {
+	until, ok := hs.stalled[address]
+	return ok && now.Before(until)
+}
+
+func (hs *headerSync) getHeader(chain *blockchain.BlockChain) func([]byte) (*blocks.BlockHeader, bool) {
+	// headers are looked up in header chain first, then in chain
+	return func(hash []byte) (*blocks.BlockHeader, bool) {
+		if header, ok := hs.headerMap[string(hash)]; ok {
+			return header, true
+		}
+		return chain.GetHeader(hash)
+	}
+}
+
+func (nd *Node) blockLocator() [][]byte {
+	// hashes from header tip back to genesis, one per height for the last 10 blocks and
+	// then exponentially sparser; headerSync should be locked by caller
+	hs := nd.headerSync
+	hashAt := func(height int) ([]byte, bool) {
+		if len(hs.headers) > 0 && height >= hs.headers[0].Height {
+			return hs.headers[height-hs.headers[0].Height].Hash, true
+		}
+		return nd.Chain.GetBlockHashByHeight(height)
+	}
+	var locator [][]byte
+	step := 1
+	for height := hs.tipHeight(nd.Chain); height > 0; height -= step {
+		if hash, found := hashAt(height); found {
+			locator = append(locator, hash)
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if genesisHash, found := nd.Chain.GetBlockHashByHeight(0); found {
+		locator = append(locator, genesisHash)
+	}
+	return locator
+}
+
+func (nd *Node) notePeerHeight(address string, height int) {
+	hs := nd.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if height > hs.peerHeights[address] {
+		hs.peerHeights[address] = height
+	}
+}
+
+func (nd *Node) SendGetHeadersMessage(meta NetworkMetaData, locator [][]byte) {
+	msg := CreateGetHeadersMessage(nd.Meta, locator)
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(msg))
+
+	nd.SendMessage("getheaders", meta, &result)
+}
+
+func (nd *Node) SendHeadersMessage(meta NetworkMetaData, headers []*blocks.BlockHeader) {
+	msg := CreateHeadersMessage(nd.Meta, headers)
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	utils.Handle(encoder.Encode(msg))
+
+	nd.SendMessage("headers", meta, &result)
+}
+
+func (nd *Node) HandleGetHeadersMessage(peer NetworkMetaData, body []byte) error {
+	var msg GetHeadersMessage
+	var decoder = gob.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if len(msg.Locator) > config.MaxLocatorHashes {
+		return errors.New("too many hashes in block locator")
+	}
+
+	// headers start after the first locator hash on best chain, or after genesis
+	startHeight := 0
+	for _, hash := range msg.Locator {
+		block, found := nd.Chain.GetBlock(hash)
+		if !found {
+			continue
+		}
+		if bestHash, onBest := nd.Chain.GetBlockHashByHeight(block.Height); onBest && bytes.Compare(bestHash, hash) == 0 {
+			startHeight = block.Height
+			break
+		}
+	}
+	headers := []*blocks.BlockHeader{}
+	tipHeight := nd.Chain.Tip().Height
+	for height := startHeight + 1; height <= tipHeight && len(headers) < config.MaxHeadersPerMessage; height++ {
+		block, found := nd.Chain.GetBlockByHeight(height)
+		if !found {
+			break
+		}
+		headers = append(headers, block.Header())
+	}
+	nd.SendHeadersMessage(peer, headers)
+	return nil
+}
+
+func (nd *Node) HandleHeadersMessage(peer NetworkMetaData, body []byte) error {
+	var msg HeadersMessage
+	var decoder = gob.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if len(msg.Headers) > config.MaxHeadersPerMessage {
+		return errors.New("too many headers in headers message")
+	}
+	for _, header := range msg.Headers {
+		if header == nil {
+			return errors.New("headers message with empty header")
+		}
+	}
+
+	// headers we do not ask for are ignored
+	hs := nd.headerSync
+	hs.mu.Lock()
+	address := peer.Address()
+	if hs.syncPeer != address {
+		hs.mu.Unlock()
+		return nil
+	}
+	getHeader := hs.getHeader(nd.Chain)
+	for _, header := range msg.Headers {
+		if _, known := hs.headerMap[string(header.Hash)]; known {
+			continue
+		}
+		if _, stored := nd.Chain.GetBlock(header.Hash); stored {
+			continue
+		}
+		if status := blockchain.ValidateHeader(&nd.Chain.Params, header, nd.Chain.Clock.Now().UnixMilli(), getHeader); status != utils.Verified {
+			hs.syncPeer = ""
+			hs.mu.Unlock()
+			nd.Misbehave(address, config.InvalidBlockScore, fmt.Sprintf("invalid header %x (%v)", header.Hash, status.String()))
+			return nil
+		}
+		hs.addHeader(header)
+		if header.Height > hs.peerHeights[address] {
+			hs.peerHeights[address] = header.Height
+		}
+	}
+
+	// a full message means that peer has more headers
+	if len(msg.Headers) == config.MaxHeadersPerMessage {
+		hs.headersAsked = time.Now()
+		locator := nd.blockLocator()
+		hs.mu.Unlock()
+		nd.SendGetHeadersMessage(peer, locator)
+		return nil
+	}
+	hs.syncPeer = ""
+	hs.syncedHeights[address] = hs.peerHeights[address]
+	if !hs.hasMoreWork(nd.Chain) {
+		hs.reset()
+	}
+	hs.mu.Unlock()
+	return nil
+}
+
+func (nd *Node) receiveSyncBlock(block *blocks.Block, peer NetworkMetaData) (bool, error) {
+	// keep a block requested by sync until its parent is stored, returns false for other blocks
+	hs := nd.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	key := string(block.Hash)
+	if _, ok := hs.inFlight[key]; !ok {
+		return false, nil
+	}
+	delete(hs.inFlight, key)
+	header, ok := hs.headerMap[key]
+	if !ok {
+		return false, nil
+	}
+	if !header.Matches(block) {
+		return true, errors.New("block does not match its header")
+	}
+	hs.downloaded[key] = &syncBlock{Block: block, Peer: peer.Address()}
+	return true, nil
+}
+
+func (nd *Node) PopSyncBlock() (*blocks.Block, string) {
+	// returns the next downloaded block whose parent is stored, and address of the peer
+	// that sent it; nil if there is none
+	hs := nd.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.prune(nd.Chain)
+	if len(hs.headers) == 0 {
+		return nil, ""
+	}
+	key := string(hs.headers[0].Hash)
+	downloaded, ok := hs.downloaded[key]
+	if !ok {
+		return nil, ""
+	}
+	delete(hs.downloaded, key)
+	return downloaded.Block, downloaded.Peer
+}
+
+func (nd *Node) InvalidateSyncHeader(hash []byte) {
+	// the block of this header fails validation, so header chain is dropped from it on
+	hs := nd.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for idx, header := range hs.headers {
+		if bytes.Compare(header.Hash, hash) == 0 {
+			fmt.Printf("[Sync] Block %x is invalid, header chain dropped from height %v.\n", hash, header.Height)
+			hs.truncate(idx)
+			return
+		}
+	}
+}
+
+func (nd *Node) syncLoop(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			nd.syncTick()
+		}
+	}
+}
+
+func (nd *Node) syncTick() {
+	// start header sync with a peer ahead of us, and request blocks of header chain
+	peers := nd.connectedPeers()
+	hs := nd.headerSync
+	hs.mu.Lock()
+	now := time.Now()
+	hs.prune(nd.Chain)
+	heights := make(map[string]int)
+	for _, pc := range peers {
+		heights[pc.Meta.Address()] = hs.peerHeight(pc)
+	}
+
+	// a sync peer that does not answer is replaced
+	if hs.syncPeer != "" && now.Sub(hs.headersAsked) > time.Duration(config.HeaderSyncTimeout)*time.Millisecond {
+		fmt.Printf("[Sync] Peer %s stalls header sync.\n", hs.syncPeer)
+		hs.stalled[hs.syncPeer] = now.Add(time.Duration(config.PeerStallDuration) * time.Millisecond)
+		hs.syncPeer = ""
+	}
+	var headerPeer *NetworkMetaData
+	var locator [][]byte
+	if hs.syncPeer == "" {
+		bestHeight := hs.tipHeight(nd.Chain)
+		for _, pc := range peers {
+			address := pc.Meta.Address()
+			if heights[address] > bestHeight && heights[address] > hs.syncedHeights[address] && !hs.isStalled(address, now) {
+				bestHeight = heights[address]
+				headerPeer = &pc.Meta
+			}
+		}
+		if headerPeer != nil {
+			hs.syncPeer = headerPeer.Address()
+			hs.headersAsked = now
+			locator = nd.blockLocator()
+		} else if len(hs.headers) > 0 && !hs.hasMoreWork(nd.Chain) {
+			// best chain gets ahead of header chain in other ways
+			hs.reset()
+		}
+	}
+
+	// blocks requested too long ago are asked from other peers
+	requests := make(map[string][]InvItem)
+	metas := make(map[string]NetworkMetaData)
+	stallTimeout := time.Duration(config.BlockStallTimeout) * time.Millisecond
+	for key, request := range hs.inFlight {
+		if now.Sub(request.Time) > stallTimeout {
+			if !hs.isStalled(request.Peer, now) {
+				fmt.Printf("[Sync] Peer %s stalls block download.\n", request.Peer)
+			}
+			hs.stalled[request.Peer] = now.Add(time.Duration(config.PeerStallDuration) * time.Millisecond)
+			delete(hs.inFlight, key)
+		}
+	}
+	if len(hs.headers) > 0 && hs.hasMoreWork(nd.Chain) {
+		inFlightCount := make(map[string]int)
+		for _, request := range hs.inFlight {
+			inFlightCount[request.Peer] += 1
+		}
+		// each block in window goes to the peer with fewest blocks in flight among those having it
+		window := hs.headers
+		if len(window) > config.BlockDownloadWindow {
+			window = window[:config.BlockDownloadWindow]
+		}
+		for _, header := range window {
+			key := string(header.Hash)
+			if _, ok := hs.inFlight[key]; ok {
+				continue
+			}
+			if _, ok := hs.downloaded[key]; ok {
+				continue
+			}
+			if nd.isRequested(InvItem{Type: InvBlock, Hash: header.Hash}) {
+				continue
+			}
+			var chosen *peerConn
+			for _, pc := range peers {
+				address := pc.Meta.Address()
+				if heights[address] < header.Height || hs.isStalled(address, now) ||
+					inFlightCount[address] >= config.MaxBlocksInFlightPerPeer {
+					continue
+				}
+				if chosen == nil || inFlightCount[address] < inFlightCount[chosen.Meta.Address()] {
+					chosen = pc
+				}
+			}
+			if chosen == nil {
+				continue
+			}
+			address := chosen.Meta.Address()
+			hs.inFlight[key] = &blockRequest{Peer: address, Time: now}
+			inFlightCount[address] += 1
+			requests[address] = append(requests[address], InvItem{Type: InvBlock, Hash: header.Hash})
+			metas[address] = chosen.Meta
+		}
+		if now.Sub(hs.lastProgress) > time.Duration(config.SyncProgressInterval)*time.Millisecond {
+			hs.lastProgress = now
+			fmt.Printf("[Sync] Block %v / %v, %v block(s) in flight, %v downloaded.\n", nd.Chain.Tip().Height,
+				hs.tipHeight(nd.Chain), len(hs.inFlight), len(hs.downloaded))
+		}
+	}
+	hs.mu.Unlock()
+
+	if headerPeer != nil {
+		nd.SendGetHeadersMessage(*headerPeer, locator)
+	}
+	for address, items := range requests {
+		nd.SendGetDataMessage(metas[address], items)
+	}
+}
+
+type PeerSyncStatus struct {
+	Address  string
+	Height   int
+	InFlight int
+	Stalled  bool
+}
+
+type SyncStatus struct {
+	// HeaderHeight: height of header tip, equal to ChainHeight if there is no header chain
+	// InFlight: blocks requested, Downloaded: blocks waiting for their parents
+	ChainHeight  int
+	HeaderHeight int
+	SyncPeer     string
+	InFlight     int
+	Downloaded   int
+	Peers        []PeerSyncStatus
+}
+
+func (nd *Node) GetSyncStatus() SyncStatus {
+	peers := nd.connectedPeers()
+	hs := nd.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	now := time.Now()
+	status := SyncStatus{ChainHeight: nd.Chain.Tip().Height, HeaderHeight: hs.tipHeight(nd.Chain),
+		SyncPeer: hs.syncPeer, InFlight: len(hs.inFlight), Downloaded: len(hs.downloaded)}
+	inFlightCount := make(map[string]int)
+	for _, request := range hs.inFlight {
+		inFlightCount[request.Peer] += 1
+	}
+	for _, pc := range peers {
+		address := pc.Meta.Address()
+		status.Peers = append(status.Peers, PeerSyncStatus{Address: address,
+			Height: hs.peerHeight(pc), InFlight: inFlightCount[address],
+			Stalled: hs.isStalled(address, now)})
+	}
+	return status
+}
+
+func (status *SyncStatus) Log2Terminal() {
+	fmt.Printf("Chain height: %v\n", status.ChainHeight)
+	fmt.Printf("Header height: %v\n", status.HeaderHeight)
+	if status.SyncPeer != "" {
+		fmt.Printf("Syncing headers from: %v\n", status.SyncPeer)
+	}
+	fmt.Printf("Blocks in flight: %v, downloaded: %v\n", status.InFlight, status.Downloaded)
+	for _, peer := range status.Peers {
+		stalled := ""
+		if peer.Stalled {
+			stalled = " (stalled)"
+		}
+		fmt.Printf("Peer %s: height %v, %v block(s) in flight%s\n", peer.Address, peer.Height, peer.InFlight, stalled)
+	}
+}
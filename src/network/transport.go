@@ -0,0 +1,535 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages are sent over long-lived TCP connections, each message is a frame of
+// 4-byte network magic | 16-byte command (zero padded) | 4-byte big endian payload length | payload
+const (
+	magicLength       = 4
+	commandLength     = 16
+	frameHeaderLength = magicLength + commandLength + 4
+)
+
+var errMessageTooLarge = errors.New("message is too large")
+var errWrongMagic = errors.New("message is from another network")
+var errConnectedToSelf = errors.New("connected to self")
+var errTooManyConnections = errors.New("too many connections")
+var errNodeStopped = errors.New("node is stopped")
+var errPeerBanned = errors.New("peer is banned")
+
+type frame struct {
+	command string
+	payload []byte
+}
+
+type peerConn struct {
+	// Meta: key of the connection, messages from it are handled as coming from this address;
+	// it is the address we dialed for outbound connections, and the address an inbound
+	// connection comes from, since the listen address a peer claims may belong to someone else
+	// Version: what the peer told us in handshake, RTT: round trip time of handshake
+	// remoteIP: IP the connection comes from, misbehavior scores and bans are kept for it
+	conn     net.Conn
+	magic    uint32
+	remoteIP string
+	Meta     NetworkMetaData
+	Version  VersionMessage
+	Inbound  bool
+	RTT      time.Duration
+	writeMu  sync.Mutex
+	closed   bool
+	closedMu sync.Mutex
+}
+
+func encodeFrame(magic uint32, command string, payload []byte) ([]byte, error) {
+	if len(command) > commandLength {
+		return nil, fmt.Errorf("command %s is too long", command)
+	}
+	if len(payload) > config.MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", len(payload))
+	}
+	frame := make([]byte, frameHeaderLength, frameHeaderLength+len(payload))
+	binary.BigEndian.PutUint32(frame, magic)
+	copy(frame[magicLength:], command)
+	binary.BigEndian.PutUint32(frame[magicLength+commandLength:], uint32(len(payload)))
+	return append(frame, payload...), nil
+}
+
+func writeFrame(w io.Writer, magic uint32, command string, payload []byte) error {
+	frame, err := encodeFrame(magic, command, payload)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, magic uint32, maxSize int) (string, []byte, error) {
+	// payload may be at most maxSize bytes, a larger one is not read
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	if binary.BigEndian.Uint32(header) != magic {
+		return "", nil, errWrongMagic
+	}
+	command := string(bytes.TrimRight(header[magicLength:magicLength+commandLength], "\x00"))
+	length := binary.BigEndian.Uint32(header[magicLength+commandLength:])
+	if int64(length) > int64(maxSize) {
+		return "", nil, errMessageTooLarge
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	return command, payload, nil
+}
+
+func (pc *peerConn) send(command string, payload []byte) error {
+	// a frame that is not written before WriteTimeout leaves the stream broken, so the
+	// connection is dropped, and so is it on any other write error
+	frame, err := encodeFrame(pc.magic, command, payload)
+	if err != nil {
+		return err
+	}
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	deadline := time.Now().Add(time.Duration(config.WriteTimeout) * time.Millisecond)
+	if err := pc.conn.SetWriteDeadline(deadline); err != nil {
+		pc.close()
+		return err
+	}
+	if _, err := pc.conn.Write(frame); err != nil {
+		pc.close()
+		return err
+	}
+	return nil
+}
+
+func (pc *peerConn) close() {
+	pc.closedMu.Lock()
+	defer pc.closedMu.Unlock()
+	if !pc.closed {
+		pc.closed = true
+		pc.conn.Close()
+	}
+}
+
+func remoteMeta(conn net.Conn) NetworkMetaData {
+	// address of the other end of connection
+	address := conn.RemoteAddr().String()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return NetworkMetaData{Ip: address}
+	}
+	return NetworkMetaData{Ip: host, Port: port}
+}
+
+func newNodeID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	utils.Handle(err)
+	return hex.EncodeToString(id)
+}
+
+func (nd *Node) genesisHash() []byte {
+	genesis, found := nd.Chain.GetBlockByHeight(0)
+	if !found {
+		return []byte{}
+	}
+	return genesis.Hash
+}
+
+func (nd *Node) checkVersion(version VersionMessage) error {
+	// peers on another chain or protocol version, and connections to ourselves, are rejected
+	if version.ProtocolVersion != config.ProtocolVersion {
+		return fmt.Errorf("protocol version %d, expect %d", version.ProtocolVersion, config.ProtocolVersion)
+	}
+	if !bytes.Equal(version.GenesisHash, nd.genesisHash()) {
+		return fmt.Errorf("genesis block %x differs from ours", version.GenesisHash)
+	}
+	if version.NodeID == nd.NodeID {
+		return errConnectedToSelf
+	}
+	return nil
+}
+
+func (nd *Node) handshake(conn net.Conn, inbound bool) (*peerConn, error) {
+	// both sides send version, check the other one and confirm with verack
+	deadline := time.Now().Add(time.Duration(config.HandshakeTimeout) * time.Millisecond)
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	var result bytes.Buffer
+	var encoder = gob.NewEncoder(&result)
+	msg := CreateVersionMessage(nd.Meta, nd.genesisHash(), nd.Chain.Tip().Height, nd.NodeID)
+	if err := encoder.Encode(msg); err != nil {
+		return nil, err
+	}
+	sendTime := time.Now()
+	magic := nd.Chain.Params.Magic
+	if err := writeFrame(conn, magic, "version", result.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// check version of peer
+	command, payload, err := readFrame(conn, magic, config.MaxHandshakeMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	if command != "version" {
+		return nil, fmt.Errorf("expect version message, got %s", command)
+	}
+	var version VersionMessage
+	var decoder = gob.NewDecoder(bytes.NewReader(payload))
+	if err := decoder.Decode(&version); err != nil {
+		return nil, err
+	}
+	if err := nd.checkVersion(version); err != nil {
+		return nil, err
+	}
+
+	// confirm
+	if err := writeFrame(conn, magic, "verack", []byte{}); err != nil {
+		return nil, err
+	}
+	command, _, err = readFrame(conn, magic, config.MaxHandshakeMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	if command != "verack" {
+		return nil, fmt.Errorf("expect verack message, got %s", command)
+	}
+	rtt := time.Since(sendTime)
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &peerConn{conn: conn, magic: magic, remoteIP: remoteMeta(conn).Ip, Version: version, Inbound: inbound,
+		RTT: rtt}, nil
+}
+
+func (nd *Node) addConn(address string, pc *peerConn) *peerConn {
+	// at most one connection is used for sending to a peer, returns the one in use,
+	// or nil if node is stopped
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	if nd.connsClosed {
+		return nil
+	}
+	if existing, ok := nd.conns[address]; ok {
+		return existing
+	}
+	nd.conns[address] = pc
+	return pc
+}
+
+func (nd *Node) removeConn(address string, pc *peerConn) {
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	if nd.conns[address] == pc {
+		delete(nd.conns, address)
+	}
+}
+
+func (nd *Node) openConns() {
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	nd.connsClosed = false
+}
+
+func (nd *Node) closeConns() {
+	// close all connections, and refuse new ones until node starts again
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	nd.connsClosed = true
+	for _, pc := range nd.conns {
+		pc.close()
+	}
+}
+
+func (nd *Node) reserveSlot(inbound bool) error {
+	// connections count against MaxInbound / MaxOutbound from before dialing or handshake,
+	// so that ones set up at the same time can not go over the limit together
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	if nd.connsClosed {
+		return errNodeStopped
+	}
+	limit := nd.Config.Network.MaxOutbound
+	if inbound {
+		limit = nd.Config.Network.MaxInbound
+	}
+	count := nd.reserved[inbound]
+	for _, pc := range nd.conns {
+		if pc.Inbound == inbound {
+			count += 1
+		}
+	}
+	if count >= limit {
+		return errTooManyConnections
+	}
+	nd.reserved[inbound] += 1
+	return nil
+}
+
+func (nd *Node) releaseSlot(inbound bool) {
+	// called once the connection is in conns or given up
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	nd.reserved[inbound] -= 1
+}
+
+func (nd *Node) connectedPeers() []*peerConn {
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	peers := make([]*peerConn, 0, len(nd.conns))
+	for _, pc := range nd.conns {
+		peers = append(peers, pc)
+	}
+	return peers
+}
+
+func (nd *Node) dial(meta NetworkMetaData) (*peerConn, error) {
+	// dial peer and handshake, the connection is not added to conns, failures are recorded
+	// in connection pool
+	address := meta.Address()
+	conn, err := net.DialTimeout("tcp", address, time.Duration(config.HandshakeTimeout)*time.Millisecond)
+	if err != nil {
+		nd.ConnectionPool.MarkFailure(address)
+		return nil, err
+	}
+	// a host name is only known to be banned once it is resolved
+	if nd.IsBanned(remoteMeta(conn).Ip) {
+		conn.Close()
+		return nil, errPeerBanned
+	}
+	pc, err := nd.handshake(conn, false)
+	if err != nil {
+		conn.Close()
+		fmt.Printf("Reject peer %s: %v.\n", address, err)
+		if err == errConnectedToSelf {
+			nd.ConnectionPool.MarkSelf(address)
+		} else {
+			nd.ConnectionPool.MarkFailure(address)
+		}
+		return nil, err
+	}
+	pc.Meta = meta
+	return pc, nil
+}
+
+func (nd *Node) getConn(meta NetworkMetaData) (*peerConn, error) {
+	// reuse connection to peer, or dial and handshake a new one
+	address := meta.Address()
+	if nd.IsBanned(meta.Ip) {
+		return nil, errPeerBanned
+	}
+	nd.connMu.Lock()
+	existing, ok := nd.conns[address]
+	closed := nd.connsClosed
+	nd.connMu.Unlock()
+	if closed {
+		return nil, errNodeStopped
+	}
+	if ok {
+		return existing, nil
+	}
+	if err := nd.reserveSlot(false); err != nil {
+		return nil, err
+	}
+	defer nd.releaseSlot(false)
+	pc, err := nd.dial(meta)
+	if err != nil {
+		return nil, err
+	}
+	nd.ConnectionPool.MarkSeen(address, pc.RTT)
+	if used := nd.addConn(address, pc); used == nil {
+		pc.close()
+		return nil, errNodeStopped
+	} else if used != pc {
+		pc.close()
+		return used, nil
+	}
+	nd.goWorker(func() { nd.readLoop(pc) })
+	return pc, nil
+}
+
+func (nd *Node) acceptConn(conn net.Conn) {
+	// inbound connection is known by the address it comes from, replies go back over it
+	meta := remoteMeta(conn)
+	if nd.IsBanned(meta.Ip) {
+		conn.Close()
+		fmt.Printf("Reject peer %s: %v.\n", meta.Address(), errPeerBanned)
+		return
+	}
+	if err := nd.reserveSlot(true); err != nil {
+		conn.Close()
+		fmt.Printf("Reject peer %s: %v.\n", meta.Address(), err)
+		return
+	}
+	pc, err := nd.handshake(conn, true)
+	if err != nil {
+		nd.releaseSlot(true)
+		conn.Close()
+		fmt.Printf("Reject peer %s: %v.\n", meta.Address(), err)
+		return
+	}
+	pc.Meta = meta
+	used := nd.addConn(pc.Meta.Address(), pc)
+	nd.releaseSlot(true)
+	if used == nil {
+		pc.close()
+		return
+	}
+	nd.goWorker(func() { nd.verifyListenAddress(pc) })
+	nd.readLoop(pc)
+}
+
+func (nd *Node) reserveVerifyDial(ip string) bool {
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	if nd.connsClosed || nd.verifyDials[ip] >= config.MaxVerifyDialsPerIP {
+		return false
+	}
+	nd.verifyDials[ip] += 1
+	return true
+}
+
+func (nd *Node) releaseVerifyDial(ip string) {
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	nd.verifyDials[ip] -= 1
+	if nd.verifyDials[ip] == 0 {
+		delete(nd.verifyDials, ip)
+	}
+}
+
+func (nd *Node) verifyListenAddress(inbound *peerConn) {
+	// the address an inbound peer claims to listen on goes into connection pool as untried,
+	// a probe dial marks it seen if the same node is there, or removes it if another node is;
+	// the probe is closed after handshake, and too many probes to one IP are skipped
+	claimed := inbound.Version.Meta
+	if claimed.Address() == nd.Meta.Address() || nd.IsBanned(claimed.Ip) {
+		return
+	}
+	if !nd.ConnectionPool.AddPeer(claimed, utils.PeerInbound) {
+		return
+	}
+	if !nd.reserveVerifyDial(claimed.Ip) {
+		return
+	}
+	defer nd.releaseVerifyDial(claimed.Ip)
+	pc, err := nd.dial(claimed)
+	if err != nil {
+		return
+	}
+	pc.close()
+	if pc.Version.NodeID != inbound.Version.NodeID {
+		fmt.Printf("Peer %s claims to listen on %s, which is another node.\n", inbound.Meta.Address(),
+			claimed.Address())
+		nd.ConnectionPool.RemovePeer(claimed.Address())
+		return
+	}
+	nd.ConnectionPool.MarkSeen(claimed.Address(), pc.RTT)
+}
+
+func (nd *Node) readLoop(pc *peerConn) {
+	// read messages until connection breaks, they are handled one at a time in arrival order
+	// by dispatchLoop, and reading stops for a while when MaxQueuedMessages are waiting
+	// messages that can not be decoded or handled count as misbehavior of the peer
+	address := pc.Meta.Address()
+	queue := make(chan frame, config.MaxQueuedMessages)
+	nd.goWorker(func() { nd.dispatchLoop(pc, queue) })
+	defer func() {
+		close(queue)
+		pc.close()
+		nd.removeConn(address, pc)
+	}()
+	for {
+		command, payload, err := readFrame(pc.conn, pc.magic, config.MaxMessageSize)
+		if err == errMessageTooLarge || err == errWrongMagic {
+			nd.Misbehave(address, config.MalformedMessageScore, err.Error())
+			return
+		} else if err != nil {
+			return
+		}
+		atomic.AddUint64(&nd.Total_recv_bytes, uint64(frameHeaderLength+len(payload)))
+		nd.ConnectionPool.MarkSeen(address, 0)
+		if _, ok := nd.handlers[command]; !ok {
+			continue
+		}
+		queue <- frame{command: command, payload: payload}
+	}
+}
+
+func (nd *Node) dispatchLoop(pc *peerConn, queue <-chan frame) {
+	// messages of a peer that gets banned are not handled any more
+	for msg := range queue {
+		if !nd.IsBanned(pc.remoteIP) {
+			nd.dispatch(pc, msg)
+		}
+	}
+}
+
+func (nd *Node) dispatch(pc *peerConn, msg frame) {
+	address := pc.Meta.Address()
+	defer func() {
+		if r := recover(); r != nil {
+			nd.Misbehave(address, config.MalformedMessageScore, fmt.Sprintf("%s message: %v", msg.command, r))
+		}
+	}()
+	if err := nd.handlers[msg.command](pc.Meta, msg.payload); err != nil {
+		nd.Misbehave(address, config.MalformedMessageScore, fmt.Sprintf("%s message: %v", msg.command, err))
+	}
+}
+
+type ConnectionInfo struct {
+	Meta    NetworkMetaData
+	Inbound bool
+	NodeID  string
+	RTT     time.Duration
+}
+
+func (nd *Node) GetConnections() []ConnectionInfo {
+	var infos []ConnectionInfo
+	for _, pc := range nd.connectedPeers() {
+		infos = append(infos, ConnectionInfo{Meta: pc.Meta, Inbound: pc.Inbound, NodeID: pc.Version.NodeID,
+			RTT: pc.RTT})
+	}
+	return infos
+}
+
+func (nd *Node) ShowConnections() {
+	nd.connMu.Lock()
+	defer nd.connMu.Unlock()
+	inbound := 0
+	for _, pc := range nd.conns {
+		if pc.Inbound {
+			inbound += 1
+		}
+	}
+	fmt.Printf("Connected to %d peers, %d/%d inbound, %d/%d outbound.\n", len(nd.conns), inbound,
+		nd.Config.Network.MaxInbound, len(nd.conns)-inbound, nd.Config.Network.MaxOutbound)
+	for address, pc := range nd.conns {
+		direction := "outbound"
+		if pc.Inbound {
+			direction = "inbound"
+		}
+		fmt.Printf("    %s (%s), node %s, version %d, height %d\n", address, direction, pc.Version.NodeID,
+			pc.Version.ProtocolVersion, pc.Version.BestHeight)
+	}
+}
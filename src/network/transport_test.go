@@ -0,0 +1,142 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AntonyMei/Blockchain/config"
+)
+
+const testMagic = uint32(0x54455354)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	if err := writeFrame(&stream, testMagic, "getheaders", []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(&stream, testMagic, "verack", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() != 2*frameHeaderLength+len("payload") {
+		t.Fatalf("frames take %d bytes", stream.Len())
+	}
+	command, payload, err := readFrame(&stream, testMagic, config.MaxMessageSize)
+	if err != nil || command != "getheaders" || string(payload) != "payload" {
+		t.Fatalf("got %q %q %v", command, payload, err)
+	}
+	command, payload, err = readFrame(&stream, testMagic, config.MaxMessageSize)
+	if err != nil || command != "verack" || len(payload) != 0 {
+		t.Fatalf("got %q %q %v", command, payload, err)
+	}
+	if _, _, err := readFrame(&stream, testMagic, config.MaxMessageSize); err != io.EOF {
+		t.Fatalf("read past last frame: got %v", err)
+	}
+}
+
+func TestEncodeFrameLimits(t *testing.T) {
+	if _, err := encodeFrame(testMagic, "a-command-that-is-too-long", nil); err == nil {
+		t.Fatal("command longer than 16 bytes is encoded")
+	}
+	if _, err := encodeFrame(testMagic, "block", make([]byte, config.MaxMessageSize+1)); err == nil {
+		t.Fatal("payload larger than MaxMessageSize is encoded")
+	}
+}
+
+func TestReadFrameWrongMagic(t *testing.T) {
+	var stream bytes.Buffer
+	if err := writeFrame(&stream, testMagic+1, "ping", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readFrame(&stream, testMagic, config.MaxMessageSize); err != errWrongMagic {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	// only header is read, payload of a frame over the limit is never allocated
+	header := make([]byte, frameHeaderLength)
+	binary.BigEndian.PutUint32(header, testMagic)
+	copy(header[magicLength:], "version")
+	binary.BigEndian.PutUint32(header[magicLength+commandLength:], config.MaxHandshakeMessageSize+1)
+	stream := bytes.NewReader(append(header, make([]byte, 16)...))
+	if _, _, err := readFrame(stream, testMagic, config.MaxHandshakeMessageSize); err != errMessageTooLarge {
+		t.Fatalf("got %v", err)
+	}
+	if stream.Len() != 16 {
+		t.Fatalf("%d bytes of payload are read", 16-stream.Len())
+	}
+
+	// same frame is fine after handshake
+	binary.BigEndian.PutUint32(header[magicLength+commandLength:], 16)
+	stream = bytes.NewReader(append(header, make([]byte, 16)...))
+	if _, _, err := readFrame(stream, testMagic, config.MaxHandshakeMessageSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	if err := writeFrame(&stream, testMagic, "block", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	truncated := bytes.NewReader(stream.Bytes()[:stream.Len()-1])
+	if _, _, err := readFrame(truncated, testMagic, config.MaxMessageSize); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v", err)
+	}
+	truncated = bytes.NewReader(stream.Bytes()[:frameHeaderLength-1])
+	if _, _, err := readFrame(truncated, testMagic, config.MaxMessageSize); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReadLoopKeepsOrder(t *testing.T) {
+	// messages of one connection are handled one at a time in the order they are sent
+	const count = 100
+	self := NetworkMetaData{Ip: "localhost", Port: "1"}
+	nd := &Node{ConnectionPool: InitializeConnectionPool(self, filepath.Join(t.TempDir(), "peers"), 10),
+		conns: make(map[string]*peerConn), scores: make(map[string]int), bans: make(map[string]time.Time)}
+	var handled []string
+	running := 0
+	done := make(chan bool)
+	nd.handlers = map[string]func(NetworkMetaData, []byte) error{
+		"ping": func(peer NetworkMetaData, body []byte) error {
+			running += 1
+			if running > 1 {
+				t.Error("messages are handled at the same time")
+			}
+			time.Sleep(time.Millisecond)
+			handled = append(handled, string(body))
+			running -= 1
+			if len(handled) == count {
+				close(done)
+			}
+			return nil
+		},
+	}
+	client, server := net.Pipe()
+	pc := &peerConn{conn: server, magic: testMagic, Meta: NetworkMetaData{Ip: "localhost", Port: "2"}}
+	nd.goWorker(func() { nd.readLoop(pc) })
+	for i := 0; i < count; i++ {
+		if err := writeFrame(client, testMagic, "ping", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%d of %d messages handled", len(handled), count)
+	}
+	client.Close()
+	nd.workers.Wait()
+	for i, body := range handled {
+		if body != strconv.Itoa(i) {
+			t.Fatalf("message %s handled at position %d", body, i)
+		}
+	}
+}
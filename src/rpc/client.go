@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type Client struct {
+	// address: host:port of rpc server, token: its auth token
+	address string
+	token   string
+	client  *http.Client
+	nextID  int64
+}
+
+func NewClient(address string, token string, timeout time.Duration) *Client {
+	return &Client{address: address, token: token, client: &http.Client{Timeout: timeout}}
+}
+
+func (c *Client) Call(method string, params interface{}, result interface{}) error {
+	// an error returned by server is an *Error, result is left untouched if it is nil
+	request := Request{JSONRPC: "2.0", Method: method,
+		ID: json.RawMessage(fmt.Sprint(atomic.AddInt64(&c.nextID, 1)))}
+	if params != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		request.Params = encoded
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, "http://"+c.address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Authorization", "Bearer "+c.token)
+	httpResponse, err := c.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	content, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	var response Response
+	if err := json.Unmarshal(content, &response); err != nil {
+		return fmt.Errorf("unexpected response (%s): %s", httpResponse.Status, bytes.TrimSpace(content))
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,168 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandlerFunc decodes params of a method and returns its result, an *Error is sent to
+// caller as it is, other errors become ApplicationError
+type HandlerFunc func(params json.RawMessage) (interface{}, error)
+
+type Server struct {
+	// requests must carry "Authorization: Bearer [token]"
+	token    string
+	handlers map[string]HandlerFunc
+	server   *http.Server
+	mu       sync.Mutex
+}
+
+func NewServer(token string) *Server {
+	return &Server{token: token, handlers: make(map[string]HandlerFunc)}
+}
+
+func (s *Server) Register(method string, handler HandlerFunc) {
+	s.handlers[method] = handler
+}
+
+func DecodeParams(params json.RawMessage, v interface{}) error {
+	// unknown fields are rejected, so that typos in params do not go unnoticed
+	if len(params) == 0 {
+		return NewError(InvalidParams, "missing params")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return NewError(InvalidParams, "%v", err)
+	}
+	return nil
+}
+
+func (s *Server) Start(address string) error {
+	// listen and serve in background, returns once the port is taken
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server != nil {
+		return errors.New("rpc server is running")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(listener)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	// stop listening and let requests being handled finish, those still running after
+	// RPCShutdownTimeout are cut off
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server == nil {
+		return errors.New("rpc server is not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.RPCShutdownTimeout)*time.Millisecond)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = s.server.Close()
+	}
+	s.server = nil
+	return err
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		writeResponse(w, http.StatusUnauthorized, &Response{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: NewError(Unauthorized, "missing or wrong auth token")})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, config.MaxRPCRequestSize+1))
+	if err != nil {
+		return
+	}
+	if len(body) > config.MaxRPCRequestSize {
+		writeResponse(w, http.StatusRequestEntityTooLarge, &Response{JSONRPC: "2.0", ID: json.RawMessage("null"),
+			Error: NewError(InvalidRequest, "request is too large")})
+		return
+	}
+	writeResponse(w, http.StatusOK, s.handle(body))
+}
+
+func (s *Server) handle(body []byte) *Response {
+	var request Request
+	if err := json.Unmarshal(body, &request); err != nil {
+		return &Response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: NewError(ParseError, "%v", err)}
+	}
+	response := &Response{JSONRPC: "2.0", ID: request.ID}
+	if len(response.ID) == 0 {
+		response.ID = json.RawMessage("null")
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		response.Error = NewError(InvalidRequest, "expect jsonrpc 2.0 request with method")
+		return response
+	}
+	handler, ok := s.handlers[request.Method]
+	if !ok {
+		response.Error = NewError(MethodNotFound, "method %s not found", request.Method)
+		return response
+	}
+
+	// a panic in handler only fails this call
+	result, err := func() (result interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = NewError(InternalError, "%v", r)
+			}
+		}()
+		return handler(request.Params)
+	}()
+	if err != nil {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			rpcErr = NewError(ApplicationError, "%v", err)
+		}
+		response.Error = rpcErr
+		return response
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		response.Error = NewError(InternalError, "could not encode result: %v", err)
+		return response
+	}
+	response.Result = encoded
+	return response
+}
+
+func writeResponse(w http.ResponseWriter, status int, response *Response) {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(encoded)
+}
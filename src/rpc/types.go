@@ -0,0 +1,274 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/src/blocks"
+	"github.com/AntonyMei/Blockchain/src/transaction"
+)
+
+// JSON-RPC 2.0 messages, see https://www.jsonrpc.org/specification
+// hashes, ids and addresses are hex strings in params and results
+
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type Response struct {
+	// exactly one of Result and Error is set
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+const (
+	// error codes defined by JSON-RPC 2.0, ApplicationError is used for everything
+	// that fails inside a valid call, e.g. unknown wallet or locked wallets
+	ParseError       = -32700
+	InvalidRequest   = -32600
+	MethodNotFound   = -32601
+	InvalidParams    = -32602
+	InternalError    = -32603
+	ApplicationError = -32000
+	Unauthorized     = -32001
+)
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+func NewError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// params of methods, methods without params take none
+
+type GetBlockParams struct {
+	// block is looked up by Hash if it is given, otherwise by Height on best chain
+	Height int    `json:"height"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+type GetTransactionParams struct {
+	TxID string `json:"tx_id"`
+}
+
+type CreateWalletParams struct {
+	// Change: derive the wallet on change chain instead of receive chain
+	Name   string `json:"name"`
+	Change bool   `json:"change,omitempty"`
+}
+
+type GetBalanceParams struct {
+	// Name is a wallet of ours or a known address, Address is used if Name is empty
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+type GetHistoryParams GetBalanceParams
+
+type Payment struct {
+	// receiver is either a known address by Name, or Address
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+	Amount  int    `json:"amount"`
+}
+
+type SendTransactionParams struct {
+	// Name: name of the transaction in pending zone, From: name of our wallet that pays
+	Name string    `json:"name"`
+	From string    `json:"from"`
+	To   []Payment `json:"to"`
+	Fee  int       `json:"fee"`
+}
+
+type MineParams struct {
+	// Transactions: names of pending transactions, picked by fee rate if empty
+	Miner        string   `json:"miner"`
+	Description  string   `json:"description"`
+	Transactions []string `json:"transactions,omitempty"`
+}
+
+type GenerateParams struct {
+	// regtest only, coinbase pays a wallet of ours or a known address by Name, or Address
+	Blocks  int    `json:"blocks"`
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+type SetMockTimeParams struct {
+	// regtest only, Time: milliseconds since epoch, 0 to use system time again
+	Time int64 `json:"time"`
+}
+
+type UnlockParams struct {
+	// Timeout: seconds until wallets are locked again, never if 0
+	Passphrase string `json:"passphrase"`
+	Timeout    int    `json:"timeout"`
+}
+
+type PingParams struct {
+	Ip   string `json:"ip"`
+	Port string `json:"port"`
+}
+
+// results of methods
+
+type BlockchainInfo struct {
+	Height     int    `json:"height"`
+	BestHash   string `json:"best_hash"`
+	Difficulty int    `json:"difficulty"`
+	Work       string `json:"work"`
+}
+
+type TxInputResult struct {
+	SourceTxID  string `json:"source_tx_id"`
+	TxOutputIdx int    `json:"tx_output_idx"`
+	PubKey      string `json:"pub_key"`
+}
+
+type TxOutputResult struct {
+	Value      int    `json:"value"`
+	PubKeyHash string `json:"pub_key_hash"`
+}
+
+type TransactionResult struct {
+	TxID     string           `json:"tx_id"`
+	Coinbase bool             `json:"coinbase"`
+	Inputs   []TxInputResult  `json:"inputs"`
+	Outputs  []TxOutputResult `json:"outputs"`
+}
+
+type BlockResult struct {
+	Hash         string              `json:"hash"`
+	PrevHash     string              `json:"prev_hash"`
+	MerkleRoot   string              `json:"merkle_root"`
+	Data         string              `json:"data"`
+	Height       int                 `json:"height"`
+	Timestamp    int64               `json:"timestamp"`
+	Nonce        int                 `json:"nonce"`
+	Difficulty   int                 `json:"difficulty"`
+	Transactions []TransactionResult `json:"transactions"`
+}
+
+type GetTransactionResult struct {
+	// a transaction is either pending (with its name in pending zone) or in a block on best chain
+	Transaction TransactionResult `json:"transaction"`
+	Pending     bool              `json:"pending"`
+	Name        string            `json:"name,omitempty"`
+	BlockHash   string            `json:"block_hash,omitempty"`
+	BlockHeight int               `json:"block_height,omitempty"`
+}
+
+type WalletResult struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Path    string `json:"path,omitempty"`
+	Balance int    `json:"balance"`
+}
+
+type KnownAddressResult struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type BalanceResult struct {
+	Address string `json:"address"`
+	Balance int    `json:"balance"`
+}
+
+type HistoryEntry struct {
+	Height      int    `json:"height"`
+	TxID        string `json:"tx_id"`
+	TxOutputIdx int    `json:"tx_output_idx"`
+	Value       int    `json:"value"`
+}
+
+type SendTransactionResult struct {
+	Name string `json:"name"`
+	TxID string `json:"tx_id"`
+}
+
+type PendingTransactionResult struct {
+	Name        string `json:"name"`
+	TxID        string `json:"tx_id"`
+	Size        int    `json:"size"`
+	Fee         int    `json:"fee"`
+	ArrivalTime int64  `json:"arrival_time"`
+}
+
+type GenerateResult struct {
+	// Hashes: generated blocks, in chain order
+	Hashes []string `json:"hashes"`
+	Height int      `json:"height"`
+}
+
+type MineResult struct {
+	// Hash and Height are only set if Status is MiningSucceeded
+	Status string `json:"status"`
+	Hash   string `json:"hash,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+type PeerResult struct {
+	// LastSeen: unix time in milliseconds, 0 if never; RTT in microseconds
+	Address   string `json:"address"`
+	Source    string `json:"source"`
+	LastSeen  int64  `json:"last_seen"`
+	RTT       int64  `json:"rtt"`
+	Failures  int    `json:"failures"`
+	Connected bool   `json:"connected"`
+	Inbound   bool   `json:"inbound"`
+	Height    int    `json:"height"`
+}
+
+type PeerSyncResult struct {
+	Address  string `json:"address"`
+	Height   int    `json:"height"`
+	InFlight int    `json:"in_flight"`
+	Stalled  bool   `json:"stalled"`
+}
+
+type SyncStatusResult struct {
+	ChainHeight  int              `json:"chain_height"`
+	HeaderHeight int              `json:"header_height"`
+	SyncPeer     string           `json:"sync_peer,omitempty"`
+	InFlight     int              `json:"in_flight"`
+	Downloaded   int              `json:"downloaded"`
+	Peers        []PeerSyncResult `json:"peers"`
+}
+
+func NewTransactionResult(tx *transaction.Transaction) TransactionResult {
+	result := TransactionResult{TxID: hex.EncodeToString(tx.TxID), Coinbase: tx.IsCoinbase(),
+		Inputs: []TxInputResult{}, Outputs: []TxOutputResult{}}
+	for _, input := range tx.TxInputList {
+		result.Inputs = append(result.Inputs, TxInputResult{SourceTxID: hex.EncodeToString(input.SourceTxID),
+			TxOutputIdx: input.TxOutputIdx, PubKey: hex.EncodeToString(input.PubKey)})
+	}
+	for _, output := range tx.TxOutputList {
+		result.Outputs = append(result.Outputs, TxOutputResult{Value: output.Value,
+			PubKeyHash: hex.EncodeToString(output.PubKeyHash)})
+	}
+	return result
+}
+
+func NewBlockResult(block *blocks.Block) BlockResult {
+	result := BlockResult{Hash: hex.EncodeToString(block.Hash), PrevHash: hex.EncodeToString(block.PrevHash),
+		MerkleRoot: hex.EncodeToString(block.GetMerkleRoot()), Data: string(block.Data), Height: block.Height,
+		Timestamp: block.Timestamp, Nonce: block.Nonce, Difficulty: block.Difficulty,
+		Transactions: []TransactionResult{}}
+	for _, tx := range block.TransactionList {
+		result.Transactions = append(result.Transactions, NewTransactionResult(tx))
+	}
+	return result
+}
@@ -13,7 +13,7 @@ import (
 	"github.com/AntonyMei/Blockchain/src/network"
 	//"github.com/AntonyMei/Blockchain/src/transaction"
 	"github.com/AntonyMei/Blockchain/src/utils"
-	//"github.com/AntonyMei/Blockchain/src/wallet"
+	"github.com/AntonyMei/Blockchain/src/wallet"
 	//"github.com/AntonyMei/Blockchain/src/cli"
 )
 
@@ -43,10 +43,11 @@ func Test_Network_Data_Bytes(num_nodes int, node_id int, Txs_Per_Block int, Outs
 	} 
 
 	// cli
-	err := os.Mkdir(config.PersistentStoragePath+userName, os.ModePerm)
+	cfg := config.Default()
+	err := os.Mkdir(cfg.UserPath(userName), os.ModePerm)
 	utils.Handle(err)
-	c := cli.InitializeCli(userName, ip, port)
-	c.CreateWallet(userName)
+	c := cli.InitializeCli(cfg, userName, ip, port)
+	c.CreateWallet(userName, wallet.ReceiveChain)
 
 	time.Sleep(time.Duration(100) * time.Millisecond)
 
@@ -56,7 +57,7 @@ func Test_Network_Data_Bytes(num_nodes int, node_id int, Txs_Per_Block int, Outs
 		accountNames := c.Wallets.GetAllWalletNames()
 		for _, name := range accountNames {
 			wallet := c.Wallets.GetWallet(name)
-			user_meta := network.UserMetaData{Name: name, PublicKey: wallet.PublicKey, WalletAddr: wallet.Address()}
+			user_meta := network.UserMetaData{Name: name, PublicKey: wallet.PublicKey, WalletAddr: wallet.Address(c.Wallets.Params)}
 			c.Node.BroadcastUserMessage(user_meta)
 		}
 		if len(c.Wallets.KnownAddressMap) == num_nodes {
@@ -88,7 +89,7 @@ func Test_Network_Data_Bytes(num_nodes int, node_id int, Txs_Per_Block int, Outs
 		if !init {
 			// Mine untill 10000 balance for warmup
 			res := c.Wallets.GetWallet(userName)
-			balance := c.Blockchain.GetBalance(res.Address(), &res.PrivateKey.PublicKey)
+			balance := c.UTXOSet.GetBalance(res.PubKeyHash())
 			if balance >= 10000 {
 				quit <- 1
 				init = true
@@ -150,7 +151,7 @@ func Test_Network_Data_Bytes(num_nodes int, node_id int, Txs_Per_Block int, Outs
 							}
 						}
 					}
-					myTx = c.CreateTransaction("tx", userName, outs, amounts)
+					myTx = c.CreateTransaction("tx", userName, outs, amounts, 0)
 				}
 				
 				fmt.Printf("Generate new transaction list\n")
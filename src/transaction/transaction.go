@@ -9,25 +9,38 @@ import (
 	"fmt"
 	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/AntonyMei/Blockchain/src/wallet"
 )
 
 type TxOutput struct {
 	// Value: number of coins used
-	// Address: address of receiver
-	Value   int
-	Address []byte
+	// PubKeyHash: hash of receiver's public key, only the owner of that key can spend it
+	Value      int
+	PubKeyHash []byte
 }
 
-func (txo *TxOutput) BelongsTo(addr []byte) bool {
-	return bytes.Compare(txo.Address, addr) == 0
+func NewTxOutput(value int, address []byte) TxOutput {
+	// create an output that pays value to given address
+	txo := TxOutput{Value: value}
+	txo.Lock(address)
+	return txo
+}
+
+func (txo *TxOutput) Lock(address []byte) {
+	// lock the output with public key hash contained in address
+	txo.PubKeyHash = wallet.AddressToPubKeyHash(address)
+}
+
+func (txo *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
+	return bytes.Compare(txo.PubKeyHash, pubKeyHash) == 0
 }
 
 func (txo *TxOutput) Log2Terminal() {
-	fmt.Printf("[TX Output] Give %v coins to account %x.\n", txo.Value, txo.Address)
+	fmt.Printf("[TX Output] Give %v coins to public key hash %x.\n", txo.Value, txo.PubKeyHash)
 }
 
 func (txo *TxOutput) Serialize() []byte {
-	serialized := bytes.Join([][]byte{txo.Address, utils.Int2Hex(int64(txo.Value))}, []byte{})
+	serialized := bytes.Join([][]byte{txo.PubKeyHash, utils.Int2Hex(int64(txo.Value))}, []byte{})
 	return serialized
 }
 
@@ -35,37 +48,39 @@ type TxInput struct {
 	// SourceTxID: ID of source Transaction
 	// TxOutputIdx: index of source TxOutput in source Transaction
 	// Sig: signed by owner of source TXO
+	// PubKey: public key of owner of source TXO, its hash must match the one in source TXO
 	SourceTxID  []byte
 	TxOutputIdx int
 	Sig         string
+	PubKey      []byte
 }
 
-func (source *TxInput) Sign(privateKey *ecdsa.PrivateKey) {
-	// hash the TxInput into a byte array
-	source.Sig = ""
-	var result bytes.Buffer
-	var encoder = gob.NewEncoder(&result)
-	utils.Handle(encoder.Encode(source))
-	hashedValue := sha256.Sum256(result.Bytes())
-	// sign the hashed value with privateKey
-	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, hashedValue[:])
-	utils.Handle(err)
+func (source *TxInput) UsesKey(pubKeyHash []byte) bool {
+	// check whether this input is spent by owner of pubKeyHash
+	return bytes.Compare(wallet.PublicKeyHash(source.PubKey), pubKeyHash) == 0
+}
+
+func (source *TxInput) Sign(sigHash []byte, privateKey *ecdsa.PrivateKey) error {
+	// sign the signature hash of the transaction this input belongs to, see Transaction.SignatureHash
+	// private key of a locked wallet is not in memory
+	if privateKey == nil || privateKey.D == nil {
+		return wallet.ErrWalletLocked
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, sigHash)
+	if err != nil {
+		return err
+	}
 	source.Sig = string(signature)
+	return nil
 }
 
-func (source *TxInput) Verify(publicKey *ecdsa.PublicKey) bool {
+func (source *TxInput) Verify(sigHash []byte, publicKey *ecdsa.PublicKey) bool {
 	// if input value is nil, we check whether it is coinbase signature
 	if publicKey == nil {
 		return source.Sig == config.CoinbaseSig
 	}
-	// hash a Copy of source into a byte array
-	sourceCopy := TxInput{SourceTxID: source.SourceTxID, TxOutputIdx: source.TxOutputIdx, Sig: ""}
-	var stream bytes.Buffer
-	var encoder = gob.NewEncoder(&stream)
-	utils.Handle(encoder.Encode(sourceCopy))
-	hashedValue := sha256.Sum256(stream.Bytes())
 	// check whether the signature is correct
-	result := ecdsa.VerifyASN1(publicKey, hashedValue[:], []byte(source.Sig))
+	result := ecdsa.VerifyASN1(publicKey, sigHash, []byte(source.Sig))
 	return result
 }
 
@@ -76,13 +91,16 @@ func (source *TxInput) Log2Terminal() {
 
 func (source *TxInput) Serialize() []byte {
 	serialized := bytes.Join([][]byte{source.SourceTxID, utils.Int2Hex(int64(source.TxOutputIdx)),
-		[]byte(source.Sig)}, []byte{})
+		[]byte(source.Sig), source.PubKey}, []byte{})
 	return serialized
 }
 
 type Transaction struct {
 	// Note that each address can appear at most once in the output list
+	// Token: random bytes of a coinbase TX, coinbase TXes share the same input, so the token
+	// keeps IDs of those paying the same amount to the same miner apart, empty for other TXes
 	TxID         []byte
+	Token        []byte
 	TxInputList  []TxInput
 	TxOutputList []TxOutput
 	//Str            string // a meaningless string only for making the transaction large (test network bytes use)
@@ -98,7 +116,8 @@ func (tx *Transaction) SetID() {
 	}
 	tx.Str = string(b)*/
 	//tx.Str = ""
-	var raw []byte
+	// token goes first, with its length, see Token
+	raw := bytes.Join([][]byte{utils.Int2Hex(int64(len(tx.Token))), tx.Token}, []byte{})
 	for _, input := range tx.TxInputList {
 		raw = bytes.Join([][]byte{raw, input.Serialize()}, []byte{})
 	}
@@ -112,13 +131,69 @@ func (tx *Transaction) SetID() {
 	//tx.Log2Terminal()
 }
 
+func (tx *Transaction) HasValidID() bool {
+	// check that TxID is the hash of token, inputs and outputs
+	txCopy := Transaction{Token: tx.Token, TxInputList: tx.TxInputList, TxOutputList: tx.TxOutputList}
+	txCopy.SetID()
+	return bytes.Compare(txCopy.TxID, tx.TxID) == 0
+}
+
+func (tx *Transaction) SignatureHash(networkID string, inputIdx int) []byte {
+	// signature hash commits to network id of the chain, all inputs (without signatures), all outputs
+	// and the index of the input being signed, so that none of them can be changed
+	// after the transaction is signed
+	raw := bytes.Join([][]byte{[]byte(networkID), utils.Int2Hex(int64(inputIdx)),
+		utils.Int2Hex(int64(len(tx.TxInputList)))}, []byte{})
+	for _, input := range tx.TxInputList {
+		raw = bytes.Join([][]byte{raw, utils.Int2Hex(int64(len(input.SourceTxID))), input.SourceTxID,
+			utils.Int2Hex(int64(input.TxOutputIdx)),
+			utils.Int2Hex(int64(len(input.PubKey))), input.PubKey}, []byte{})
+	}
+	raw = bytes.Join([][]byte{raw, utils.Int2Hex(int64(len(tx.TxOutputList)))}, []byte{})
+	for _, output := range tx.TxOutputList {
+		raw = bytes.Join([][]byte{raw, utils.Int2Hex(int64(output.Value)),
+			utils.Int2Hex(int64(len(output.PubKeyHash))), output.PubKeyHash}, []byte{})
+	}
+	hash := sha256.Sum256(raw)
+	return hash[:]
+}
+
+func (tx *Transaction) Sign(networkID string, privateKey *ecdsa.PrivateKey) error {
+	// sign every input, all inputs and outputs must be in place before signing
+	for idx := range tx.TxInputList {
+		if err := tx.TxInputList[idx].Sign(tx.SignatureHash(networkID, idx), privateKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Transaction) VerifyInput(networkID string, inputIdx int) bool {
+	// check whether the input at inputIdx is signed by owner of the public key it carries
+	input := tx.TxInputList[inputIdx]
+	if len(input.PubKey) == 0 {
+		return false
+	}
+	publicKey := wallet.DeserializePublicKey(input.PubKey)
+	return input.Verify(tx.SignatureHash(networkID, inputIdx), &publicKey)
+}
+
 func (tx *Transaction) IsCoinbase() bool {
-	// Check whether a tx is coinbase tx
+	// Check whether a tx is coinbase tx, its value is checked against fees by block validation
+	// coinbase of genesis may pay premine to several outputs
 	condition1 := len(tx.TxInputList) == 1 && len(tx.TxInputList[0].SourceTxID) == 0 && tx.TxInputList[0].TxOutputIdx == -1 && tx.TxInputList[0].Sig == config.CoinbaseSig
-	condition2 := len(tx.TxOutputList) == 1 && tx.TxOutputList[0].Value == config.MiningReward
+	condition2 := len(tx.TxOutputList) >= 1
 	return condition1 && condition2
 }
 
+func (tx *Transaction) Size() int {
+	// serialized size of the transaction, used by block size limit and fee rate
+	var encoded bytes.Buffer
+	encoder := gob.NewEncoder(&encoded)
+	utils.Handle(encoder.Encode(tx))
+	return encoded.Len()
+}
+
 func (tx *Transaction) Log2Terminal() {
 	fmt.Printf("[Transaction] TxID %x\n", tx.TxID)
 	for _, input := range tx.TxInputList {
@@ -130,14 +205,19 @@ func (tx *Transaction) Log2Terminal() {
 	fmt.Println()
 }
 
-func CoinbaseTx(minerAddr []byte) *Transaction {
-	// coinbase transaction has no input, and gives MiningReward to miner
-	input := TxInput{[]byte{}, -1, config.CoinbaseSig}
-	output := TxOutput{config.MiningReward, minerAddr}
-	// to identify different coinbase TXes, we add randomness to initial TxID
+func CoinbaseTx(minerAddr []byte, reward int, fees int) *Transaction {
+	// coinbase transaction has no input, and gives mining reward plus fees of the block to miner
+	// to identify different coinbase TXes, we add a random token
 	token := make([]byte, 32)
 	_, _ = rand.Read(token)
-	transaction := Transaction{token, []TxInput{input}, []TxOutput{output}}
+	return CoinbaseTxWithToken(minerAddr, reward, fees, token)
+}
+
+func CoinbaseTxWithToken(minerAddr []byte, reward int, fees int, token []byte) *Transaction {
+	// same as CoinbaseTx, token must differ between coinbase TXes paying the same amount to the same miner
+	input := TxInput{SourceTxID: []byte{}, TxOutputIdx: -1, Sig: config.CoinbaseSig}
+	output := NewTxOutput(reward+fees, minerAddr)
+	transaction := Transaction{Token: token, TxInputList: []TxInput{input}, TxOutputList: []TxOutput{output}}
 	transaction.SetID()
 	return &transaction
 }
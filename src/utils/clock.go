@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock gives chain time (block timestamps, timestamp checks and expiry of pending transactions),
+// so that regtest can set it. Network timeouts always use system time.
+type Clock struct {
+	// mockTime: milliseconds returned by Now, system time is used if it is 0
+	mockTime int64
+}
+
+func (c *Clock) SetMockTime(milliseconds int64) {
+	// 0 switches back to system time
+	atomic.StoreInt64(&c.mockTime, milliseconds)
+}
+
+func (c *Clock) Now() time.Time {
+	// nil clock always uses system time
+	if c == nil {
+		return time.Now()
+	}
+	if milliseconds := atomic.LoadInt64(&c.mockTime); milliseconds != 0 {
+		return time.UnixMilli(milliseconds)
+	}
+	return time.Now()
+}
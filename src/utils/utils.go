@@ -24,6 +24,14 @@ const (
 	WrongTXInputSignature
 	InputSumOutputSumMismatch
 	DoubleSpending
+	WrongDifficulty
+	WrongTimestamp
+	WrongTXInputPublicKey
+	WrongHeight
+	WrongTXOutputValue
+	WrongCoinbaseValue
+	BlockTooLarge
+	DuplicateTX
 )
 
 func (bs BlockStatus) String() string {
@@ -48,6 +56,93 @@ func (bs BlockStatus) String() string {
 		return "InputSumOutputSumMismatch"
 	case DoubleSpending:
 		return "DoubleSpending"
+	case WrongDifficulty:
+		return "WrongDifficulty"
+	case WrongTimestamp:
+		return "WrongTimestamp"
+	case WrongTXInputPublicKey:
+		return "WrongTXInputPublicKey"
+	case WrongHeight:
+		return "WrongHeight"
+	case WrongTXOutputValue:
+		return "WrongTXOutputValue"
+	case WrongCoinbaseValue:
+		return "WrongCoinbaseValue"
+	case BlockTooLarge:
+		return "BlockTooLarge"
+	case DuplicateTX:
+		return "DuplicateTX"
+	}
+	return "Unknown"
+}
+
+type MiningStatus int64
+
+const (
+	MiningSucceeded = iota
+	MiningCancelled
+	MiningExhausted
+)
+
+func (ms MiningStatus) String() string {
+	switch ms {
+	case MiningSucceeded:
+		return "MiningSucceeded"
+	case MiningCancelled:
+		return "MiningCancelled"
+	case MiningExhausted:
+		return "MiningExhausted"
+	}
+	return "Unknown"
+}
+
+type MempoolStatus int64
+
+const (
+	TXAccepted = iota
+	TXAlreadyKnown
+	TXInvalid
+	TXConflict
+	TXPoolFull
+	TXMissingInputs
+)
+
+func (ms MempoolStatus) String() string {
+	switch ms {
+	case TXAccepted:
+		return "TXAccepted"
+	case TXAlreadyKnown:
+		return "TXAlreadyKnown"
+	case TXInvalid:
+		return "TXInvalid"
+	case TXConflict:
+		return "TXConflict"
+	case TXPoolFull:
+		return "TXPoolFull"
+	case TXMissingInputs:
+		return "TXMissingInputs"
+	}
+	return "Unknown"
+}
+
+type PeerSource int64
+
+const (
+	// PeerManual: added with ping command, PeerGossip: learned from peers message
+	// PeerInbound: connected to us
+	PeerManual = iota
+	PeerGossip
+	PeerInbound
+)
+
+func (ps PeerSource) String() string {
+	switch ps {
+	case PeerManual:
+		return "PeerManual"
+	case PeerGossip:
+		return "PeerGossip"
+	case PeerInbound:
+		return "PeerInbound"
 	}
 	return "Unknown"
 }
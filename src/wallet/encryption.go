@@ -0,0 +1,74 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// secrets of wallet file (mnemonic and random keys) are encrypted with XChaCha20-Poly1305
+// under a key derived from the passphrase with scrypt
+var (
+	ErrWalletLocked    = errors.New("wallet is locked")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+type encryptedSecret struct {
+	// Salt and scrypt parameters are needed to derive the key again from passphrase
+	Salt       []byte
+	ScryptN    int
+	ScryptR    int
+	ScryptP    int
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func newEncryptedSecret(passphrase string) (encryptedSecret, []byte) {
+	// a fresh salt with current scrypt parameters, returns key derived from passphrase
+	secret := encryptedSecret{Salt: make([]byte, config.WalletSaltLength), ScryptN: config.WalletScryptN,
+		ScryptR: config.WalletScryptR, ScryptP: config.WalletScryptP}
+	_, err := rand.Read(secret.Salt)
+	utils.Handle(err)
+	key, err := secret.deriveKey(passphrase)
+	utils.Handle(err)
+	return secret, key
+}
+
+func (secret *encryptedSecret) deriveKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), secret.Salt, secret.ScryptN, secret.ScryptR, secret.ScryptP,
+		chacha20poly1305.KeySize)
+}
+
+func (secret *encryptedSecret) seal(key []byte, plaintext []byte) error {
+	// encrypt plaintext with a new random nonce
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	secret.Nonce = nonce
+	secret.Ciphertext = aead.Seal(nil, nonce, plaintext, nil)
+	return nil
+}
+
+func (secret *encryptedSecret) open(key []byte) ([]byte, error) {
+	// authentication fails if key is wrong or file is tampered with
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret.Nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := aead.Open(nil, secret.Nonce, secret.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,42 @@
+package wallet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptedSecretRoundTrip(t *testing.T) {
+	secret, key := newEncryptedSecret("correct horse")
+	if err := secret.seal(key, []byte("mnemonic words")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(secret.Ciphertext, []byte("mnemonic words")) {
+		t.Fatal("ciphertext contains plaintext")
+	}
+
+	// key is derived again from passphrase and saved salt
+	key, err := secret.deriveKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := secret.open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "mnemonic words" {
+		t.Fatalf("got %q after round trip", plaintext)
+	}
+
+	// wrong passphrase and tampered ciphertext are both rejected
+	wrongKey, err := secret.deriveKey("wrong horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secret.open(wrongKey); err != ErrWrongPassphrase {
+		t.Fatalf("open with wrong passphrase: got %v", err)
+	}
+	secret.Ciphertext[0] ^= 1
+	if _, err := secret.open(key); err != ErrWrongPassphrase {
+		t.Fatalf("open tampered secret: got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/AntonyMei/Blockchain/config"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// HD wallets follow BIP32 key derivation on P-256, every personal wallet is a key
+// at path m/44'/HDCoinType'/0'/chain/index derived from a single seed
+const (
+	HardenedOffset = uint32(1) << 31
+	ReceiveChain   = uint32(0)
+	ChangeChain    = uint32(1)
+)
+
+type ExtendedKey struct {
+	// Key: private key, ChainCode: extra entropy for deriving children
+	Key       *big.Int
+	ChainCode []byte
+}
+
+func NewMasterKey(seed []byte) *ExtendedKey {
+	// master key is the left half of HMAC-SHA512(HDSeedKey, seed), rehash in the
+	// (negligible) case that it is not a valid private key
+	n := elliptic.P256().Params().N
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, []byte(config.HDSeedKey))
+		mac.Write(data)
+		sum := mac.Sum(nil)
+		key := new(big.Int).SetBytes(sum[:32])
+		if key.Sign() != 0 && key.Cmp(n) < 0 {
+			return &ExtendedKey{Key: key, ChainCode: sum[32:]}
+		}
+		data = sum
+	}
+}
+
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	// derive child private key, hardened children (index >= HardenedOffset) can not
+	// be derived from the parent public key
+	curve := elliptic.P256()
+	var data []byte
+	if index >= HardenedOffset {
+		data = append([]byte{0x00}, k.Key.FillBytes(make([]byte, 32))...)
+	} else {
+		x, y := curve.ScalarBaseMult(k.Key.FillBytes(make([]byte, 32)))
+		data = elliptic.MarshalCompressed(curve, x, y)
+	}
+	indexBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(indexBytes, index)
+	data = append(data, indexBytes...)
+	mac := hmac.New(sha512.New, k.ChainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	tweak := new(big.Int).SetBytes(sum[:32])
+	if tweak.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid child index")
+	}
+	childKey := new(big.Int).Add(tweak, k.Key)
+	childKey.Mod(childKey, curve.Params().N)
+	if childKey.Sign() == 0 {
+		return nil, errors.New("invalid child index")
+	}
+	return &ExtendedKey{Key: childKey, ChainCode: sum[32:]}, nil
+}
+
+func WalletPath(chain uint32, index uint32) string {
+	return fmt.Sprintf("m/44'/%d'/0'/%d/%d", config.HDCoinType, chain, index)
+}
+
+func (k *ExtendedKey) DerivePath(path string) (*ExtendedKey, error) {
+	// derive key at path like m/44'/1'/0'/0/3, ' marks hardened levels
+	levels := strings.Split(path, "/")
+	if len(levels) == 0 || levels[0] != "m" {
+		return nil, errors.New("derivation path must start with m")
+	}
+	key := k
+	for _, level := range levels[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(level, "'") {
+			offset = HardenedOffset
+			level = strings.TrimSuffix(level, "'")
+		}
+		index, err := strconv.ParseUint(level, 10, 31)
+		if err != nil {
+			return nil, errors.New("could not parse derivation path " + path)
+		}
+		key, err = key.Child(uint32(index) + offset)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (k *ExtendedKey) Wallet(path string) *Wallet {
+	// turn the key into a wallet, path is kept so that the wallet can be derived again
+	curve := elliptic.P256()
+	privateKey := ecdsa.PrivateKey{D: new(big.Int).Set(k.Key)}
+	privateKey.PublicKey.Curve = curve
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(k.Key.FillBytes(make([]byte, 32)))
+	return &Wallet{PrivateKey: privateKey, PublicKey: SerializePublicKey(&privateKey.PublicKey), Path: path}
+}
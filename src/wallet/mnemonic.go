@@ -0,0 +1,116 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"github.com/AntonyMei/Blockchain/config"
+	"github.com/AntonyMei/Blockchain/src/utils"
+	"golang.org/x/crypto/pbkdf2"
+	"strings"
+)
+
+// A mnemonic is the seed entropy written as words, one word per byte, followed by
+// one checksum word (first byte of sha256 of entropy). Every word is identified by
+// its first four letters, so typos after that are harmless.
+var mnemonicWordList = [256]string{
+	"able", "acid", "acorn", "actor", "adult", "agent", "alarm", "album",
+	"alert", "alley", "alpha", "amber", "angle", "ankle", "apple", "april",
+	"arena", "argue", "armor", "arrow", "atlas", "attic", "audio", "autumn",
+	"award", "bacon", "badge", "baker", "bamboo", "banana", "banner", "barrel",
+	"basket", "beach", "beard", "beaver", "bench", "berry", "bicycle", "bird",
+	"blanket", "blossom", "board", "bonus", "boost", "bottle", "brain", "brave",
+	"bread", "brick", "bridge", "brisk", "bronze", "brush", "bubble", "bucket",
+	"budget", "buffalo", "bundle", "burger", "butter", "cabin", "cactus", "camel",
+	"canal", "candle", "canvas", "carbon", "cargo", "carpet", "castle", "cattle",
+	"cave", "cedar", "cereal", "chair", "chalk", "cherry", "chess", "chicken",
+	"chimney", "circle", "citrus", "clay", "cliff", "clock", "cloud", "clover",
+	"coach", "cobalt", "coconut", "comet", "copper", "coral", "cosmos", "cotton",
+	"cousin", "cradle", "crane", "crater", "cricket", "crystal", "curtain", "cushion",
+	"daisy", "dancer", "dawn", "delta", "denim", "desert", "diamond", "dinner",
+	"dolphin", "donkey", "dragon", "drawer", "dream", "drift", "drum", "eagle",
+	"earth", "echo", "elbow", "elder", "ember", "engine", "equal", "eraser",
+	"evening", "fabric", "falcon", "fancy", "feather", "fence", "ferry", "fiber",
+	"fiddle", "finger", "flame", "flock", "flower", "forest", "fossil", "fox",
+	"frost", "fruit", "galaxy", "garden", "garlic", "gentle", "ginger", "giraffe",
+	"glacier", "glove", "goat", "gold", "gorilla", "grape", "gravel", "guitar",
+	"hammer", "harbor", "harvest", "hazel", "helmet", "hero", "hollow", "honey",
+	"horizon", "hotel", "humble", "igloo", "indigo", "island", "ivory", "jacket",
+	"jaguar", "jelly", "jewel", "jungle", "kettle", "kidney", "kitten", "ladder",
+	"lagoon", "lamp", "lantern", "lemon", "leopard", "letter", "lily", "lizard",
+	"lobster", "lunar", "magnet", "mango", "maple", "marble", "meadow", "melody",
+	"mirror", "monkey", "mountain", "muffin", "napkin", "nectar", "needle", "nickel",
+	"noble", "oasis", "ocean", "olive", "onion", "orange", "orbit", "orchid",
+	"otter", "oyster", "paddle", "palace", "panda", "paper", "parrot", "peach",
+	"pebble", "pelican", "pepper", "piano", "pillow", "pilot", "planet", "plum",
+	"pocket", "pony", "potato", "pumpkin", "puzzle", "quartz", "rabbit", "radar",
+	"rainbow", "raven", "ribbon", "river", "robot", "rocket", "saddle", "salmon",
+	"sandal", "satin", "scarf", "shadow", "shell", "silver", "sketch", "slipper",
+}
+
+func NewMnemonic() string {
+	// generate a mnemonic from fresh random entropy
+	entropy := make([]byte, config.MnemonicEntropyLength)
+	_, err := rand.Read(entropy)
+	utils.Handle(err)
+	return EntropyToMnemonic(entropy)
+}
+
+func EntropyToMnemonic(entropy []byte) string {
+	checksum := sha256.Sum256(entropy)
+	var words []string
+	for _, b := range append(append([]byte{}, entropy...), checksum[0]) {
+		words = append(words, mnemonicWordList[b])
+	}
+	return strings.Join(words, " ")
+}
+
+func findMnemonicWord(word string) (byte, bool) {
+	word = strings.ToLower(word)
+	if len(word) > 4 {
+		word = word[:4]
+	}
+	for idx, candidate := range mnemonicWordList {
+		if candidate == word || (len(word) == 4 && strings.HasPrefix(candidate, word)) {
+			return byte(idx), true
+		}
+	}
+	return 0, false
+}
+
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	// decode a mnemonic back into entropy, checking its length and checksum
+	words := strings.Fields(mnemonic)
+	if len(words) != config.MnemonicEntropyLength+1 {
+		return nil, errors.New("wrong number of words in mnemonic")
+	}
+	var decoded []byte
+	for _, word := range words {
+		b, found := findMnemonicWord(word)
+		if !found {
+			return nil, errors.New("unknown word in mnemonic: " + word)
+		}
+		decoded = append(decoded, b)
+	}
+	entropy := decoded[:config.MnemonicEntropyLength]
+	checksum := sha256.Sum256(entropy)
+	if checksum[0] != decoded[config.MnemonicEntropyLength] {
+		return nil, errors.New("wrong mnemonic checksum")
+	}
+	return entropy, nil
+}
+
+func NormalizeMnemonic(mnemonic string) (string, error) {
+	// rewrite a mnemonic with full words, so that abbreviated input gives the same seed
+	entropy, err := MnemonicToEntropy(mnemonic)
+	if err != nil {
+		return "", err
+	}
+	return EntropyToMnemonic(entropy), nil
+}
+
+func MnemonicToSeed(mnemonic string) []byte {
+	// stretch the mnemonic into a 64 byte seed, the same way as BIP39 without passphrase
+	return pbkdf2.Key([]byte(mnemonic), []byte("mnemonic"), 2048, 64, sha512.New)
+}
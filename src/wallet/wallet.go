@@ -1,12 +1,14 @@
 package wallet
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/utils"
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 	"math/big"
 )
@@ -15,8 +17,10 @@ type Wallet struct {
 	// PrivateKey is generated using Elliptic Curve Digital Signature Algorithm
 	// PublicKeyHash goes through a more complicated process, similar to Bitcoin, see also
 	// https://dev.to/nheindev/building-a-blockchain-in-go-pt-v-wallets-12na
+	// Path: HD derivation path of the key, empty for wallets with a random key
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
+	Path       string
 }
 
 func GenerateKeyPair() (ecdsa.PrivateKey, []byte) {
@@ -24,9 +28,12 @@ func GenerateKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	utils.Handle(err)
-	// public key, ... means append after
-	publicKey := append(privateKey.PublicKey.X.Bytes(), privateKey.PublicKey.Y.Bytes()...)
-	return *privateKey, publicKey
+	return *privateKey, SerializePublicKey(&privateKey.PublicKey)
+}
+
+func SerializePublicKey(publicKey *ecdsa.PublicKey) []byte {
+	// public key is X | Y, both padded to 32 bytes so that it can be split in half
+	return append(publicKey.X.FillBytes(make([]byte, 32)), publicKey.Y.FillBytes(make([]byte, 32))...)
 }
 
 func DeserializePublicKey(publicKey []byte) ecdsa.PublicKey {
@@ -51,22 +58,43 @@ func PublicKeyHash(publicKey []byte) []byte {
 	return publicKeyAfterRipemd
 }
 
-func Checksum(ripemdHash []byte) []byte {
+func Checksum(ripemdHash []byte, format config.WalletParams) []byte {
 	firstHash := sha256.Sum256(ripemdHash)
 	secondHash := sha256.Sum256(firstHash[:])
-	return secondHash[:config.ChecksumLength]
+	return secondHash[:format.ChecksumLength]
+}
+
+func ValidateAddress(address []byte, format config.WalletParams) bool {
+	// address is base58(version | public key hash | checksum)
+	decoded, err := base58.Decode(string(address))
+	if err != nil || len(decoded) != 1+ripemd160.Size+format.ChecksumLength || decoded[0] != format.Version {
+		return false
+	}
+	versionedHash := decoded[:len(decoded)-format.ChecksumLength]
+	checksum := decoded[len(decoded)-format.ChecksumLength:]
+	return bytes.Compare(Checksum(versionedHash, format), checksum) == 0
+}
+
+func AddressToPubKeyHash(address []byte) []byte {
+	// strip version and checksum from address, address should be validated before
+	decoded := utils.Base58Decode(address)
+	return decoded[1 : 1+ripemd160.Size]
 }
 
 func CreateWallet() *Wallet {
 	privateKey, publicKey := GenerateKeyPair()
-	newWallet := Wallet{privateKey, publicKey}
+	newWallet := Wallet{PrivateKey: privateKey, PublicKey: publicKey}
 	return &newWallet
 }
 
-func (w *Wallet) Address() []byte {
+func (w *Wallet) PubKeyHash() []byte {
+	return PublicKeyHash(w.PublicKey)
+}
+
+func (w *Wallet) Address(format config.WalletParams) []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
-	versionedHash := append([]byte{config.WalletVersion}, pubHash...)
-	checksum := Checksum(versionedHash)
+	versionedHash := append([]byte{format.Version}, pubHash...)
+	checksum := Checksum(versionedHash, format)
 	finalHash := append(versionedHash, checksum...)
 	address := utils.Base58Encode(finalHash)
 	return address
@@ -2,37 +2,310 @@ package wallet
 
 import (
 	"bytes"
-	"sync"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"github.com/AntonyMei/Blockchain/config"
 	"github.com/AntonyMei/Blockchain/src/utils"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"sync"
+	"time"
 )
 
 type Wallets struct {
 	PersonalWalletMap map[string]*Wallet
 	KnownAddressMap   map[string]*KnownAddress
 	WalletPath        string
-	mu                sync.Mutex
+	// Params: address format of the network these wallets are used on
+	Params config.WalletParams
+	// Mnemonic: backup of the seed that personal wallets are derived from
+	// NextIndex: next unused index on receive and change chain
+	// Mnemonic and private keys are only in memory while wallets are unlocked
+	Mnemonic  string
+	NextIndex [2]uint32
+	masterKey *ExtendedKey
+	// secret: encrypted mnemonic and random keys, as saved in wallet file
+	// fileKey: key derived from passphrase, nil when wallets are locked
+	secret    encryptedSecret
+	fileKey   []byte
+	lockTimer *time.Timer
+	mu        sync.Mutex
+}
+
+type walletFile struct {
+	// what is saved on disk: public keys are kept in plain text so that locked wallets
+	// can still show addresses and receive coins, everything that can spend is in Secret
+	// Version: see config.WalletFileVersion, files written before it existed have 0
+	Version        int
+	NextIndex      [2]uint32
+	WalletPaths    map[string]string
+	PublicKeys     map[string][]byte
+	KnownAddresses map[string]knownAddressFile
+	Secret         encryptedSecret
+}
+
+type plainWalletFile struct {
+	// wallet file of version 0 without Secret, it is only read to be migrated
+	Mnemonic       string
+	NextIndex      [2]uint32
+	WalletPaths    map[string]string
+	RandomKeys     map[string][]byte
+	KnownAddresses map[string]knownAddressFile
+}
+
+type legacyWalletsFile struct {
+	// wallet file written before HD wallets existed, a gob of Wallets with whole ecdsa keys;
+	// curves in it are skipped, private keys and known addresses are rebuilt on P256
+	PersonalWalletMap map[string]*legacyWallet
+	KnownAddressMap   map[string]*legacyKnownAddress
 }
 
-func InitializeWallets(userName string) (*Wallets, error) {
-	// create new wallets
-	wallets := Wallets{}
+type legacyWallet struct {
+	PrivateKey struct {
+		D *big.Int
+	}
+}
+
+type legacyKnownAddress struct {
+	PublicKey struct {
+		X *big.Int
+		Y *big.Int
+	}
+	Address []byte
+}
+
+type walletSecret struct {
+	// keys of HD wallets are derived again from mnemonic, RandomKeys only keeps
+	// wallets with random keys, e.g. those created before HD wallets existed
+	Mnemonic   string
+	RandomKeys map[string][]byte
+}
+
+type knownAddressFile struct {
+	PublicKey []byte
+	Address   []byte
+}
+
+func InitializeWallets(cfg *config.Config, userName string) (*Wallets, error) {
+	// create new wallets, they are unlocked if the file has no passphrase yet
+	wallets := Wallets{Params: cfg.Wallet}
 	wallets.PersonalWalletMap = make(map[string]*Wallet)
 	wallets.KnownAddressMap = make(map[string]*KnownAddress)
-	wallets.WalletPath = config.PersistentStoragePath + userName + config.WalletFileName
+	wallets.WalletPath = cfg.UserPath(userName) + config.WalletFileName
 	err := wallets.LoadFile()
-	return &wallets, err
+	if os.IsNotExist(err) {
+		// a new seed for new wallets, protected by an empty passphrase until one is set
+		wallets.secret, wallets.fileKey = newEncryptedSecret("")
+		wallets.setMnemonic(NewMnemonic())
+		return &wallets, err
+	}
+	// a file that can not be read must not be replaced by new wallets
+	utils.Handle(err)
+	if wallets.fileKey == nil {
+		_ = wallets.Unlock("", 0)
+	}
+	return &wallets, nil
+}
+
+func (ws *Wallets) setMnemonic(mnemonic string) {
+	ws.Mnemonic = mnemonic
+	ws.masterKey = NewMasterKey(MnemonicToSeed(mnemonic))
+}
+
+func (ws *Wallets) IsLocked() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.fileKey == nil
+}
+
+func (ws *Wallets) Unlock(passphrase string, timeout time.Duration) error {
+	// decrypt secrets and put private keys back into wallets, wallets are locked
+	// again after timeout (never if timeout is 0)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	key, err := ws.secret.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	plaintext, err := ws.secret.open(key)
+	if err != nil {
+		return err
+	}
+	var secret walletSecret
+	decoder := gob.NewDecoder(bytes.NewReader(plaintext))
+	if err := decoder.Decode(&secret); err != nil {
+		return err
+	}
+
+	// keys are written into existing wallets, so that wallets held by others are unlocked too
+	ws.setMnemonic(secret.Mnemonic)
+	for name, wallet := range ws.PersonalWalletMap {
+		var unlocked *Wallet
+		if wallet.Path != "" {
+			derived, err := ws.masterKey.DerivePath(wallet.Path)
+			if err != nil {
+				return err
+			}
+			unlocked = derived.Wallet(wallet.Path)
+		} else if randomKey, ok := secret.RandomKeys[name]; ok {
+			unlocked = (&ExtendedKey{Key: new(big.Int).SetBytes(randomKey)}).Wallet("")
+		} else {
+			continue
+		}
+		*wallet = *unlocked
+	}
+	ws.fileKey = key
+
+	// restart lock timer
+	if ws.lockTimer != nil {
+		ws.lockTimer.Stop()
+		ws.lockTimer = nil
+	}
+	if timeout > 0 {
+		ws.lockTimer = time.AfterFunc(timeout, ws.Lock)
+	}
+	return nil
 }
 
-func (ws *Wallets) CreateWallet(name string) []byte {
+func (ws *Wallets) Lock() {
+	// drop mnemonic and private keys from memory, wallets can still be listed
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.lockTimer != nil {
+		ws.lockTimer.Stop()
+		ws.lockTimer = nil
+	}
+	// keep secrets created since last save, they can not be saved once keys are dropped
+	if ws.fileKey != nil {
+		utils.Handle(ws.sealSecret())
+	}
+	for _, wallet := range ws.PersonalWalletMap {
+		if wallet.PrivateKey.D != nil {
+			wallet.PrivateKey.D.SetInt64(0)
+			wallet.PrivateKey.D = nil
+		}
+	}
+	ws.Mnemonic = ""
+	ws.masterKey = nil
+	ws.fileKey = nil
+}
+
+func (ws *Wallets) ChangePassphrase(oldPassphrase string, newPassphrase string) error {
+	// secrets are encrypted again with a fresh salt, wallets stay locked or unlocked
+	ws.mu.Lock()
+	// secrets created since last save are sealed first, e.g. the seed of a new wallet file
+	if ws.fileKey != nil {
+		if err := ws.sealSecret(); err != nil {
+			ws.mu.Unlock()
+			return err
+		}
+	}
+	oldKey, err := ws.secret.deriveKey(oldPassphrase)
+	if err != nil {
+		ws.mu.Unlock()
+		return err
+	}
+	plaintext, err := ws.secret.open(oldKey)
+	if err != nil {
+		ws.mu.Unlock()
+		return err
+	}
+	secret, key := newEncryptedSecret(newPassphrase)
+	if err := secret.seal(key, plaintext); err != nil {
+		ws.mu.Unlock()
+		return err
+	}
+	ws.secret = secret
+	if ws.fileKey != nil {
+		ws.fileKey = key
+	}
+	ws.mu.Unlock()
+	return ws.SaveFile()
+}
+
+func (ws *Wallets) deriveWallet(chain uint32, index uint32) (*Wallet, error) {
+	path := WalletPath(chain, index)
+	key, err := ws.masterKey.DerivePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return key.Wallet(path), nil
+}
+
+func (ws *Wallets) DeriveWallet(name string, chain uint32) ([]byte, error) {
+	// derive a fresh key on receive or change chain and save it as a wallet
 	// returns address of that wallet
-	wallet := CreateWallet()
-	ws.PersonalWalletMap[name] = wallet
-	return wallet.Address()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.fileKey == nil {
+		return nil, ErrWalletLocked
+	}
+	for {
+		index := ws.NextIndex[chain]
+		ws.NextIndex[chain] += 1
+		// an index without valid key is skipped, as BIP32 suggests
+		if wallet, err := ws.deriveWallet(chain, index); err == nil {
+			ws.PersonalWalletMap[name] = wallet
+			return wallet.Address(ws.Params), nil
+		}
+	}
+}
+
+func (ws *Wallets) CreateWallet(name string) ([]byte, error) {
+	// returns address of that wallet
+	return ws.DeriveWallet(name, ReceiveChain)
+}
+
+// ErrSeedInUse is returned by Restore when wallets of the current seed have been used on chain
+var ErrSeedInUse = errors.New("wallets of current seed have been used, restoring would drop them")
+
+func (ws *Wallets) Restore(mnemonic string, isUsed func(*Wallet) bool, force bool) (int, error) {
+	// replace the seed with the one behind mnemonic, and find wallets derived from it by
+	// scanning both chains until HDGapLimit unused keys in a row, they are named
+	// receive-[index] and change-[index]; returns number of wallets found
+	// the old seed can only be replaced while none of its wallets is used, unless forced
+	mnemonic, err := NormalizeMnemonic(mnemonic)
+	if err != nil {
+		return 0, err
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.fileKey == nil {
+		return 0, ErrWalletLocked
+	}
+	if !force && mnemonic != ws.Mnemonic {
+		for _, wallet := range ws.PersonalWalletMap {
+			if wallet.Path != "" && isUsed(wallet) {
+				return 0, ErrSeedInUse
+			}
+		}
+	}
+	for name, wallet := range ws.PersonalWalletMap {
+		if wallet.Path != "" {
+			delete(ws.PersonalWalletMap, name)
+		}
+	}
+	ws.setMnemonic(mnemonic)
+	found := 0
+	for chain, prefix := range []string{"receive", "change"} {
+		ws.NextIndex[chain] = 0
+		for index, gap := uint32(0), 0; gap < config.HDGapLimit; index++ {
+			wallet, err := ws.deriveWallet(uint32(chain), index)
+			if err != nil || !isUsed(wallet) {
+				gap += 1
+				continue
+			}
+			gap = 0
+			ws.PersonalWalletMap[fmt.Sprintf("%s-%d", prefix, index)] = wallet
+			ws.NextIndex[chain] = index + 1
+			found += 1
+		}
+	}
+	return found, nil
 }
 
 func (ws *Wallets) AddWallet(name string, wallet *Wallet) {
@@ -77,16 +350,66 @@ func (ws *Wallets) GetAllWalletNames() []string {
 	return accountNames
 }
 
-func (ws *Wallets) SaveFile() {
+func (ws *Wallets) sealSecret() error {
+	// encrypt mnemonic and random keys in memory into secret, wallets must be unlocked
+	secret := walletSecret{Mnemonic: ws.Mnemonic, RandomKeys: make(map[string][]byte)}
+	for name, wallet := range ws.PersonalWalletMap {
+		if wallet.Path == "" && wallet.PrivateKey.D != nil {
+			secret.RandomKeys[name] = wallet.PrivateKey.D.Bytes()
+		}
+	}
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(secret); err != nil {
+		return err
+	}
+	return ws.secret.seal(ws.fileKey, plaintext.Bytes())
+}
+
+func (ws *Wallets) SaveFile() error {
+	// secrets are encrypted again only when unlocked, otherwise the saved ones are kept
+	ws.mu.Lock()
+	if ws.fileKey != nil {
+		if err := ws.sealSecret(); err != nil {
+			ws.mu.Unlock()
+			return err
+		}
+	} else if len(ws.secret.Ciphertext) == 0 {
+		// nothing to keep, writing the file would lose the mnemonic
+		ws.mu.Unlock()
+		return errors.New("wallet secrets are not loaded, wallet file is not saved")
+	}
+	file := walletFile{Version: config.WalletFileVersion, NextIndex: ws.NextIndex,
+		WalletPaths: make(map[string]string), PublicKeys: make(map[string][]byte),
+		KnownAddresses: make(map[string]knownAddressFile), Secret: ws.secret}
+	for name, wallet := range ws.PersonalWalletMap {
+		file.PublicKeys[name] = wallet.PublicKey
+		if wallet.Path != "" {
+			file.WalletPaths[name] = wallet.Path
+		}
+	}
+	for name, knownAddress := range ws.KnownAddressMap {
+		file.KnownAddresses[name] = knownAddressFile{PublicKey: SerializePublicKey(&knownAddress.PublicKey),
+			Address: knownAddress.Address}
+	}
+
 	// encode the wallets
 	var content bytes.Buffer
-	gob.Register(elliptic.P256())
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
-	utils.Handle(err)
-	// save to file
-	err = ioutil.WriteFile(ws.WalletPath, content.Bytes(), 0644)
-	utils.Handle(err)
+	err := encoder.Encode(file)
+	ws.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// write a new file and move it over the old one, so that the old one is never half written;
+	// only readable by owner
+	tmpPath := ws.WalletPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, ws.WalletPath)
 }
 
 func (ws *Wallets) LoadFile() error {
@@ -97,15 +420,87 @@ func (ws *Wallets) LoadFile() error {
 
 	// read the file
 	fileContent, err := ioutil.ReadFile(ws.WalletPath)
-	utils.Handle(err)
+	if err != nil {
+		return err
+	}
 
-	// encode it back into a wallet
-	var wallets Wallets
-	gob.Register(elliptic.P256())
+	// encode it back into locked wallets
+	var file walletFile
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
-	utils.Handle(err)
-	ws.PersonalWalletMap = wallets.PersonalWalletMap
-	ws.KnownAddressMap = wallets.KnownAddressMap
+	if err := decoder.Decode(&file); err != nil {
+		// wallets of a file written before HD wallets existed become wallets with random keys
+		var legacy legacyWalletsFile
+		if gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&legacy) != nil {
+			return err
+		}
+		secret := walletSecret{RandomKeys: make(map[string][]byte)}
+		for name, wallet := range legacy.PersonalWalletMap {
+			if wallet != nil && wallet.PrivateKey.D != nil {
+				secret.RandomKeys[name] = wallet.PrivateKey.D.Bytes()
+			}
+		}
+		knownAddresses := make(map[string]knownAddressFile)
+		for name, knownAddress := range legacy.KnownAddressMap {
+			if knownAddress == nil || knownAddress.PublicKey.X == nil || knownAddress.PublicKey.Y == nil {
+				continue
+			}
+			publicKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: knownAddress.PublicKey.X,
+				Y: knownAddress.PublicKey.Y}
+			knownAddresses[name] = knownAddressFile{PublicKey: SerializePublicKey(&publicKey),
+				Address: knownAddress.Address}
+		}
+		return ws.migrate(secret, [2]uint32{}, nil, knownAddresses)
+	}
+	if file.Version > config.WalletFileVersion {
+		return fmt.Errorf("wallet file has version %v, this build reads up to %v", file.Version,
+			config.WalletFileVersion)
+	}
+	if file.Version == 0 && len(file.Secret.Ciphertext) == 0 {
+		// secrets in plain text, written before wallet file was encrypted
+		var plain plainWalletFile
+		if err := gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&plain); err != nil {
+			return err
+		}
+		return ws.migrate(walletSecret{Mnemonic: plain.Mnemonic, RandomKeys: plain.RandomKeys},
+			plain.NextIndex, plain.WalletPaths, plain.KnownAddresses)
+	}
+	ws.NextIndex = file.NextIndex
+	ws.secret = file.Secret
+	for name, publicKey := range file.PublicKeys {
+		wallet := Wallet{PublicKey: publicKey, Path: file.WalletPaths[name]}
+		wallet.PrivateKey.PublicKey = DeserializePublicKey(publicKey)
+		ws.PersonalWalletMap[name] = &wallet
+	}
+	for name, knownAddress := range file.KnownAddresses {
+		ws.KnownAddressMap[name] = &KnownAddress{PublicKey: DeserializePublicKey(knownAddress.PublicKey),
+			Address: knownAddress.Address}
+	}
 	return nil
 }
+
+func (ws *Wallets) migrate(secret walletSecret, nextIndex [2]uint32, walletPaths map[string]string,
+	knownAddresses map[string]knownAddressFile) error {
+	// put secrets of an old wallet file under an empty passphrase and save it in current format,
+	// wallets are unlocked afterwards; a file without mnemonic gets a new seed for HD wallets
+	ws.secret, ws.fileKey = newEncryptedSecret("")
+	if secret.Mnemonic == "" {
+		secret.Mnemonic = NewMnemonic()
+	}
+	ws.setMnemonic(secret.Mnemonic)
+	ws.NextIndex = nextIndex
+	for name, path := range walletPaths {
+		key, err := ws.masterKey.DerivePath(path)
+		if err != nil {
+			return err
+		}
+		ws.PersonalWalletMap[name] = key.Wallet(path)
+	}
+	for name, randomKey := range secret.RandomKeys {
+		ws.PersonalWalletMap[name] = (&ExtendedKey{Key: new(big.Int).SetBytes(randomKey)}).Wallet("")
+	}
+	for name, knownAddress := range knownAddresses {
+		ws.KnownAddressMap[name] = &KnownAddress{PublicKey: DeserializePublicKey(knownAddress.PublicKey),
+			Address: knownAddress.Address}
+	}
+	return ws.SaveFile()
+}
@@ -0,0 +1,277 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/gob"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/AntonyMei/Blockchain/config"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	// config with a data dir of its own and directory of user "alice" in it
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	if err := os.MkdirAll(cfg.UserPath("alice"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestWalletFileRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	wallets, err := InitializeWallets(cfg, "alice")
+	if !os.IsNotExist(err) {
+		t.Fatalf("new wallet file: got %v", err)
+	}
+	address, err := wallets.CreateWallet("hd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := CreateWallet()
+	wallets.AddWallet("random", random)
+	mnemonic := wallets.Mnemonic
+	if err := wallets.ChangePassphrase("", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// secrets are not in the file in plain text
+	content, err := ioutil.ReadFile(wallets.WalletPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte(mnemonic)) || bytes.Contains(content, random.PrivateKey.D.Bytes()) {
+		t.Fatal("wallet file contains secrets in plain text")
+	}
+
+	// file with a passphrase is loaded locked, addresses are still known
+	loaded, err := InitializeWallets(cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.IsLocked() {
+		t.Fatal("wallets with passphrase are unlocked after loading")
+	}
+	if !bytes.Equal(loaded.GetWallet("hd").Address(cfg.Wallet), address) {
+		t.Fatal("address of HD wallet changed")
+	}
+	if err := loaded.Unlock("wrong", 0); err != ErrWrongPassphrase {
+		t.Fatalf("unlock with wrong passphrase: got %v", err)
+	}
+	if err := loaded.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Mnemonic != mnemonic {
+		t.Fatal("mnemonic changed")
+	}
+	if loaded.GetWallet("random").PrivateKey.D.Cmp(random.PrivateKey.D) != 0 {
+		t.Fatal("random key changed")
+	}
+
+	// saving locked wallets keeps the secrets of the file
+	loaded.Lock()
+	if err := loaded.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := InitializeWallets(cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Unlock("secret", 0); err != nil {
+		t.Fatal(err)
+	}
+	if again.Mnemonic != mnemonic {
+		t.Fatal("mnemonic lost by saving locked wallets")
+	}
+}
+
+func TestWalletFileUpgrade(t *testing.T) {
+	// a file written before wallet file was encrypted keeps its secrets in plain text
+	cfg := testConfig(t)
+	mnemonic := NewMnemonic()
+	hdKey, err := NewMasterKey(MnemonicToSeed(mnemonic)).DerivePath(WalletPath(ReceiveChain, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := CreateWallet()
+	plain := plainWalletFile{Mnemonic: mnemonic, NextIndex: [2]uint32{1, 0},
+		WalletPaths: map[string]string{"hd": WalletPath(ReceiveChain, 0)},
+		RandomKeys:  map[string][]byte{"random": random.PrivateKey.D.Bytes()}}
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(plain); err != nil {
+		t.Fatal(err)
+	}
+	path := cfg.UserPath("alice") + config.WalletFileName
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// secrets are moved under an empty passphrase and the file is saved in current format
+	wallets, err := InitializeWallets(cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wallets.IsLocked() || wallets.Mnemonic != mnemonic {
+		t.Fatal("secrets of old wallet file are not loaded")
+	}
+	if !bytes.Equal(wallets.GetWallet("hd").Address(cfg.Wallet), hdKey.Wallet("").Address(cfg.Wallet)) {
+		t.Fatal("HD wallet of old wallet file is not loaded")
+	}
+	if wallets.GetWallet("random").PrivateKey.D.Cmp(random.PrivateKey.D) != 0 {
+		t.Fatal("random key of old wallet file is not loaded")
+	}
+	upgraded, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file walletFile
+	if err := gob.NewDecoder(bytes.NewReader(upgraded)).Decode(&file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Version != config.WalletFileVersion || len(file.Secret.Ciphertext) == 0 {
+		t.Fatalf("wallet file is not upgraded, version %v", file.Version)
+	}
+	if bytes.Contains(upgraded, []byte(mnemonic)) {
+		t.Fatal("upgraded wallet file contains mnemonic in plain text")
+	}
+	if wallets.NextIndex != [2]uint32{1, 0} {
+		t.Fatalf("next index changed to %v", wallets.NextIndex)
+	}
+}
+
+func TestWalletFileNewerVersion(t *testing.T) {
+	// a file of a newer build is not understood, and must be left as it is
+	cfg := testConfig(t)
+	var content bytes.Buffer
+	file := walletFile{Version: config.WalletFileVersion + 1, PublicKeys: map[string][]byte{"a": {1}}}
+	if err := gob.NewEncoder(&content).Encode(file); err != nil {
+		t.Fatal(err)
+	}
+	path := cfg.UserPath("alice") + config.WalletFileName
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wallets := Wallets{PersonalWalletMap: make(map[string]*Wallet), KnownAddressMap: make(map[string]*KnownAddress),
+		WalletPath: path}
+	if err := wallets.LoadFile(); err == nil {
+		t.Fatal("wallet file of newer version is loaded")
+	}
+	if err := wallets.SaveFile(); err == nil {
+		t.Fatal("wallet file is saved without its secrets")
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, content.Bytes()) {
+		t.Fatal("wallet file of newer version is overwritten")
+	}
+}
+
+// wallet file written before HD wallets existed is a gob of Wallets, whose keys are ecdsa keys
+// with a P256 curve in them (p256Curve of older go versions)
+type oldCurve struct {
+	*elliptic.CurveParams
+}
+
+type oldPublicKey struct {
+	elliptic.Curve
+	X, Y *big.Int
+}
+
+type oldWallet struct {
+	PrivateKey struct {
+		PublicKey oldPublicKey
+		D         *big.Int
+	}
+	PublicKey []byte
+}
+
+type oldKnownAddress struct {
+	PublicKey oldPublicKey
+	Address   []byte
+}
+
+type oldWallets struct {
+	PersonalWalletMap map[string]*oldWallet
+	KnownAddressMap   map[string]*oldKnownAddress
+	WalletPath        string
+}
+
+func TestWalletFileBeforeHD(t *testing.T) {
+	cfg := testConfig(t)
+	gob.RegisterName("crypto/elliptic.p256Curve", oldCurve{})
+	curve := oldCurve{elliptic.P256().Params()}
+	random := CreateWallet()
+	var old oldWallet
+	old.PrivateKey.PublicKey = oldPublicKey{curve, random.PrivateKey.X, random.PrivateKey.Y}
+	old.PrivateKey.D = random.PrivateKey.D
+	old.PublicKey = random.PublicKey
+	path := cfg.UserPath("alice") + config.WalletFileName
+	file := oldWallets{PersonalWalletMap: map[string]*oldWallet{"alice": &old},
+		KnownAddressMap: map[string]*oldKnownAddress{"alice": {PublicKey: old.PrivateKey.PublicKey,
+			Address: random.Address(cfg.Wallet)}}, WalletPath: path}
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys become random keys of the encrypted secret, and a seed is created for HD wallets
+	wallets, err := InitializeWallets(cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wallets.IsLocked() || wallets.Mnemonic == "" {
+		t.Fatal("wallets of old wallet file have no seed")
+	}
+	loaded := wallets.GetWallet("alice")
+	if loaded == nil || loaded.PrivateKey.D.Cmp(random.PrivateKey.D) != 0 || loaded.Path != "" {
+		t.Fatal("key of old wallet file is not loaded as random key")
+	}
+	knownAddress := wallets.GetKnownAddress("alice")
+	if knownAddress == nil || !bytes.Equal(knownAddress.Address, random.Address(cfg.Wallet)) ||
+		knownAddress.PublicKey.X.Cmp(random.PrivateKey.X) != 0 {
+		t.Fatal("known address of old wallet file is not loaded")
+	}
+
+	// the file is saved in current format and loads as usual
+	again, err := InitializeWallets(cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.GetWallet("alice").PrivateKey.D.Cmp(random.PrivateKey.D) != 0 || again.Mnemonic != wallets.Mnemonic {
+		t.Fatal("migrated wallet file does not load")
+	}
+}
+
+func TestRestoreKeepsUsedSeed(t *testing.T) {
+	cfg := testConfig(t)
+	wallets, _ := InitializeWallets(cfg, "alice")
+	address, err := wallets.CreateWallet("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnemonic := wallets.Mnemonic
+	isUsed := func(w *Wallet) bool { return bytes.Equal(w.Address(cfg.Wallet), address) }
+
+	// seed with a used wallet is only replaced when forced
+	if _, err := wallets.Restore(NewMnemonic(), isUsed, false); err != ErrSeedInUse {
+		t.Fatalf("restore over used seed: got %v", err)
+	}
+	if wallets.Mnemonic != mnemonic || wallets.GetWallet("alice") == nil {
+		t.Fatal("refused restore changed wallets")
+	}
+	if _, err := wallets.Restore(NewMnemonic(), isUsed, true); err != nil {
+		t.Fatal(err)
+	}
+	if wallets.Mnemonic == mnemonic || wallets.GetWallet("alice") != nil {
+		t.Fatal("forced restore kept old seed")
+	}
+}